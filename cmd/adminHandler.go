@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/balgabekj/go_car/pkg/model"
+	"github.com/balgabekj/go_car/pkg/validator"
+	"github.com/gorilla/mux"
+)
+
+// adminUser is the view of a user returned by the admin endpoints. Unlike the public
+// representation it includes the record version, which clients send back in the
+// X-Expected-Version header to avoid overwriting concurrent changes.
+type adminUser struct {
+	*model.User
+	Version int `json:"version"`
+}
+
+// adminListUsersHandler lists users, optionally filtered by email, name, activation status and
+// creation date.
+func (app *application) adminListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		model.UserFilter
+		model.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Email = app.readStrings(qs, "email", "")
+	input.Name = app.readStrings(qs, "name", "")
+	input.Activated = app.readBool(qs, "activated", v)
+	input.CreatedAfter = app.readDate(qs, "created_after", v)
+	input.CreatedBefore = app.readDate(qs, "created_before", v)
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readStrings(qs, "sort", "id")
+	input.Filters.SortSafeList = []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+
+	if model.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(input.UserFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	result := make([]adminUser, len(users))
+	for i, user := range users {
+		result[i] = adminUser{User: user, Version: user.Version}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": result, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminShowUserHandler shows a user together with their roles, effective permissions and the
+// number of cars they have listed.
+func (app *application) adminShowUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	cars, err := app.models.Cars.CountForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"user":        adminUser{User: user, Version: user.Version},
+		"roles":       roles,
+		"permissions": permissions,
+		"car_count":   cars,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminUpdateUserHandler deactivates or reactivates a user. Deactivating a user also ends all of
+// their sessions, and they can't reactivate the account themselves with an activation token.
+func (app *application) adminUpdateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.checkExpectedVersion(w, r, user) {
+		return
+	}
+
+	var input struct {
+		Activated *bool `json:"activated"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Activated == nil {
+		v := validator.New()
+		v.AddError("activated", "must be provided")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user.Activated = *input.Activated
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !user.Activated {
+		if err := app.revokeAllTokens(user.ID); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.logAdminAction(r, "user activation changed", user.ID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": adminUser{User: user, Version: user.Version}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminForcePasswordResetHandler invalidates a user's current password, ends all of their
+// sessions and emails them a password reset token, e.g. after a suspected account compromise.
+func (app *application) adminForcePasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.checkExpectedVersion(w, r, user) {
+		return
+	}
+
+	// Replace the password with a random one nobody knows, so the old password stops working
+	// straight away.
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err := user.Password.Set(base64.RawURLEncoding.EncodeToString(randomBytes))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := app.revokeAllTokens(user.ID); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, model.ScopePasswordReset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.sendEmail(user.Email, "password_reset.tmpl", map[string]interface{}{
+		"passwordResetToken": token.Plaintext,
+	})
+
+	app.logAdminAction(r, "user password reset forced", user.ID)
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "the user's password has been reset and reset instructions have been emailed to them"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminRevokeTokensHandler ends every session of a user.
+func (app *application) adminRevokeTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	if err := app.revokeAllTokens(user.ID); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logAdminAction(r, "user tokens revoked", user.ID)
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"message": "all tokens for the user have been revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminGrantPermissionsHandler grants permission codes directly to a user.
+func (app *application) adminGrantPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	known, err := app.models.Permissions.GetAllCodes()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(len(input.Permissions) > 0, "permissions", "must contain at least 1 permission")
+	for _, code := range input.Permissions {
+		v.Check(known.Include(code), "permissions", "must only contain known permission codes")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Permissions.AddForUser(user.ID, input.Permissions...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logAdminAction(r, "user permissions granted", user.ID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "permissions successfully granted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminRevokePermissionHandler takes a directly granted permission code away from a user.
+func (app *application) adminRevokePermissionHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.Permissions.RemoveForUser(user.ID, mux.Vars(r)["code"])
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logAdminAction(r, "user permission revoked", user.ID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "permission successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkExpectedVersion compares the optional X-Expected-Version request header with the user's
+// current version. If they differ, a 409 Conflict response is sent and false is returned.
+func (app *application) checkExpectedVersion(w http.ResponseWriter, r *http.Request, user *model.User) bool {
+	expected := r.Header.Get("X-Expected-Version")
+	if expected == "" {
+		return true
+	}
+
+	if strconv.Itoa(user.Version) != expected {
+		app.editConflictResponse(w, r)
+		return false
+	}
+
+	return true
+}
+
+// revokeAllTokens ends every session of a user, including any pending two-factor logins. Calendar
+// feed URLs are revoked as well, since they give access to the user's schedule.
+func (app *application) revokeAllTokens(userID int64) error {
+	for _, scope := range []string{model.ScopeAuthentication, model.ScopeRefresh, model.ScopeMFAPending, model.ScopeCalendar} {
+		if err := app.models.Tokens.DeleteAllForUser(scope, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logAdminAction records an administrative change to a user account.
+func (app *application) logAdminAction(r *http.Request, message string, userID int64) {
+	app.logger.PrintInfo(message, map[string]string{
+		"user_id":  strconv.FormatInt(userID, 10),
+		"admin_id": strconv.FormatInt(app.contextGetUser(r).ID, 10),
+		"time":     time.Now().UTC().Format(time.RFC3339),
+	})
+}
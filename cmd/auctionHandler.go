@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/balgabekj/go_car/pkg/model"
+	"github.com/balgabekj/go_car/pkg/validator"
+)
+
+// createAuctionHandler puts one of the authenticated seller's cars up for auction, with prices in
+// the currency the car is listed in. The auction starts straight away unless starts_at is given.
+// Bids in the last extension_minutes (2 by default) extend the auction by that long.
+func (app *application) createAuctionHandler(w http.ResponseWriter, r *http.Request) {
+	car, ok := app.readCarParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		StartsAt         *time.Time  `json:"starts_at"`
+		EndsAt           time.Time   `json:"ends_at"`
+		StartingPrice    json.Number `json:"starting_price"`
+		ReservePrice     json.Number `json:"reserve_price"`
+		MinIncrement     json.Number `json:"min_increment"`
+		ExtensionMinutes *int        `json:"extension_minutes"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if int64(car.UserID) != user.ID {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	currency := car.Price.Currency
+
+	auction := &model.Auction{
+		CarID:            car.ID,
+		SellerID:         user.ID,
+		StartsAt:         time.Now().Truncate(time.Second),
+		EndsAt:           input.EndsAt.Truncate(time.Second),
+		StartingPrice:    app.parseAmount(input.StartingPrice, "starting_price", currency, v),
+		MinIncrement:     app.parseAmount(input.MinIncrement, "min_increment", currency, v),
+		ExtensionSeconds: 120,
+	}
+
+	if input.StartsAt != nil {
+		auction.StartsAt = input.StartsAt.Truncate(time.Second)
+	}
+	if input.ReservePrice != "" {
+		reserve := app.parseAmount(input.ReservePrice, "reserve_price", currency, v)
+		auction.ReservePrice = &reserve
+	}
+	if input.ExtensionMinutes != nil {
+		auction.ExtensionSeconds = *input.ExtensionMinutes * 60
+	}
+
+	if model.ValidateAuction(v, auction); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if car.Status != model.CarStatusAvailable {
+		app.errorResponse(w, r, http.StatusConflict, "the car is no longer available")
+		return
+	}
+
+	err = app.models.Auctions.Insert(auction)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrAuctionExists):
+			app.errorResponse(w, r, http.StatusConflict, "the car is already up for auction")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Reload the auction to fill in the car and the computed fields.
+	auction, err = app.models.Auctions.Get(auction.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/api/v1/auctions/%d", auction.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"auction": auction}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listAuctionsHandler lists auctions in a given status, live ones by default. They are sorted by
+// end time, soonest first, unless another sort is asked for.
+func (app *application) listAuctionsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		model.AuctionFilter
+		model.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Status = app.readStrings(qs, "status", model.AuctionStatusLive)
+	input.CarID = app.readInt(qs, "car_id", 0, v)
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readStrings(qs, "sort", "ends_at")
+	input.Filters.SortSafeList = []string{"ends_at", "current_price", "-ends_at", "-current_price"}
+
+	v.Check(validator.In(input.Status, model.AuctionStatusScheduled, model.AuctionStatusLive,
+		model.AuctionStatusEnded, model.AuctionStatusSold, model.AuctionStatusUnsold,
+		model.AuctionStatusCancelled), "status", "invalid status value")
+
+	if model.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	auctions, metadata, err := app.models.Auctions.GetAll(input.AuctionFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"auctions": auctions, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showAuctionHandler returns an auction. Authenticated users are also told whether they are in
+// the lead, and the seller of a sold car who the winner is.
+func (app *application) showAuctionHandler(w http.ResponseWriter, r *http.Request) {
+	auction, ok := app.readAuctionParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, app.auctionEnvelope(r, auction), nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// placeBidHandler bids on a live auction on behalf of the authenticated user, up to the maximum
+// they give. The response tells them whether they are now in the lead.
+func (app *application) placeBidHandler(w http.ResponseWriter, r *http.Request) {
+	auction, ok := app.readAuctionParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		MaxAmount json.Number `json:"max_amount"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	maxAmount := app.parseAmount(input.MaxAmount, "max_amount", auction.CurrentPrice.Currency, v)
+
+	if model.ValidateBidAmount(v, maxAmount); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if auction.SellerID == user.ID {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "you can't bid in your own auction")
+		return
+	}
+
+	blocked, err := app.models.Blocks.IsBlocked(user.ID, auction.SellerID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if blocked {
+		app.errorResponse(w, r, http.StatusForbidden, "you can't bid in this seller's auctions")
+		return
+	}
+
+	auction, err = app.models.Auctions.PlaceBid(auction.ID, user.ID, maxAmount)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrAuctionNotLive):
+			app.errorResponse(w, r, http.StatusConflict, "the auction is not live")
+		case errors.Is(err, model.ErrBidTooLow):
+			app.bidTooLowResponse(w, r, user.ID)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, app.auctionEnvelope(r, auction), nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listBidsHandler returns the bid history of an auction. Bidders are only shown by alias;
+// authenticated users who have bid are told which alias is theirs.
+func (app *application) listBidsHandler(w http.ResponseWriter, r *http.Request) {
+	auction, ok := app.readAuctionParam(w, r)
+	if !ok {
+		return
+	}
+
+	bids, err := app.models.Auctions.GetBids(auction.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"bids": bids}
+
+	if user := app.contextGetUser(r); !user.IsAnonymous() {
+		for _, bid := range bids {
+			if bid.BidderID == user.ID {
+				env["you"] = bid.Bidder
+				break
+			}
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// cancelAuctionHandler lets the seller, or a moderator, call off an auction, as long as nobody has
+// bid yet.
+func (app *application) cancelAuctionHandler(w http.ResponseWriter, r *http.Request) {
+	auction, ok := app.readAuctionParam(w, r)
+	if !ok {
+		return
+	}
+
+	allowed, err := app.canManageListing(r, auction.SellerID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !allowed {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	switch {
+	case auction.Status != model.AuctionStatusScheduled && auction.Status != model.AuctionStatusLive:
+		app.errorResponse(w, r, http.StatusConflict, fmt.Sprintf("the auction is already %s", auction.Status))
+		return
+	case auction.BidCount > 0:
+		app.errorResponse(w, r, http.StatusConflict, "the auction can't be cancelled once bids have been placed")
+		return
+	}
+
+	err = app.models.Auctions.Cancel(auction)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"auction": auction}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readAuctionParam loads the auction given by the "id" URL parameter.
+func (app *application) readAuctionParam(w http.ResponseWriter, r *http.Request) (*model.Auction, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	auction, err := app.models.Auctions.Get(int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return auction, true
+}
+
+// auctionEnvelope wraps an auction together with what the authenticated user may know about the
+// lead: whether they hold it, and for the seller of a sold car, who won.
+func (app *application) auctionEnvelope(r *http.Request, auction *model.Auction) envelope {
+	env := envelope{"auction": auction}
+
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		return env
+	}
+
+	env["leading"] = auction.IsLeading(user.ID)
+
+	if auction.Status == model.AuctionStatusSold && auction.SellerID == user.ID {
+		env["winner_id"] = auction.LeaderID
+	}
+
+	return env
+}
+
+// bidTooLowResponse reports a bid below the minimum. The auction is read again, because the
+// minimum may have gone up since the bid was checked.
+func (app *application) bidTooLowResponse(w http.ResponseWriter, r *http.Request, userID int64) {
+	id, _ := app.readIDParam(r)
+
+	auction, err := app.models.Auctions.Get(int64(id))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if auction.IsLeading(userID) {
+		v.AddError("max_amount", "must be more than your current maximum bid")
+	} else {
+		v.AddError("max_amount", fmt.Sprintf("must be at least %s", auction.MinimumBid.Decimal()))
+	}
+
+	app.failedValidationResponse(w, r, v.Errors)
+}
+
+// checkCarNotInAuction sends a 409 Conflict response and returns false if the car is in an
+// auction which hasn't been settled, since it can't be sold any other way until then.
+func (app *application) checkCarNotInAuction(w http.ResponseWriter, r *http.Request, carID int) bool {
+	open, err := app.models.Auctions.HasOpen(carID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if open {
+		app.errorResponse(w, r, http.StatusConflict, "the car is being sold by auction")
+		return false
+	}
+
+	return true
+}
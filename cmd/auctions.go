@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/balgabekj/go_car/pkg/model"
+)
+
+// startAuctionCloser periodically settles auctions which have ended: it determines the winner,
+// reserves the car for them and lets the winner and the seller know.
+func (app *application) startAuctionCloser() {
+	if app.config.auction.closeInterval <= 0 {
+		return
+	}
+
+	app.every(app.config.auction.closeInterval, app.closeAuctions)
+}
+
+// closeAuctions settles every auction which has ended. Auctions settled by an overlapping run,
+// or by another instance, are skipped.
+func (app *application) closeAuctions() {
+	ids, err := app.models.Auctions.GetEndedIDs()
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	for _, id := range ids {
+		auction, err := app.models.Auctions.Settle(id)
+		if err != nil {
+			if !errors.Is(err, model.ErrRecordNotFound) {
+				app.logger.PrintError(err, map[string]string{"auction_id": strconv.FormatInt(id, 10)})
+			}
+			continue
+		}
+
+		app.logger.PrintInfo("auction settled", map[string]string{
+			"auction_id": strconv.FormatInt(auction.ID, 10),
+			"status":     auction.Status,
+			"price":      auction.CurrentPrice.String(),
+		})
+
+		app.notifyAuctionSettled(auction)
+	}
+}
+
+// notifyAuctionSettled emails the seller the outcome of an auction, and the winner if there is
+// one.
+func (app *application) notifyAuctionSettled(auction *model.Auction) {
+	seller, err := app.models.Users.Get(auction.SellerID)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	app.sendEmail(seller.Email, "auction_ended.tmpl", map[string]interface{}{
+		"name":    seller.Name,
+		"auction": auction,
+		"sold":    auction.Status == model.AuctionStatusSold,
+	})
+
+	if auction.Status != model.AuctionStatusSold {
+		return
+	}
+
+	winner, err := app.models.Users.Get(*auction.LeaderID)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	app.sendEmail(winner.Email, "auction_won.tmpl", map[string]interface{}{
+		"name":    winner.Name,
+		"auction": auction,
+	})
+}
@@ -3,31 +3,88 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/balgabekj/go_car/pkg/model"
+	"github.com/balgabekj/go_car/pkg/money"
 	"github.com/balgabekj/go_car/pkg/validator"
 	"github.com/gorilla/mux"
 	"net/http"
-	"strconv"
+	"net/url"
+	"strings"
 )
 
+// carInput is the request body for creating and updating a car. The price is a decimal number in
+// the given currency, or in the default currency if none is given. The seller is always the
+// user making the request.
+type carInput struct {
+	Model        string      `json:"model"`
+	Brand        string      `json:"brand"`
+	Year         int         `json:"year"`
+	Price        json.Number `json:"price"`
+	Currency     string      `json:"currency"`
+	Color        string      `json:"color"`
+	IsUsed       bool        `json:"isUsed"`
+	CategoryName string      `json:"categoryName"`
+}
+
+// carFromInput returns the car described by the input. If the price or currency is invalid, the
+// error is recorded in the validator.
+func (app *application) carFromInput(input *carInput, v *validator.Validator) *model.Car {
+	car := &model.Car{
+		Model:        input.Model,
+		Brand:        input.Brand,
+		Year:         input.Year,
+		Color:        input.Color,
+		IsUsed:       input.IsUsed,
+		CategoryName: input.CategoryName,
+	}
+
+	currency := app.config.money.currency
+	if input.Currency != "" {
+		var ok bool
+		currency, ok = money.LookupCurrency(strings.ToUpper(input.Currency))
+		if !ok {
+			v.AddError("currency", "must be a supported ISO 4217 currency code")
+			return car
+		}
+	}
+
+	// A car may be listed without a price, e.g. when it is only up for auction.
+	car.Price = app.parseAmount(input.Price, "price", currency, v)
+	return car
+}
+
 func (app *application) createCarHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract car data from request body
-	var car model.Car
-	err := json.NewDecoder(r.Body).Decode(&car)
+	var input carInput
+	err := json.NewDecoder(r.Body).Decode(&input)
 	if err != nil {
 		app.models.Cars.ErrorLog.Println(err)
 		http.Error(w, "Error decoding data", http.StatusBadRequest)
 		return
 	}
 
+	v := validator.New()
+
+	car := app.carFromInput(&input, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	car.UserID = int(app.contextGetUser(r).ID)
+
 	// Insert car into the database
-	err = app.models.Cars.Insert(&car)
+	err = app.models.Cars.Insert(car)
 	if err != nil {
 		app.models.Cars.ErrorLog.Println(err)
 		http.Error(w, "Error creating car", http.StatusInternalServerError)
 		return
 	}
 
+	car.SuggestedPrice = app.suggestPrice(car)
+
 	// Return success response
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(car)
@@ -59,6 +116,7 @@ func (app *application) getAllCarHandler(w http.ResponseWriter, r *http.Request)
 		Brand   string
 		MinYear int
 		MaxYear int
+		Prices  model.PriceFilter
 		model.Filters
 	}
 	v := validator.New()
@@ -69,14 +127,30 @@ func (app *application) getAllCarHandler(w http.ResponseWriter, r *http.Request)
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 
+	// Prices are filtered and sorted in the requested currency, or in the default currency if
+	// none is requested. Converted prices are only returned when a currency is requested.
+	input.Prices.Currency = app.config.money.currency
+	if code := app.readStrings(qs, "currency", ""); code != "" {
+		currency, ok := money.LookupCurrency(strings.ToUpper(code))
+		v.Check(ok, "currency", "must be a supported ISO 4217 currency code")
+		input.Prices.Currency = currency
+		input.Prices.Convert = true
+	}
+	input.Prices.Min = app.readPrice(qs, "min_price", input.Prices.Currency, v)
+	input.Prices.Max = app.readPrice(qs, "max_price", input.Prices.Currency, v)
+
 	input.Filters.Sort = app.readStrings(qs, "sort", "id")
-	input.Filters.SortSafeList = []string{"id", "brand", "year", "-id", "-brand", "-year"}
+	input.Filters.SortSafeList = []string{"id", "brand", "year", "price", "-id", "-brand", "-year", "-price"}
 
 	if model.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	cars, metadata, err := app.models.Cars.GetAll(input.Brand, input.MinYear, input.MaxYear, input.Filters)
+	cars, metadata, err := app.models.Cars.GetAll(input.Brand, input.MinYear, input.MaxYear, input.Prices, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
 	err = app.writeJSON(w, http.StatusOK, envelope{"cars": cars, "metadata": metadata}, nil)
 
@@ -88,50 +162,105 @@ func (app *application) getAllCarHandler(w http.ResponseWriter, r *http.Request)
 	app.respondWithJson(w, http.StatusOK, cars)
 }
 
+// updateCarHandler updates one of the current user's cars. Once a car is reserved or sold its
+// price and currency are fixed, since orders are placed at that price.
 func (app *application) updateCarHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract car ID from URL parameters
-	params := mux.Vars(r)
-	id := params["id"]
+	existing, ok := app.readCarParam(w, r)
+	if !ok {
+		return
+	}
+
+	if int64(existing.UserID) != app.contextGetUser(r).ID {
+		app.notPermittedResponse(w, r)
+		return
+	}
 
 	// Extract car data from request body
-	var car model.Car
-	err := json.NewDecoder(r.Body).Decode(&car)
+	var input carInput
+	err := json.NewDecoder(r.Body).Decode(&input)
 	if err != nil {
 		app.models.Cars.ErrorLog.Println(err)
 		http.Error(w, "Error decoding data", http.StatusBadRequest)
 		return
 	}
 
-	// Set car ID for update
-	car.ID, _ = strconv.Atoi(id)
+	v := validator.New()
+
+	car := app.carFromInput(&input, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The seller, status and category aren't changed by an update.
+	car.ID = existing.ID
+	car.UserID = existing.UserID
+	car.Status = existing.Status
+	car.CategoryName = existing.CategoryName
 
 	// Update car in the database
-	err = app.models.Cars.Update(&car)
+	err = app.models.Cars.Update(car)
 	if err != nil {
-		app.models.Cars.ErrorLog.Println(err)
-		http.Error(w, "Error updating car", http.StatusInternalServerError)
+		switch {
+		case errors.Is(err, model.ErrCarNotAvailable):
+			app.errorResponse(w, r, http.StatusConflict, "the price of a reserved or sold car can't be changed")
+		default:
+			app.models.Cars.ErrorLog.Println(err)
+			http.Error(w, "Error updating car", http.StatusInternalServerError)
+		}
 		return
 	}
 
+	car.SuggestedPrice = app.suggestPrice(car)
+
 	// Return success response
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(car)
 }
 
+// readPrice reads an optional price bound in the given currency from the URL query string and
+// returns it in minor units. It returns zero if the key is missing, and records an error in the
+// validator if the value isn't a valid amount.
+func (app *application) readPrice(qs url.Values, key string, currency money.Currency, v *validator.Validator) int64 {
+	return app.readAmount(qs, key, currency, v).Amount
+}
+
+// deleteCarHandler deletes one of the authenticated seller's cars, or any car for a moderator. A
+// car that is reserved, sold, up for auction or being ordered can't be deleted, as that would
+// take its auction, offers and order history with it.
 func (app *application) deleteCarHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract car ID from URL parameters
-	params := mux.Vars(r)
-	id := params["id"]
+	car, ok := app.readCarParam(w, r)
+	if !ok {
+		return
+	}
 
-	// Delete car from the database
-	err := app.models.Cars.Delete(id)
+	allowed, err := app.canManageListing(r, int64(car.UserID))
 	if err != nil {
-		app.models.Cars.ErrorLog.Println(err)
-		http.Error(w, "Error deleting car", http.StatusInternalServerError)
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !allowed {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	if car.Status != model.CarStatusAvailable {
+		app.errorResponse(w, r, http.StatusConflict, fmt.Sprintf("the car is %s and can't be deleted", car.Status))
+		return
+	}
+
+	err = app.models.Cars.Delete(car.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrCarNotAvailable):
+			app.errorResponse(w, r, http.StatusConflict, "the car is up for auction or being ordered and can't be deleted")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	// Return success response
 	w.WriteHeader(http.StatusNoContent)
 }
 
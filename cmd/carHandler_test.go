@@ -0,0 +1,66 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"testing"
+
+	"github.com/balgabekj/go_car/pkg/model"
+)
+
+// carRow is a row of the cars table, as read by CarModel.Get.
+func carRow(id, sellerID int64, status string) fakeResult {
+	return fakeResult{
+		columns: []string{"id", "model", "brand", "year", "color", "price", "currency", "isUsed", "userID", "categoryName", "status"},
+		rows:    [][]driver.Value{{id, "Camry", "Toyota", int64(2020), "white", int64(1500000000), "KZT", true, sellerID, "Sedan", status}},
+	}
+}
+
+func TestDeleteCar(t *testing.T) {
+	seller := &model.User{ID: 1, Activated: true}
+
+	tests := []struct {
+		name        string
+		car         fakeResult
+		permissions []string
+		deleted     int64
+		wantStatus  int
+		wantDelete  bool
+	}{
+		{name: "own car", car: carRow(7, 1, model.CarStatusAvailable), deleted: 1, wantStatus: http.StatusNoContent, wantDelete: true},
+		{name: "another seller's car", car: carRow(7, 2, model.CarStatusAvailable), permissions: []string{"cars:write"}, deleted: 1, wantStatus: http.StatusForbidden},
+		{name: "moderator", car: carRow(7, 2, model.CarStatusAvailable), permissions: []string{"cars:moderate"}, deleted: 1, wantStatus: http.StatusNoContent, wantDelete: true},
+		{name: "moderator and a reserved car", car: carRow(7, 2, model.CarStatusReserved), permissions: []string{"cars:moderate"}, deleted: 1, wantStatus: http.StatusConflict},
+		{name: "reserved car", car: carRow(7, 1, model.CarStatusReserved), deleted: 1, wantStatus: http.StatusConflict},
+		{name: "sold car", car: carRow(7, 1, model.CarStatusSold), deleted: 1, wantStatus: http.StatusConflict},
+		// An open auction or an order in progress keeps the DELETE from matching the car.
+		{name: "car up for auction", car: carRow(7, 1, model.CarStatusAvailable), deleted: 0, wantStatus: http.StatusConflict, wantDelete: true},
+		{name: "missing car", car: fakeResult{columns: carRow(7, 1, "").columns}, wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			permissions := fakeResult{columns: []string{"code"}}
+			for _, code := range tt.permissions {
+				permissions.rows = append(permissions.rows, []driver.Value{code})
+			}
+
+			db, conn := newFakeDB(t, map[string]fakeResult{
+				"SELECT id, model, brand": tt.car,
+				"SELECT permissions.code": permissions,
+				"DELETE FROM cars":        {rowsAffected: tt.deleted},
+			})
+			app := newTestApplication(conn)
+
+			res := serve(app, app.deleteCarHandler, http.MethodDelete, "/v1/cars/7", seller, map[string]string{"id": "7"})
+
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", res.StatusCode, tt.wantStatus)
+			}
+
+			if deleted := db.executed("DELETE FROM cars"); deleted != tt.wantDelete {
+				t.Errorf("delete attempted = %t, want %t", deleted, tt.wantDelete)
+			}
+		})
+	}
+}
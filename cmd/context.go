@@ -12,6 +12,21 @@ type contextKey string
 // context.
 const userContextKey = contextKey("user")
 
+// tokenContextKey is used as a key for getting and setting the plaintext authentication token
+// that the request was authenticated with.
+const tokenContextKey = contextKey("token")
+
+// permissionsContextKey is used as a key for the user's permission codes when they have already
+// been resolved, for example from the claims of a signed access token.
+const permissionsContextKey = contextKey("permissions")
+
+// sessionContextKey is used as a key for the session (token family) a signed access token was
+// issued for.
+const sessionContextKey = contextKey("session")
+
+// apiKeyContextKey is used as a key for the API key a request was authenticated with.
+const apiKeyContextKey = contextKey("apiKey")
+
 // contextSetUser returns a new copy of the request with the provided User struct added to the
 // context.
 func (app *application) contextSetUser(r *http.Request, user *model.User) *http.Request {
@@ -26,3 +41,59 @@ func (app *application) contextGetUser(r *http.Request) *model.User {
 
 	return user
 }
+
+// contextSetToken returns a new copy of the request with the plaintext authentication token
+// added to the context.
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// contextGetToken returns the plaintext authentication token from the request context, or the
+// empty string for anonymous requests.
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+// contextSetPermissions returns a new copy of the request with the user's permission codes added
+// to the context.
+func (app *application) contextSetPermissions(r *http.Request, permissions model.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+// contextGetPermissions returns the permission codes stored in the request context. The boolean
+// is false if they haven't been resolved yet.
+func (app *application) contextGetPermissions(r *http.Request) (model.Permissions, bool) {
+	permissions, ok := r.Context().Value(permissionsContextKey).(model.Permissions)
+	return permissions, ok
+}
+
+// contextSetSession returns a new copy of the request with the session (token family) id added
+// to the context.
+func (app *application) contextSetSession(r *http.Request, session string) *http.Request {
+	ctx := context.WithValue(r.Context(), sessionContextKey, session)
+	return r.WithContext(ctx)
+}
+
+// contextGetSession returns the session id from the request context, or the empty string if the
+// request wasn't authenticated with a signed token.
+func (app *application) contextGetSession(r *http.Request) string {
+	session, _ := r.Context().Value(sessionContextKey).(string)
+	return session
+}
+
+// contextSetAPIKey returns a new copy of the request with the API key it was authenticated with
+// added to the context.
+func (app *application) contextSetAPIKey(r *http.Request, key *model.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// contextGetAPIKey returns the API key the request was authenticated with, or nil if it wasn't
+// made with an API key.
+func (app *application) contextGetAPIKey(r *http.Request) *model.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*model.APIKey)
+	return key
+}
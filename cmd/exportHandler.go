@@ -0,0 +1,251 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/balgabekj/go_car/pkg/model"
+	"github.com/balgabekj/go_car/pkg/validator"
+	"github.com/gorilla/mux"
+)
+
+// exportTimeout is how long an export can be pending before the purger gives up on it. Archives
+// normally take seconds to build, so an export still pending after this was lost.
+const exportTimeout = 30 * time.Minute
+
+// createDataExportHandler starts generating a ZIP archive with a copy of the authenticated user's
+// personal data. The archive is built in the background; the response contains the export ID for
+// the status endpoint and the secret download link, which is also emailed once the archive is
+// ready.
+func (app *application) createDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	export, err := app.models.Exports.New(user.ID, app.config.exportTTL)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrExportInProgress):
+			app.errorResponse(w, r, http.StatusConflict, "a data export is already being generated for your account")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.background(func() {
+		archive, err := app.buildDataExport(user)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"export_id": strconv.FormatInt(export.ID, 10)})
+
+			if err := app.models.Exports.Fail(export.ID); err != nil {
+				app.logger.PrintError(err, nil)
+			}
+			return
+		}
+
+		err = app.models.Exports.Complete(export.ID, archive)
+		if err != nil {
+			if !errors.Is(err, model.ErrRecordNotFound) {
+				app.logger.PrintError(err, nil)
+			}
+			return
+		}
+
+		app.sendEmail(user.Email, "data_export.tmpl", map[string]interface{}{
+			"name":          user.Name,
+			"downloadToken": export.DownloadToken,
+			"expiry":        export.Expiry,
+		})
+	})
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/api/v1/users/me/export/%d", export.ID))
+
+	env := envelope{
+		"export":       export,
+		"download_url": "/api/v1/exports/" + export.DownloadToken,
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showDataExportHandler reports the status of one of the authenticated user's data exports.
+func (app *application) showDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	export, err := app.models.Exports.Get(int64(id), app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"export": export}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// downloadDataExportHandler serves a ready export archive. The secret in the URL is the only
+// credential, so the link works straight from the email until the export expires.
+func (app *application) downloadDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+
+	v := validator.New()
+	if model.ValidateTokenPlaintext(v, token); !v.Valid() {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	export, archive, err := app.models.Exports.GetArchive(token)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="gocars-export-%d.zip"`, export.ID))
+	w.Header().Set("Content-Length", strconv.Itoa(len(archive)))
+	w.Header().Set("Cache-Control", "no-store")
+
+	_, err = w.Write(archive)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// buildDataExport collects the personal data we hold about a user and writes each part as a JSON
+// file into a ZIP archive. When a feature starts storing personal data, it should add a file
+// here too.
+func (app *application) buildDataExport(user *model.User) ([]byte, error) {
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	mfaEnabled, err := app.models.MFA.IsEnabled(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	cars, err := app.models.Cars.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := app.models.Tokens.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKeys, err := app.models.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := app.models.Messages.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	offers, err := app.models.Offers.GetAllInvolving(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	testDrives, err := app.models.TestDrives.GetAllInvolving(user.ID, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	bids, err := app.models.Auctions.GetBidsForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	orders, err := app.models.Orders.GetAllInvolving(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	invoices, err := app.models.Invoices.GetAllInvolving(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"profile.json", envelope{
+			"user":        user,
+			"roles":       roles,
+			"permissions": permissions,
+			"mfa_enabled": mfaEnabled,
+		}},
+		{"listings.json", envelope{"cars": cars}},
+		{"tokens.json", envelope{"tokens": tokens}},
+		{"api_keys.json", envelope{"api_keys": apiKeys}},
+		{"messages.json", envelope{"messages": messages}},
+		{"offers.json", envelope{"offers": offers}},
+		{"test_drives.json", envelope{"test_drives": testDrives}},
+		{"bids.json", envelope{"bids": bids}},
+		{"orders.json", envelope{"orders": orders}},
+		{"invoices.json", envelope{"invoices": invoices}},
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	for _, file := range files {
+		f, err := zw.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+
+		js, err := json.MarshalIndent(file.data, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := f.Write(js); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
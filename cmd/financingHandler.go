@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/balgabekj/go_car/pkg/finance"
+	"github.com/balgabekj/go_car/pkg/money"
+	"github.com/balgabekj/go_car/pkg/validator"
+)
+
+// Limits on financing plans. Amounts have as many decimal places as their currency, and rates
+// at most four.
+const (
+	financingMaxTerm     = 120
+	financingDefaultTerm = 60
+	financingRatePlaces  = 4
+)
+
+// carFinancingHandler calculates a loan or lease schedule for buying a listed car at its asking
+// price, in the currency the car is listed in. The rest of the plan is read from the query
+// string, as for the standalone calculator.
+func (app *application) carFinancingHandler(w http.ResponseWriter, r *http.Request) {
+	car, ok := app.readCarParam(w, r)
+	if !ok {
+		return
+	}
+
+	app.writeFinancingSchedule(w, r, car.Price)
+}
+
+// calculateFinancingHandler is the standalone calculator: it calculates a loan or lease schedule
+// for any price given in the query string, in the currency given, or the default currency.
+func (app *application) calculateFinancingHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	v := validator.New()
+
+	currency := app.config.money.currency
+	if code := app.readStrings(qs, "currency", ""); code != "" {
+		var ok bool
+		currency, ok = money.LookupCurrency(strings.ToUpper(code))
+		v.Check(ok, "currency", "must be a supported ISO 4217 currency code")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	price := app.readAmount(qs, "price", currency, v)
+	v.Check(qs.Get("price") != "", "price", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.writeFinancingSchedule(w, r, price)
+}
+
+// writeFinancingSchedule reads and validates the financing plan from the query string and sends
+// its schedule, with amounts in the currency of the price. The query string holds:
+//
+//	type              loan (default) or lease
+//	down_payment      paid up front, 0 by default
+//	term              in months, 60 by default
+//	apr               annual percentage rate, required
+//	residual          value of the car at the end of the term, required for leases; for loans
+//	                  it is an optional balloon payment
+//	residual_percent  the residual as a percentage of the price instead of an amount
+func (app *application) writeFinancingSchedule(w http.ResponseWriter, r *http.Request, price money.Money) {
+	qs := r.URL.Query()
+
+	v := validator.New()
+
+	plan := finance.Plan{
+		Kind:        app.readStrings(qs, "type", finance.Loan),
+		Price:       price,
+		DownPayment: app.readAmount(qs, "down_payment", price.Currency, v),
+		Term:        app.readInt(qs, "term", financingDefaultTerm, v),
+		APR:         app.readDecimal(qs, "apr", financingRatePlaces, v),
+	}
+
+	plan.Residual = app.readResidual(qs, price, v)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	financed := price.Amount - plan.DownPayment.Amount
+
+	v.Check(validator.In(plan.Kind, finance.Loan, finance.Lease), "type", "must be loan or lease")
+	v.Check(price.Amount > 0, "price", "must be greater than zero")
+	v.Check(financed > 0, "down_payment", "must be less than the price")
+	v.Check(plan.Term >= 1, "term", "must be at least 1 month")
+	v.Check(plan.Term <= financingMaxTerm, "term", "must not be more than 120 months")
+	v.Check(qs.Get("apr") != "", "apr", "must be provided")
+	v.Check(plan.APR.Cmp(big.NewRat(100, 1)) <= 0, "apr", "must not be more than 100")
+	v.Check(plan.Residual.Amount < financed, "residual", "must be less than the price minus the down payment")
+	if plan.Kind == finance.Lease {
+		v.Check(plan.Residual.Amount > 0, "residual", "must be provided for a lease")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"financing": finance.Calculate(plan)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readResidual reads the residual value from the query string, given either as an amount in the
+// currency of the price or as a percentage of the price.
+func (app *application) readResidual(qs url.Values, price money.Money, v *validator.Validator) money.Money {
+	if qs.Get("residual_percent") == "" {
+		return app.readAmount(qs, "residual", price.Currency, v)
+	}
+
+	if qs.Get("residual") != "" {
+		v.AddError("residual", "must not be provided together with residual_percent")
+		return money.Money{Currency: price.Currency}
+	}
+
+	percent := app.readDecimal(qs, "residual_percent", financingRatePlaces, v)
+
+	v.Check(percent.Cmp(big.NewRat(100, 1)) < 0, "residual_percent", "must be less than 100")
+
+	return price.Mul(percent.Quo(percent, big.NewRat(100, 1)))
+}
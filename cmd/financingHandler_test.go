@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/balgabekj/go_car/pkg/model"
+	"github.com/balgabekj/go_car/pkg/money"
+)
+
+func TestCarFinancing(t *testing.T) {
+	// A car listed at 2,000,000 yen, which has no minor units.
+	car := carRow(7, 1, model.CarStatusAvailable)
+	car.rows[0][5], car.rows[0][6] = int64(2000000), "JPY"
+
+	_, db := newFakeDB(t, map[string]fakeResult{"SELECT id, model, brand": car})
+	app := newTestApplication(db)
+
+	tests := []struct {
+		name         string
+		target       string
+		wantStatus   int
+		wantPayment  int64
+		wantResidual int64
+	}{
+		{name: "loan", target: "/v1/cars/7/financing?apr=6", wantStatus: http.StatusOK, wantPayment: 38666},
+		{name: "residual percent", target: "/v1/cars/7/financing?apr=6&residual_percent=33.33", wantStatus: http.StatusOK, wantPayment: 29111, wantResidual: 666600},
+		{name: "fractional yen", target: "/v1/cars/7/financing?apr=6&down_payment=1000.5", wantStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := serve(app, app.carFinancingHandler, http.MethodGet, tt.target, nil, map[string]string{"id": "7"})
+
+			if res.StatusCode != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", res.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Financing struct {
+					MonthlyPayment money.Money `json:"monthly_payment"`
+					Residual       money.Money `json:"residual"`
+				} `json:"financing"`
+			}
+
+			err := json.NewDecoder(res.Body).Decode(&body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, m := range []money.Money{body.Financing.MonthlyPayment, body.Financing.Residual} {
+				if m.Currency.Code != "JPY" {
+					t.Errorf("amount in %s, want JPY", m.Currency.Code)
+				}
+			}
+			if got := body.Financing.MonthlyPayment.Amount; got != tt.wantPayment {
+				t.Errorf("monthly payment = %d, want %d", got, tt.wantPayment)
+			}
+			if got := body.Financing.Residual.Amount; got != tt.wantResidual {
+				t.Errorf("residual = %d, want %d", got, tt.wantResidual)
+			}
+		})
+	}
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/balgabekj/go_car/pkg/model"
+	"github.com/balgabekj/go_car/pkg/money"
 	"github.com/balgabekj/go_car/pkg/validator"
 	"github.com/gorilla/mux"
+	"math/big"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 )
 
 // Define an envelope type.
@@ -25,6 +32,87 @@ func (app *application) readIDParam(r *http.Request) (int, error) {
 	return id, nil
 }
 
+// readUserParam looks up the user whose id is interpolated in the request URL. If the id is
+// invalid or no such user exists, a 404 Not Found response is sent and ok is false.
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*model.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.models.Users.Get(int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
+
+// readCarParam looks up the car whose id is interpolated in the request URL. If the id is invalid
+// or no such car exists, a 404 Not Found response is sent and ok is false.
+func (app *application) readCarParam(w http.ResponseWriter, r *http.Request) (*model.Car, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	car, err := app.models.Cars.Get(strconv.Itoa(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return car, true
+}
+
+// userPermissions returns the permission codes of the user who made the request. They are taken
+// from the request context if they came with the request, e.g. in a signed access token or as the
+// permissions of an API key, and looked up otherwise.
+func (app *application) userPermissions(r *http.Request) (model.Permissions, error) {
+	if permissions, ok := app.contextGetPermissions(r); ok {
+		return permissions, nil
+	}
+
+	return app.models.Permissions.GetAllForUser(app.contextGetUser(r).ID)
+}
+
+// canManageListing reports whether the user who made the request may manage a listing of the
+// given seller: their own, or anyone's if they hold the cars:moderate permission.
+func (app *application) canManageListing(r *http.Request, sellerID int64) (bool, error) {
+	if sellerID == app.contextGetUser(r).ID {
+		return true, nil
+	}
+
+	permissions, err := app.userPermissions(r)
+	if err != nil {
+		return false, err
+	}
+
+	return permissions.Include("cars:moderate"), nil
+}
+
+// clientIP returns the IP address of the client that made the request, without the port.
+func (app *application) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
 // writeJSON marshals data structure to encoded JSON response. It returns an error if there are
 // any issues, else error is nil.
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope,
@@ -176,3 +264,155 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	// Otherwise, return the converted integer value.
 	return i
 }
+
+// readBool reads an optional boolean value from the URL query string. It returns nil if the key
+// is missing, and records an error in the validator if the value isn't a valid boolean.
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return nil
+	}
+
+	return &b
+}
+
+// readDate reads an optional date from the URL query string, either as a plain date
+// (2006-01-02) or a full RFC 3339 timestamp. It returns the zero time if the key is missing, and
+// records an error in the validator if the value can't be parsed.
+func (app *application) readDate(qs url.Values, key string, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return time.Time{}
+	}
+
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+
+	v.AddError(key, "must be a date in YYYY-MM-DD or RFC 3339 format")
+	return time.Time{}
+}
+
+// readDecimal reads an optional non-negative decimal number with at most places decimal places,
+// such as a rate, exactly from the URL query string. It returns zero if the key is missing, and
+// records an error in the validator if the value isn't a plain decimal number.
+func (app *application) readDecimal(qs url.Values, key string, places int, v *validator.Validator) *big.Rat {
+	s := qs.Get(key)
+	if s == "" {
+		return new(big.Rat)
+	}
+
+	d, err := money.ParseRat(s, places)
+	if err != nil {
+		v.AddError(key, fmt.Sprintf("must be a non-negative decimal number with at most %d decimal places", places))
+		return new(big.Rat)
+	}
+
+	return d
+}
+
+// readAmount reads an optional amount of money in the given currency from the URL query string,
+// as parseAmount does for request bodies.
+func (app *application) readAmount(qs url.Values, key string, currency money.Currency, v *validator.Validator) money.Money {
+	return app.parseAmount(json.Number(qs.Get(key)), key, currency, v)
+}
+
+// parseAmount parses an amount of money in the given currency, as given in a request. It returns
+// zero if the amount is missing, and records an error in the validator if it isn't a
+// non-negative decimal number with at most as many decimal places as the currency has.
+func (app *application) parseAmount(s json.Number, key string, currency money.Currency, v *validator.Validator) money.Money {
+	if s == "" {
+		return money.Money{Currency: currency}
+	}
+
+	amount, err := money.Parse(s.String(), currency)
+	if err != nil {
+		v.AddError(key, fmt.Sprintf("must be a non-negative amount with at most %d decimal places", currency.Exponent))
+		return money.Money{Currency: currency}
+	}
+
+	return amount
+}
+
+// background runs the given function in a background goroutine. The goroutine is tracked by
+// app.wg so that a graceful shutdown waits for it to finish, and any panic is recovered and
+// logged instead of bringing down the whole application. Periodic jobs, such as the purger and
+// the auction closer, go through background on every run via app.every, so shutting down waits
+// for a run in progress but doesn't start new ones.
+func (app *application) background(fn func()) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.PrintError(fmt.Errorf("%s", err), nil)
+			}
+		}()
+
+		fn()
+	}()
+}
+
+// every calls fn through app.background once per interval until the server starts shutting
+// down. The server stops these tickers before it waits for background tasks, so that no task is
+// started during, or after, that wait.
+func (app *application) every(interval time.Duration, fn func()) {
+	app.tickers.Add(1)
+
+	go func() {
+		defer app.tickers.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				app.background(fn)
+			case <-app.shutdown:
+				return
+			}
+		}
+	}()
+}
+
+// emailAttempts is how many times sendEmail tries to deliver an email before giving up.
+const emailAttempts = 3
+
+// sendEmail delivers a templated email in the background. Delivery is attempted up to three
+// times, sleeping a little longer between each attempt, before the failure is logged.
+func (app *application) sendEmail(recipient, templateFile string, data interface{}) {
+	app.background(func() {
+		var err error
+
+		for i := 1; i <= emailAttempts; i++ {
+			err = app.mailer.Send(recipient, templateFile, data)
+			if err == nil {
+				return
+			}
+
+			// There's nothing to wait for after the last attempt, and sleeping would only hold up
+			// a graceful shutdown.
+			if i == emailAttempts {
+				break
+			}
+
+			time.Sleep(time.Duration(i) * 500 * time.Millisecond)
+		}
+
+		app.logger.PrintError(err, map[string]string{
+			"recipient": recipient,
+			"template":  templateFile,
+		})
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/balgabekj/go_car/pkg/invoice"
+	"github.com/balgabekj/go_car/pkg/model"
+	"github.com/balgabekj/go_car/pkg/validator"
+)
+
+// showOrderInvoiceHandler returns the invoice of a completed order to its buyer or seller, as
+// JSON, HTML or PDF depending on the format query string parameter. Invoices are normally issued
+// as soon as the last payment comes in; if that failed the invoice is issued here instead.
+func (app *application) showOrderInvoiceHandler(w http.ResponseWriter, r *http.Request) {
+	order, ok := app.readOrderParam(w, r)
+	if !ok {
+		return
+	}
+
+	format := app.readStrings(r.URL.Query(), "format", "json")
+
+	v := validator.New()
+
+	if v.Check(validator.In(format, "json", "html", "pdf"), "format", "must be json, html or pdf"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if order.Status != model.OrderStatusCompleted {
+		app.errorResponse(w, r, http.StatusConflict, "invoices are only issued for completed orders")
+		return
+	}
+
+	inv, err := app.models.Invoices.GetForOrder(order.ID)
+	if errors.Is(err, model.ErrRecordNotFound) {
+		inv, err = app.issueInvoice(order)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var body []byte
+
+	switch format {
+	case "html":
+		body = inv.HTML
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	case "pdf":
+		body = inv.PDF
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="invoice-%s.pdf"`, inv.Number))
+	default:
+		err = app.writeJSON(w, http.StatusOK, envelope{"invoice": inv}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Cache-Control", "no-store")
+
+	_, err = w.Write(body)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// issueInvoice issues the invoice for a completed order, whose payments must have been loaded.
+// The buyer and seller details are copied from their accounts as they are now. If the invoice
+// was issued concurrently, that one is returned instead.
+func (app *application) issueInvoice(order *model.Order) (*model.Invoice, error) {
+	if order.SellerID == 0 {
+		return nil, fmt.Errorf("order %d has no seller to issue an invoice for", order.ID)
+	}
+
+	seller, err := app.invoiceParty(order.SellerID)
+	if err != nil {
+		return nil, err
+	}
+
+	buyer, err := app.invoiceParty(order.BuyerID)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := invoice.Document{
+		OrderID: order.ID,
+		Seller:  seller,
+		Buyer:   buyer,
+		Lines: []invoice.Line{
+			{Description: order.Car, Quantity: 1, UnitPrice: order.Price},
+		},
+		Payments: []invoice.Payment{},
+		Currency: order.Price.Currency.Code,
+		TaxName:  app.config.invoice.taxName,
+		TaxRate:  app.config.invoice.taxRate,
+	}
+
+	for _, p := range order.Payments {
+		if p.Status == model.PaymentStatusSucceeded {
+			doc.Payments = append(doc.Payments, invoice.Payment{Date: p.UpdatedAt, Amount: p.Amount})
+		}
+	}
+
+	doc.CalculateTotals()
+
+	inv := &model.Invoice{
+		OrderID:  order.ID,
+		SellerID: order.SellerID,
+		Document: doc,
+	}
+
+	err = app.models.Invoices.Issue(inv, func(inv *model.Invoice) error {
+		var err error
+
+		inv.HTML, err = inv.Document.HTML()
+		if err != nil {
+			return err
+		}
+
+		inv.PDF, err = inv.Document.PDF()
+		return err
+	})
+	if errors.Is(err, model.ErrInvoiceExists) {
+		return app.models.Invoices.GetForOrder(order.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return inv, nil
+}
+
+// invoiceParty returns the details of a user to print on an invoice. Users whose account has
+// been deleted are shown as such.
+func (app *application) invoiceParty(userID int64) (invoice.Party, error) {
+	user, err := app.models.Users.Get(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			return invoice.Party{Name: "Deleted account"}, nil
+		default:
+			return invoice.Party{}, err
+		}
+	}
+
+	return invoice.Party{
+		Name:     user.Name,
+		Email:    user.Email,
+		Phone:    user.Phone,
+		Location: user.Location,
+	}, nil
+}
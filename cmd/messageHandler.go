@@ -0,0 +1,404 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/balgabekj/go_car/pkg/model"
+	"github.com/balgabekj/go_car/pkg/validator"
+)
+
+// sendCarMessageHandler lets a buyer message the seller of a car. The first message starts the
+// conversation, later ones are added to it. Sellers reply through the conversation endpoint,
+// since a car can have conversations with many buyers.
+func (app *application) sendCarMessageHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	car, err := app.models.Cars.Get(strconv.Itoa(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if int64(car.UserID) == user.ID {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "you can't start a conversation about your own car, reply through /api/v1/conversations instead")
+		return
+	}
+
+	message, ok := app.readMessage(w, r)
+	if !ok {
+		return
+	}
+
+	if app.isBlocked(w, r, user.ID, int64(car.UserID)) {
+		return
+	}
+
+	conversation, err := app.models.Messages.StartConversation(car.ID, user.ID, int64(car.UserID))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.postMessage(w, r, conversation, message)
+}
+
+// sendConversationMessageHandler adds a message to an existing conversation.
+func (app *application) sendConversationMessageHandler(w http.ResponseWriter, r *http.Request) {
+	conversation, ok := app.readConversationParam(w, r)
+	if !ok {
+		return
+	}
+
+	message, ok := app.readMessage(w, r)
+	if !ok {
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if app.isBlocked(w, r, user.ID, conversation.OtherParticipant(user.ID)) {
+		return
+	}
+
+	app.postMessage(w, r, conversation, message)
+}
+
+// listConversationsHandler returns the authenticated user's inbox, along with the total number
+// of unread messages.
+func (app *application) listConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	var filters model.Filters
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	filters.Sort = "-last_message_at"
+	filters.SortSafeList = []string{"-last_message_at"}
+
+	if model.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	conversations, metadata, err := app.models.Messages.GetConversationsForUser(user.ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	unread, err := app.models.Messages.CountUnread(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"conversations": conversations, "unread": unread, "metadata": metadata}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showConversationHandler returns a conversation with a page of its messages, newest first by
+// default, and marks the conversation as read.
+func (app *application) showConversationHandler(w http.ResponseWriter, r *http.Request) {
+	conversation, ok := app.readConversationParam(w, r)
+	if !ok {
+		return
+	}
+
+	var filters model.Filters
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 50, v)
+	filters.Sort = app.readStrings(qs, "sort", "-id")
+	filters.SortSafeList = []string{"id", "-id"}
+
+	if model.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	messages, metadata, err := app.models.Messages.GetAllForConversation(conversation.ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Messages.MarkRead(conversation.ID, app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	conversation.Unread = 0
+
+	env := envelope{"conversation": conversation, "messages": messages, "metadata": metadata}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// blockUserHandler stops the user in the URL from exchanging messages with the authenticated
+// user.
+func (app *application) blockUserHandler(w http.ResponseWriter, r *http.Request) {
+	blocked, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if blocked.ID == user.ID {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "you can't block yourself")
+		return
+	}
+
+	err := app.models.Blocks.Block(user.ID, blocked.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully blocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// unblockUserHandler lifts a block placed by the authenticated user.
+func (app *application) unblockUserHandler(w http.ResponseWriter, r *http.Request) {
+	blocked, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.Blocks.Unblock(app.contextGetUser(r).ID, blocked.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully unblocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listBlockedUsersHandler returns the users the authenticated user has blocked.
+func (app *application) listBlockedUsersHandler(w http.ResponseWriter, r *http.Request) {
+	blocked, err := app.models.Blocks.GetAllForUser(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"blocked_users": blocked}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// reportUserHandler records a complaint about the user in the URL for moderators to review. If a
+// conversation is given, the reporter must take part in it together with the reported user.
+func (app *application) reportUserHandler(w http.ResponseWriter, r *http.Request) {
+	reported, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Reason         string `json:"reason"`
+		ConversationID *int64 `json:"conversation_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	report := &model.Report{
+		ReporterID:     user.ID,
+		ReportedID:     reported.ID,
+		ConversationID: input.ConversationID,
+		Reason:         input.Reason,
+	}
+
+	v := validator.New()
+
+	if model.ValidateReport(v, report); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if report.ConversationID != nil {
+		conversation, err := app.models.Messages.GetConversation(*report.ConversationID, user.ID)
+		if err != nil && !errors.Is(err, model.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if conversation == nil || !conversation.HasParticipant(reported.ID) {
+			v.AddError("conversation_id", "must be a conversation between you and the reported user")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	err = app.models.Reports.Insert(report)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"report": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listReportsHandler lets moderators review reports, optionally only those about one user.
+func (app *application) listReportsHandler(w http.ResponseWriter, r *http.Request) {
+	var filters model.Filters
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	reportedID := app.readInt(qs, "user_id", 0, v)
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	filters.Sort = "-id"
+	filters.SortSafeList = []string{"-id"}
+
+	if model.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	reports, metadata, err := app.models.Reports.GetAll(int64(reportedID), filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"reports": reports, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readConversationParam loads the conversation given by the "id" URL parameter. Conversations the
+// authenticated user doesn't take part in are reported as not found.
+func (app *application) readConversationParam(w http.ResponseWriter, r *http.Request) (*model.Conversation, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	conversation, err := app.models.Messages.GetConversation(int64(id), app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return conversation, true
+}
+
+// readMessage reads and validates the message in the request body.
+func (app *application) readMessage(w http.ResponseWriter, r *http.Request) (*model.Message, bool) {
+	var input struct {
+		Body string `json:"body"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, false
+	}
+
+	message := &model.Message{
+		SenderID: app.contextGetUser(r).ID,
+		Body:     input.Body,
+	}
+
+	v := validator.New()
+
+	if model.ValidateMessage(v, message); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	return message, true
+}
+
+// isBlocked sends a 403 Forbidden response and returns true if either user has blocked the other.
+func (app *application) isBlocked(w http.ResponseWriter, r *http.Request, a, b int64) bool {
+	blocked, err := app.models.Blocks.IsBlocked(a, b)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return true
+	}
+
+	if blocked {
+		app.errorResponse(w, r, http.StatusForbidden, "you can't exchange messages with this user")
+		return true
+	}
+
+	return false
+}
+
+// postMessage adds the message to the conversation and sends it back to the client.
+func (app *application) postMessage(w http.ResponseWriter, r *http.Request, conversation *model.Conversation, message *model.Message) {
+	message.ConversationID = conversation.ID
+
+	err := app.models.Messages.Insert(message)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/api/v1/conversations/%d", conversation.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"conversation": conversation, "message": message}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"errors"
+	"github.com/balgabekj/go_car/pkg/jwt"
 	"github.com/balgabekj/go_car/pkg/model"
 	"github.com/balgabekj/go_car/pkg/validator"
+	"github.com/gorilla/mux"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -28,10 +32,15 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 
 		// Otherwise, we expect the value of the Authorization header to be in the format
-		// "Bearer <token>". We try to split this into its constituent parts, and if the header
-		// isn't in the expected format we return a 401 Unauthorized response using the
-		// invalidAuthenticationTokenResponse helper.
+		// "Bearer <token>" or, for dealer integrations, "ApiKey <key>". We try to split this into
+		// its constituent parts, and if the header isn't in the expected format we return a 401
+		// Unauthorized response using the invalidAuthenticationTokenResponse helper.
 		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) == 2 && headerParts[0] == "ApiKey" {
+			app.authenticateAPIKey(w, r, headerParts[1], next)
+			return
+		}
+
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
@@ -40,6 +49,24 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// Extract the actual authentication token from the header parts
 		token := headerParts[1]
 
+		// In signed mode the token carries everything we need about the user, so verify its
+		// signature and build the request context from the claims without touching the database.
+		if app.signer != nil && jwt.IsSigned(token) {
+			claims, err := app.signer.Verify(token)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			r = app.contextSetUser(r, &model.User{ID: claims.UserID, Activated: claims.Activated})
+			r = app.contextSetToken(r, token)
+			r = app.contextSetSession(r, claims.Session)
+			r = app.contextSetPermissions(r, model.Permissions(claims.Permissions))
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		// Validate the token to make sure it is in a sensible format.
 		v := validator.New()
 
@@ -63,14 +90,75 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		// Record when the session was last used, so it can be shown in the session list.
+		err = app.models.Tokens.Touch(token)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
 		// Call the contextSetUser healer to add the user information to the request context.
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
 
 		// Call next handler in chain
 		next.ServeHTTP(w, r)
 	})
 }
 
+// authenticateAPIKey authenticates a request made with an API key. The request gets the
+// permissions granted to the key, limited to those the owning user still has, so taking a
+// permission away from a user also takes it away from all of their keys.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, plaintext string, next http.Handler) {
+	v := validator.New()
+
+	if model.ValidateAPIKeyPlaintext(v, plaintext); !v.Valid() {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	key, user, err := app.models.APIKeys.GetForKey(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !key.AllowsIP(app.clientIP(r)) {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	userPermissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions := model.Permissions{}
+	for _, code := range key.Permissions {
+		if userPermissions.Include(code) {
+			permissions = append(permissions, code)
+		}
+	}
+
+	err = app.models.APIKeys.Touch(key.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+	r = app.contextSetPermissions(r, permissions)
+
+	next.ServeHTTP(w, r)
+}
+
 // requireAuthenticatedUser checks that the user is not anonymous (i.e., they are authenticated).
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -107,13 +195,33 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// requireInteractiveUser checks that the user is activated and that the request wasn't made with
+// an API key. Keys are for machine integrations and only act through the permissions they were
+// granted, so every route which changes something and isn't guarded by requirePermissions uses
+// this instead of requireActivatedUser. Otherwise a read-only key could place bids, accept offers
+// or manage credentials, and a restricted key could be used to mint a broader one.
+func (app *application) requireInteractiveUser(next http.HandlerFunc) http.HandlerFunc {
+	return app.requireActivatedUser(app.denyAPIKeys(next))
+}
+
+// denyAPIKeys refuses requests made with an API key. It is used on its own for routes that don't
+// need an activated account, such as logging out.
+func (app *application) denyAPIKeys(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
 func (app *application) requirePermissions(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Retrieve the user from the request context.
-		user := app.contextGetUser(r)
-
-		// Get the slice of permission for the user
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		// Get the slice of permission for the user, unless they already came with the request
+		// (e.g. embedded in a signed access token).
+		permissions, err := app.userPermissions(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -126,6 +234,10 @@ func (app *application) requirePermissions(code string, next http.HandlerFunc) h
 			return
 		}
 
+		// Stash the resolved permissions alongside the user, so handlers (or a nested
+		// requirePermissions) don't have to look them up again.
+		r = app.contextSetPermissions(r, permissions)
+
 		// Otherwise, they have the required permission, so we call the next handler in the chain.
 		next.ServeHTTP(w, r)
 	})
@@ -133,3 +245,45 @@ func (app *application) requirePermissions(code string, next http.HandlerFunc) h
 	// Wrap this with the requireActivatedUser middleware before returning
 	return app.requireActivatedUser(fn)
 }
+
+// rateLimit returns middleware which applies the token bucket limit configured for the given
+// route group. Anonymous clients are limited by IP address and authenticated users by their user
+// id, so users behind a shared NAT don't starve each other. Groups without their own limit use
+// the "default" one.
+func (app *application) rateLimit(group string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !app.config.limiter.enabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			limit, ok := app.config.limiter.limits[group]
+			if !ok {
+				limit = app.config.limiter.limits["default"]
+			}
+
+			key := group + ":ip:" + app.clientIP(r)
+			if user := app.contextGetUser(r); !user.IsAnonymous() {
+				key = group + ":user:" + strconv.FormatInt(user.ID, 10)
+			}
+
+			res, err := app.limiter.Take(key, limit)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(res.Reset.Seconds()))))
+
+			if !res.Allowed {
+				app.rateLimitExceededResponse(w, r, res.RetryAfter)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
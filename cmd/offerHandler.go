@@ -0,0 +1,300 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/balgabekj/go_car/pkg/model"
+	"github.com/balgabekj/go_car/pkg/validator"
+)
+
+// createOfferHandler lets a buyer propose a price for an available car, in the currency the car
+// is listed in.
+func (app *application) createOfferHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	car, err := app.models.Cars.Get(strconv.Itoa(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Amount json.Number `json:"amount"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	amount := app.parseAmount(input.Amount, "amount", car.Price.Currency, v)
+
+	if model.ValidateOfferAmount(v, amount); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if int64(car.UserID) == user.ID {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "you can't make an offer for your own car")
+		return
+	}
+
+	if car.Status != model.CarStatusAvailable {
+		app.errorResponse(w, r, http.StatusConflict, "the car is no longer available")
+		return
+	}
+
+	if !app.checkCarNotInAuction(w, r, car.ID) {
+		return
+	}
+
+	offer := &model.Offer{
+		CarID:    car.ID,
+		BuyerID:  user.ID,
+		SellerID: int64(car.UserID),
+		Amount:   amount,
+	}
+
+	err = app.models.Offers.Insert(offer, app.config.offerTTL)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrOpenOfferExists):
+			app.errorResponse(w, r, http.StatusConflict, "you already have an open offer for this car")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/api/v1/offers/%d", offer.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"offer": offer}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listOffersHandler lists the offers the authenticated user made or received. They can be
+// filtered by role (buyer or seller), car and status.
+func (app *application) listOffersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		model.OfferFilter
+		model.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Role = app.readStrings(qs, "role", "")
+	input.CarID = app.readInt(qs, "car_id", 0, v)
+	input.Status = app.readStrings(qs, "status", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = "-updated_at"
+	input.Filters.SortSafeList = []string{"-updated_at"}
+
+	v.Check(validator.In(input.Role, "", "buyer", "seller"), "role", "must be buyer or seller")
+	v.Check(validator.In(input.Status, "", model.OfferStatusPending, model.OfferStatusCountered,
+		model.OfferStatusAccepted, model.OfferStatusRejected, model.OfferStatusWithdrawn,
+		model.OfferStatusExpired), "status", "invalid status value")
+
+	if model.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	offers, metadata, err := app.models.Offers.GetAllForUser(app.contextGetUser(r).ID, input.OfferFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"offers": offers, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showOfferHandler returns an offer with its full history.
+func (app *application) showOfferHandler(w http.ResponseWriter, r *http.Request) {
+	offer, ok := app.readOfferParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"offer": offer}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// counterOfferHandler replaces the amount of an offer and hands the turn to the other party.
+func (app *application) counterOfferHandler(w http.ResponseWriter, r *http.Request) {
+	offer, ok := app.readOfferForResponse(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Amount json.Number `json:"amount"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	amount := app.parseAmount(input.Amount, "amount", offer.Amount.Currency, v)
+
+	model.ValidateOfferAmount(v, amount)
+	v.Check(amount.Amount != offer.Amount.Amount, "amount", "must be different from the current amount")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Offers.Counter(offer, app.contextGetUser(r).ID, amount, app.config.offerTTL)
+	app.offerResponse(w, r, offer, err)
+}
+
+// acceptOfferHandler accepts an offer, which reserves the car for the buyer.
+func (app *application) acceptOfferHandler(w http.ResponseWriter, r *http.Request) {
+	offer, ok := app.readOfferForResponse(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.checkCarNotInAuction(w, r, offer.CarID) {
+		return
+	}
+
+	err := app.models.Offers.Accept(offer, app.contextGetUser(r).ID)
+	app.offerResponse(w, r, offer, err)
+}
+
+// rejectOfferHandler turns an offer down.
+func (app *application) rejectOfferHandler(w http.ResponseWriter, r *http.Request) {
+	offer, ok := app.readOfferForResponse(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.Offers.Reject(offer, app.contextGetUser(r).ID)
+	app.offerResponse(w, r, offer, err)
+}
+
+// withdrawOfferHandler lets the buyer take back an open offer, whoever's turn it is.
+func (app *application) withdrawOfferHandler(w http.ResponseWriter, r *http.Request) {
+	offer, ok := app.readOfferParam(w, r)
+	if !ok {
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if offer.BuyerID != user.ID {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	if !offer.IsOpen() {
+		app.errorResponse(w, r, http.StatusConflict, fmt.Sprintf("the offer is already %s", offer.Status))
+		return
+	}
+
+	err := app.models.Offers.Withdraw(offer, user.ID)
+	app.offerResponse(w, r, offer, err)
+}
+
+// readOfferParam loads the offer given by the "id" URL parameter. Offers the authenticated user
+// isn't a party to are reported as not found.
+func (app *application) readOfferParam(w http.ResponseWriter, r *http.Request) (*model.Offer, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	offer, err := app.models.Offers.Get(int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	if !offer.HasParticipant(app.contextGetUser(r).ID) {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	return offer, true
+}
+
+// readOfferForResponse loads the offer given by the "id" URL parameter and checks that it is open
+// and waiting for the authenticated user to respond.
+func (app *application) readOfferForResponse(w http.ResponseWriter, r *http.Request) (*model.Offer, bool) {
+	offer, ok := app.readOfferParam(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	if !offer.IsOpen() {
+		app.errorResponse(w, r, http.StatusConflict, fmt.Sprintf("the offer is already %s", offer.Status))
+		return nil, false
+	}
+
+	if offer.AwaitingResponseFrom() != app.contextGetUser(r).ID {
+		app.errorResponse(w, r, http.StatusConflict, "the offer is waiting for the other party to respond")
+		return nil, false
+	}
+
+	return offer, true
+}
+
+// offerResponse sends the updated offer, or the appropriate error response if the update failed.
+func (app *application) offerResponse(w http.ResponseWriter, r *http.Request, offer *model.Offer, err error) {
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, model.ErrCarNotAvailable):
+			app.errorResponse(w, r, http.StatusConflict, "the car is no longer available")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"offer": offer}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/balgabekj/go_car/pkg/model"
+	"github.com/balgabekj/go_car/pkg/money"
+	"github.com/balgabekj/go_car/pkg/payment"
+	"github.com/balgabekj/go_car/pkg/validator"
+	"github.com/gorilla/mux"
+)
+
+// createOrderHandler lets a buyer order a car, paying either the full price or a deposit first,
+// and starts the first payment. An available car is ordered at its listed price and reserved for
+// the buyer; a car already reserved for the buyer is ordered at the price of their accepted offer
+// or winning bid.
+func (app *application) createOrderHandler(w http.ResponseWriter, r *http.Request) {
+	car, ok := app.readCarParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		PaymentType string `json:"payment_type"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.PaymentType == "" {
+		input.PaymentType = model.PaymentTypeFull
+	}
+
+	v := validator.New()
+
+	v.Check(validator.In(input.PaymentType, model.PaymentTypeFull, model.PaymentTypeDeposit), "payment_type", "must be full or deposit")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if int64(car.UserID) == user.ID {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "you can't order your own car")
+		return
+	}
+
+	order := &model.Order{
+		CarID:       car.ID,
+		Car:         fmt.Sprintf("%d %s %s", car.Year, car.Brand, car.Model),
+		BuyerID:     user.ID,
+		SellerID:    int64(car.UserID),
+		PaymentType: input.PaymentType,
+	}
+
+	var price money.Money
+
+	switch car.Status {
+	case model.CarStatusAvailable:
+		if !app.checkCarNotInAuction(w, r, car.ID) {
+			return
+		}
+
+		price = car.Price
+		order.ReservedCar = true
+
+	case model.CarStatusReserved:
+		agreed, ok, err := app.agreedPrice(car.ID, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !ok {
+			app.errorResponse(w, r, http.StatusConflict, "the car is reserved for another buyer")
+			return
+		}
+
+		price = agreed
+
+	default:
+		app.errorResponse(w, r, http.StatusConflict, "the car is no longer available")
+		return
+	}
+
+	// Orders are paid in the payment currency, so a price in another currency is converted at
+	// the current rate. The order records its currency, so it is still paid in that currency
+	// if the payment currency is changed later.
+	paymentCurrency, _ := money.LookupCurrency(app.config.payment.currency)
+
+	order.Price, err = app.models.Rates.Convert(price, paymentCurrency)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrNoExchangeRate):
+			app.errorResponse(w, r, http.StatusConflict, fmt.Sprintf("the car is priced in %s, which can't be converted to %s", price.Currency.Code, paymentCurrency.Code))
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if order.Price.Amount <= 0 {
+		app.errorResponse(w, r, http.StatusConflict, "the car has no price and can't be ordered")
+		return
+	}
+
+	order.Deposit = money.Money{Currency: order.Price.Currency}
+	if order.PaymentType == model.PaymentTypeDeposit {
+		order.Deposit = order.Price.Mul(app.config.payment.depositPercent.Rat())
+	}
+
+	err = app.models.Orders.Insert(order)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrCarNotAvailable):
+			app.errorResponse(w, r, http.StatusConflict, "the car is no longer available")
+		case errors.Is(err, model.ErrActiveOrderExists):
+			app.errorResponse(w, r, http.StatusConflict, "the car already has an order in progress")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/api/v1/orders/%d", order.ID))
+
+	env := envelope{"order": order}
+
+	// The order stands even if the provider can't be reached; the buyer can start the payment
+	// again later.
+	p, err := app.startPayment(r.Context(), order)
+	if err != nil {
+		app.logError(r, err)
+		env["message"] = fmt.Sprintf("the payment could not be started, please try again with POST /api/v1/orders/%d/payments", order.ID)
+	} else {
+		env["payment"] = p
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listOrdersHandler lists the orders the authenticated user placed or received. They can be
+// filtered by role (buyer or seller) and status.
+func (app *application) listOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		model.OrderFilter
+		model.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Role = app.readStrings(qs, "role", "")
+	input.Status = app.readStrings(qs, "status", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = "-created_at"
+	input.Filters.SortSafeList = []string{"-created_at"}
+
+	v.Check(validator.In(input.Role, "", "buyer", "seller"), "role", "must be buyer or seller")
+	v.Check(validator.In(input.Status, "", model.OrderStatusPending, model.OrderStatusDepositPaid,
+		model.OrderStatusCompleted, model.OrderStatusCancelled), "status", "invalid status value")
+
+	if model.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	orders, metadata, err := app.models.Orders.GetAllForUser(app.contextGetUser(r).ID, input.OrderFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"orders": orders, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showOrderHandler returns an order with its payments.
+func (app *application) showOrderHandler(w http.ResponseWriter, r *http.Request) {
+	order, ok := app.readOrderParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"order": order}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createOrderPaymentHandler starts the next payment for an order: the deposit, the full price or
+// the balance. If a payment is already waiting for the buyer it is returned instead, so that the
+// buyer can't end up paying twice.
+func (app *application) createOrderPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	order, ok := app.readOrderParam(w, r)
+	if !ok {
+		return
+	}
+
+	if order.BuyerID != app.contextGetUser(r).ID {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	if !order.IsPayable() {
+		app.errorResponse(w, r, http.StatusConflict, fmt.Sprintf("the order is already %s", order.Status))
+		return
+	}
+
+	p, err := app.models.Orders.GetPendingPayment(order.ID)
+	switch {
+	case err == nil && p.Reference != "":
+		err = app.writeJSON(w, http.StatusOK, envelope{"payment": p}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	case err != nil && !errors.Is(err, model.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// If a payment is still being created by a concurrent request, or it was lost less than a
+	// minute ago, startPayment refuses to start another one.
+	p, err = app.startPayment(r.Context(), order)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrPaymentInProgress):
+			app.errorResponse(w, r, http.StatusConflict, "a payment for this order is already being started, please try again shortly")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"payment": p}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// cancelOrderHandler calls off an order on behalf of either participant, as long as nothing has
+// been paid.
+func (app *application) cancelOrderHandler(w http.ResponseWriter, r *http.Request) {
+	order, ok := app.readOrderParam(w, r)
+	if !ok {
+		return
+	}
+
+	if order.Status != model.OrderStatusPending {
+		app.errorResponse(w, r, http.StatusConflict, fmt.Sprintf("an order can't be cancelled once it is %s", order.Status))
+		return
+	}
+
+	err := app.models.Orders.Cancel(order)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"order": order}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// paymentWebhookHandler receives payment status callbacks from the payment provider. Providers
+// retry callbacks until they get a 2xx response, so events which have already been processed are
+// acknowledged without being applied again, and callbacks for payments we don't know yet (e.g.
+// because the provider was faster than our own bookkeeping) get a 404 so they are retried.
+func (app *application) paymentWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	event, err := app.payment.ParseWebhook(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, payment.ErrInvalidSignature):
+			app.errorResponse(w, r, http.StatusUnauthorized, "invalid webhook signature")
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(event.ID != "", "id", "must be provided")
+	v.Check(event.PaymentID != "", "payment_id", "must be provided")
+	v.Check(validator.In(event.Status, payment.StatusPending, payment.StatusSucceeded, payment.StatusFailed), "status", "invalid status value")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	order, p, err := app.models.Orders.ApplyPaymentEvent(app.payment.Name(), event.ID, event.PaymentID, event.Status)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrDuplicateEvent):
+			err = app.writeJSON(w, http.StatusOK, envelope{"message": "event already processed"}, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Money taken for a payment we had given up on, or beyond the price, has to be refunded by
+	// hand.
+	if event.Status == payment.StatusSucceeded && p.Status != model.PaymentStatusSucceeded {
+		app.logger.PrintInfo("payment succeeded after it was failed, refund required", map[string]string{
+			"order_id":   strconv.FormatInt(order.ID, 10),
+			"payment_id": strconv.FormatInt(p.ID, 10),
+		})
+	}
+
+	if p.Status == model.PaymentStatusSucceeded && order.Balance.Amount < 0 {
+		app.logger.PrintInfo("order overpaid, refund required", map[string]string{
+			"order_id":   strconv.FormatInt(order.ID, 10),
+			"payment_id": strconv.FormatInt(p.ID, 10),
+		})
+	}
+
+	if p.Status == model.PaymentStatusSucceeded && order.Status == model.OrderStatusCancelled {
+		app.logger.PrintInfo("payment received for a cancelled order, refund required", map[string]string{
+			"order_id":   strconv.FormatInt(order.ID, 10),
+			"payment_id": strconv.FormatInt(p.ID, 10),
+		})
+	}
+
+	// The order was paid off by this payment, so issue its invoice. The order is reloaded to get
+	// all of its payments.
+	if p.Status == model.PaymentStatusSucceeded && order.Status == model.OrderStatusCompleted {
+		orderID := order.ID
+
+		app.background(func() {
+			order, err := app.models.Orders.Get(orderID)
+			if err == nil {
+				_, err = app.issueInvoice(order)
+			}
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{"order_id": strconv.FormatInt(orderID, 10)})
+			}
+		})
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "event processed"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// fakeCheckoutHandler stands in for the checkout page of the fake payment provider during
+// development: it completes the payment with the given status (succeeded by default) and
+// delivers the signed webhook callback, exactly as the provider would.
+func (app *application) fakeCheckoutHandler(w http.ResponseWriter, r *http.Request) {
+	fake, ok := app.payment.(*payment.Fake)
+	if !ok || app.config.env != "development" {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Status string `json:"status"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Status == "" {
+		input.Status = payment.StatusSucceeded
+	}
+
+	v := validator.New()
+
+	v.Check(validator.In(input.Status, payment.StatusSucceeded, payment.StatusFailed), "status", "must be succeeded or failed")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	webhook, err := fake.Complete(r.Context(), mux.Vars(r)["id"], input.Status, "/api/v1/payments/webhook")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	app.paymentWebhookHandler(w, webhook)
+}
+
+// startPayment records the next payment for an order and creates it at the payment provider. The
+// local payment ID is used as the idempotency key, so a retried call can't create a second
+// payment at the provider.
+func (app *application) startPayment(ctx context.Context, order *model.Order) (*model.Payment, error) {
+	p := &model.Payment{
+		OrderID:  order.ID,
+		Provider: app.payment.Name(),
+		Amount:   order.NextPaymentAmount(),
+	}
+
+	err := app.models.Orders.InsertPayment(p)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	created, err := app.payment.CreatePayment(ctx, payment.Request{
+		IdempotencyKey: fmt.Sprintf("payment-%d", p.ID),
+		Amount:         p.Amount,
+		Description:    fmt.Sprintf("Go Cars order %d: %s", order.ID, order.Car),
+	})
+	if err != nil {
+		p.Status = model.PaymentStatusFailed
+		if updateErr := app.models.Orders.UpdatePayment(p); updateErr != nil {
+			return nil, updateErr
+		}
+		return nil, err
+	}
+
+	p.Reference = created.ID
+	p.CheckoutURL = created.CheckoutURL
+	p.Status = created.Status
+
+	err = app.models.Orders.UpdatePayment(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// agreedPrice returns the price the buyer agreed for a reserved car, through an accepted offer or
+// by winning an auction. ok is false if the car isn't reserved for the buyer.
+func (app *application) agreedPrice(carID int, buyerID int64) (price money.Money, ok bool, err error) {
+	offer, err := app.models.Offers.GetAcceptedForCar(carID)
+	switch {
+	case err == nil:
+		if offer.BuyerID == buyerID {
+			return offer.Amount, true, nil
+		}
+	case !errors.Is(err, model.ErrRecordNotFound):
+		return money.Money{}, false, err
+	}
+
+	auction, err := app.models.Auctions.GetSoldForCar(carID)
+	switch {
+	case err == nil:
+		if auction.IsLeading(buyerID) {
+			return auction.CurrentPrice, true, nil
+		}
+	case !errors.Is(err, model.ErrRecordNotFound):
+		return money.Money{}, false, err
+	}
+
+	return money.Money{}, false, nil
+}
+
+// readOrderParam loads the order given by the "id" URL parameter. Orders the authenticated user
+// isn't a party to are reported as not found.
+func (app *application) readOrderParam(w http.ResponseWriter, r *http.Request) (*model.Order, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	order, err := app.models.Orders.Get(int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	if !order.HasParticipant(app.contextGetUser(r).ID) {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	return order, true
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/balgabekj/go_car/pkg/model"
+	"github.com/balgabekj/go_car/pkg/valuation"
+)
+
+// startPriceEstimator periodically estimates the market price of every listed car, which list
+// responses label cars with. The first run starts straight away so labels don't wait a whole
+// interval after a restart.
+func (app *application) startPriceEstimator() {
+	if app.config.estimate.interval <= 0 {
+		return
+	}
+
+	app.background(app.estimatePrices)
+	app.every(app.config.estimate.interval, app.estimatePrices)
+}
+
+// estimatePrices values every listed car against the others, in the currency of its own price,
+// and replaces the stored estimates. Sold cars are only used as comparables, and cars there
+// isn't enough data for are left without an estimate.
+func (app *application) estimatePrices() {
+	started := time.Now()
+
+	comparables, err := app.models.Cars.GetAllComparables()
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	rates, err := app.models.Rates.GetRates()
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	// Most cars are priced in one of a few currencies, so the comparables are converted and
+	// grouped once for each of them.
+	groups := map[string]comparableGroups{}
+	estimates := []model.PriceEstimate{}
+
+	for _, c := range comparables {
+		if c.Sold {
+			continue
+		}
+
+		currency := c.Price.Currency
+
+		if _, ok := groups[currency.Code]; !ok {
+			groups[currency.Code] = groupComparables(convertComparables(comparables, rates, currency))
+		}
+
+		subject := valuation.Subject{
+			Brand:        c.Brand,
+			Model:        c.Model,
+			Year:         c.Year,
+			Category:     c.Category,
+			ExcludeCarID: c.CarID,
+		}
+
+		result, err := valuation.Estimate(subject, groups[currency.Code].forSubject(&subject), currency, started.Year())
+		if err != nil {
+			if !errors.Is(err, valuation.ErrNotEnoughData) {
+				app.logger.PrintError(err, map[string]string{"car_id": strconv.Itoa(c.CarID)})
+			}
+			continue
+		}
+
+		estimates = append(estimates, priceEstimate(c.CarID, result))
+	}
+
+	err = app.models.Cars.ReplacePriceEstimates(estimates)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	app.logger.PrintInfo("car prices estimated", map[string]string{
+		"cars":        strconv.Itoa(len(estimates)),
+		"comparables": strconv.Itoa(len(comparables)),
+		"duration":    time.Since(started).String(),
+	})
+}
+
+// comparableGroups holds comparables grouped by brand, in lower case, and by category. An
+// estimate only looks at the cars of the subject's brand and category, so valuing each listing
+// against its groups rather than against every car keeps a run from growing with the square of
+// the number of cars.
+type comparableGroups struct {
+	brands     map[string][]valuation.Comparable
+	categories map[string][]valuation.Comparable
+}
+
+func groupComparables(comparables []valuation.Comparable) comparableGroups {
+	groups := comparableGroups{
+		brands:     map[string][]valuation.Comparable{},
+		categories: map[string][]valuation.Comparable{},
+	}
+
+	for _, c := range comparables {
+		brand := strings.ToLower(c.Brand)
+		groups.brands[brand] = append(groups.brands[brand], c)
+
+		if c.Category != "" {
+			groups.categories[c.Category] = append(groups.categories[c.Category], c)
+		}
+	}
+
+	return groups
+}
+
+// forSubject returns the cars of the subject's brand together with the cars of its category,
+// as GetComparables does. A subject without a category is given the one most cars of its model
+// are listed in.
+func (g comparableGroups) forSubject(subject *valuation.Subject) []valuation.Comparable {
+	brand := g.brands[strings.ToLower(subject.Brand)]
+
+	if subject.Category == "" {
+		subject.Category = valuation.ModelCategory(*subject, brand)
+	}
+
+	comparables := append([]valuation.Comparable(nil), brand...)
+
+	// Cars of the brand are already in the list.
+	for _, c := range g.categories[subject.Category] {
+		if !strings.EqualFold(c.Brand, subject.Brand) {
+			comparables = append(comparables, c)
+		}
+	}
+
+	return comparables
+}
+
+// suggestPrice returns the range a car could be priced at, from comparable cars other than
+// itself, in the currency of its price. It is shown to sellers when they list or update a car,
+// so it is only a hint: if there is too little data, or the estimate fails, it returns nil.
+func (app *application) suggestPrice(car *model.Car) *model.PriceEstimate {
+	subject := valuation.Subject{
+		Brand:        car.Brand,
+		Model:        car.Model,
+		Year:         car.Year,
+		Category:     car.CategoryName,
+		ExcludeCarID: car.ID,
+	}
+
+	comparables, err := app.comparables(subject, car.Price.Currency)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil
+	}
+
+	result, err := valuation.Estimate(subject, comparables, car.Price.Currency, time.Now().Year())
+	if err != nil {
+		if !errors.Is(err, valuation.ErrNotEnoughData) {
+			app.logger.PrintError(err, nil)
+		}
+		return nil
+	}
+
+	estimate := priceEstimate(car.ID, result)
+	return &estimate
+}
+
+func priceEstimate(carID int, result *valuation.Result) model.PriceEstimate {
+	return model.PriceEstimate{
+		CarID:      carID,
+		Low:        result.Low,
+		Value:      result.Value,
+		High:       result.High,
+		Confidence: result.Confidence,
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/balgabekj/go_car/pkg/model"
+	"github.com/balgabekj/go_car/pkg/validator"
+)
+
+// showCurrentUserHandler returns the profile of the authenticated user. The user is loaded from
+// the database rather than taken from the request context, because in signed token mode the
+// context only carries the ID and activation status from the token claims.
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateCurrentUserHandler partially updates the name and contact details of the authenticated
+// user. The email address and password have their own endpoints, because both need extra checks.
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Use pointers so we can tell a field that was left out of the request body apart from one
+	// that was explicitly set to the empty string.
+	var input struct {
+		Name     *string `json:"name"`
+		Phone    *string `json:"phone"`
+		Location *string `json:"location"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+	if input.Phone != nil {
+		user.Phone = *input.Phone
+	}
+	if input.Location != nil {
+		user.Location = *input.Location
+	}
+
+	v := validator.New()
+
+	model.ValidateUser(v, user)
+	model.ValidateContactDetails(v, user)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// requestEmailChangeHandler starts an email change. The new address is stored as pending and a
+// confirmation token is sent to it, so the address only changes once the user has proven they
+// own it.
+func (app *application) requestEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	model.ValidateEmail(v, input.Email)
+	model.ValidatePasswordPlaintext(v, input.Password)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, ok := app.currentUserWithPassword(w, r, input.Password)
+	if !ok {
+		return
+	}
+
+	if input.Email == user.Email {
+		v.AddError("email", "must be different from the current email address")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Report a taken address the same way registration does. The check is repeated when the
+	// change is confirmed, since someone else could register the address in the meantime.
+	_, err = app.models.Users.GetByEmail(input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, model.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.SetPendingEmail(user.ID, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Only the most recent request can be confirmed.
+	err = app.models.Tokens.DeleteAllForUser(model.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, model.ScopeEmailChange)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.sendEmail(input.Email, "email_change.tmpl", map[string]interface{}{
+		"name":             user.Name,
+		"email":            input.Email,
+		"emailChangeToken": token.Plaintext,
+	})
+
+	env := envelope{"message": "an email will be sent to the new address containing instructions to confirm the change"}
+	if app.config.env == "development" {
+		env["email_change_token"] = token.Plaintext
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmEmailChangeHandler completes an email change using the token sent to the new address.
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if model.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The token has to belong to the user making the request, so a token leaked from someone
+	// else's mailbox can't be used from another account.
+	user, err := app.models.Users.GetForToken(model.ScopeEmailChange, input.TokenPlaintext)
+	if err != nil && !errors.Is(err, model.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user == nil || user.ID != app.contextGetUser(r).ID {
+		v.AddError("token", "invalid or expired email change token")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.ConfirmEmailChange(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, model.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Password reset tokens were mailed to the old address, so they shouldn't outlive it.
+	for _, scope := range []string{model.ScopeEmailChange, model.ScopePasswordReset} {
+		err = app.models.Tokens.DeleteAllForUser(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// changePasswordHandler changes the password of the authenticated user, who has to provide their
+// current password. All sessions are ended afterwards, so the user has to log in again.
+func (app *application) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+	model.ValidatePasswordPlaintext(v, input.NewPassword)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, ok := app.currentUserWithPassword(w, r, input.CurrentPassword)
+	if !ok {
+		return
+	}
+
+	err = user.Password.Set(input.NewPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.revokeAllTokens(user.ID)
+	if err == nil {
+		err = app.models.Tokens.DeleteAllForUser(model.ScopePasswordReset, user.ID)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "your password was successfully changed, please log in again"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteCurrentUserHandler deletes the account of the authenticated user. Cars the user listed
+// are either kept under an anonymised account ("anonymise", the default) or handed over to
+// another activated user ("transfer"), e.g. a colleague at the same dealership.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password   string `json:"password"`
+		Listings   string `json:"listings"`
+		TransferTo string `json:"transfer_to"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Listings == "" {
+		input.Listings = "anonymise"
+	}
+
+	v := validator.New()
+
+	v.Check(input.Password != "", "password", "must be provided")
+	v.Check(validator.In(input.Listings, "anonymise", "transfer"), "listings", "must be either anonymise or transfer")
+	if input.Listings == "transfer" {
+		v.Check(validator.Matches(input.TransferTo, validator.EmailRX), "transfer_to", "must be a valid email address")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, ok := app.currentUserWithPassword(w, r, input.Password)
+	if !ok {
+		return
+	}
+
+	if input.Listings == "transfer" {
+		newOwner, err := app.models.Users.GetByEmail(input.TransferTo)
+		if err != nil && !errors.Is(err, model.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if newOwner == nil || !newOwner.Activated || newOwner.ID == user.ID {
+			v.AddError("transfer_to", "must be the email address of another activated user")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		err = app.models.Users.Delete(user.ID, newOwner.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		// The users row can only go away if nothing references it, so users who have listed
+		// cars are anonymised instead.
+		cars, err := app.models.Cars.CountForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if cars == 0 {
+			err = app.models.Users.Delete(user.ID, 0)
+		} else {
+			err = app.models.Users.Anonymise(user.ID)
+		}
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.models.Permissions.Cache.Invalidate(user.ID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "your account was successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// currentUserWithPassword loads the authenticated user and checks that the given password is
+// theirs. If it isn't, an invalid credentials response is sent and false is returned.
+func (app *application) currentUserWithPassword(w http.ResponseWriter, r *http.Request, password string) (*model.User, bool) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	match, err := user.Password.Matches(password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return nil, false
+	}
+
+	return user, true
+}
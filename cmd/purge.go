@@ -0,0 +1,53 @@
+package main
+
+import "strconv"
+
+// startPurger periodically deletes data we no longer need: expired tokens, expired data exports
+// and accounts that were registered but never activated. It also closes offers which have
+// expired, and fails exports which were lost while being built.
+func (app *application) startPurger() {
+	if app.config.purge.interval <= 0 {
+		return
+	}
+
+	app.every(app.config.purge.interval, app.purge)
+}
+
+// purge runs a single purge and logs how many records were deleted.
+func (app *application) purge() {
+	properties := make(map[string]string)
+
+	tokens, err := app.models.Tokens.DeleteExpired()
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+	properties["tokens"] = strconv.FormatInt(tokens, 10)
+
+	exports, err := app.models.Exports.DeleteExpired()
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+	properties["exports"] = strconv.FormatInt(exports, 10)
+
+	staleExports, err := app.models.Exports.FailStale(exportTimeout)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+	properties["stale_exports"] = strconv.FormatInt(staleExports, 10)
+
+	offers, err := app.models.Offers.ExpireStale()
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+	properties["offers"] = strconv.FormatInt(offers, 10)
+
+	if app.config.purge.unactivatedAfter > 0 {
+		users, err := app.models.Users.DeleteUnactivated(app.config.purge.unactivatedAfter)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+		properties["unactivated_users"] = strconv.FormatInt(users, 10)
+	}
+
+	app.logger.PrintInfo("purged expired records", properties)
+}
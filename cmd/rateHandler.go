@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/balgabekj/go_car/pkg/model"
+	"github.com/balgabekj/go_car/pkg/validator"
+)
+
+// listExchangeRatesHandler returns the exchange rates prices are converted at.
+func (app *application) listExchangeRatesHandler(w http.ResponseWriter, r *http.Request) {
+	rates, err := app.models.Rates.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"rates": rates}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateExchangeRatesHandler replaces the exchange rates with a new rate table, in the same form
+// as the -rates-file flag.
+func (app *application) updateExchangeRatesHandler(w http.ResponseWriter, r *http.Request) {
+	var input model.RateTable
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if model.ValidateRateTable(v, &input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Rates.Replace(&input)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.listExchangeRatesHandler(w, r)
+}
+
+// loadRatesFile replaces the exchange rates with those in the file given by the -rates-file
+// flag, if any. It is called at startup, so that rates can be kept in a file next to the
+// deployment instead of being set through the API.
+func (app *application) loadRatesFile() error {
+	if app.config.money.ratesFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(app.config.money.ratesFile)
+	if err != nil {
+		return err
+	}
+
+	var table model.RateTable
+
+	err = json.Unmarshal(data, &table)
+	if err != nil {
+		return fmt.Errorf("rates file: %w", err)
+	}
+
+	v := validator.New()
+
+	if model.ValidateRateTable(v, &table); !v.Valid() {
+		return fmt.Errorf("rates file: %v", v.Errors)
+	}
+
+	return app.models.Rates.Replace(&table)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"expvar"
 	"fmt"
 	"github.com/gorilla/mux"
 	"net/http"
@@ -11,24 +12,153 @@ func (app *application) routes() http.Handler {
 	r := mux.NewRouter()
 	// Cars
 	cars := r.PathPrefix("/api/v1").Subrouter()
+	cars.Use(app.rateLimit("cars"))
 
-	cars.HandleFunc("/cars", app.createCarHandler).Methods("POST")
+	cars.HandleFunc("/cars", app.requirePermissions("cars:write", app.createCarHandler)).Methods("POST")
 	cars.HandleFunc("/cars/{id}", app.getCarHandler).Methods("GET")
 	cars.HandleFunc("/cars", app.getAllCarHandler).Methods("GET")
-	cars.HandleFunc("/cars/{id}", app.updateCarHandler).Methods("PUT")
+	cars.HandleFunc("/cars/{id}", app.requirePermissions("cars:write", app.updateCarHandler)).Methods("PUT")
 	cars.HandleFunc("/cars/{id}", app.requirePermissions("cars:write", app.deleteCarHandler)).Methods("DELETE")
+	cars.HandleFunc("/cars/{id:[0-9]+}/financing", app.carFinancingHandler).Methods("GET")
+	cars.HandleFunc("/financing", app.calculateFinancingHandler).Methods("GET")
+	cars.HandleFunc("/valuation", app.valuationHandler).Methods("GET")
+	cars.HandleFunc("/exchange-rates", app.listExchangeRatesHandler).Methods("GET")
+	cars.HandleFunc("/exchange-rates", app.requirePermissions("rates:manage", app.updateExchangeRatesHandler)).Methods("PUT")
 
 	// Category
 	cars.HandleFunc("/category/{categoryName}/cars", app.getCarByCategoryHandler).Methods("GET")
-	cars.HandleFunc("/category", app.createCategoryHandler).Methods("POST")
-	cars.HandleFunc("/category/{name}", app.updateCategoryHandler).Methods("PUT")
-	cars.HandleFunc("/category/{name}", app.deleteCategoryHandler).Methods("DELETE")
+	cars.HandleFunc("/category", app.requirePermissions("cars:moderate", app.createCategoryHandler)).Methods("POST")
+	cars.HandleFunc("/category/{name}", app.requirePermissions("cars:moderate", app.updateCategoryHandler)).Methods("PUT")
+	cars.HandleFunc("/category/{name}", app.requirePermissions("cars:moderate", app.deleteCategoryHandler)).Methods("DELETE")
+	// Messages
+	messages := r.PathPrefix("/api/v1").Subrouter()
+	messages.Use(app.rateLimit("messages"))
+
+	messages.HandleFunc("/cars/{id:[0-9]+}/messages", app.requireInteractiveUser(app.sendCarMessageHandler)).Methods("POST")
+	messages.HandleFunc("/conversations", app.requireActivatedUser(app.listConversationsHandler)).Methods("GET")
+	messages.HandleFunc("/conversations/{id:[0-9]+}", app.requireActivatedUser(app.showConversationHandler)).Methods("GET")
+	messages.HandleFunc("/conversations/{id:[0-9]+}/messages", app.requireInteractiveUser(app.sendConversationMessageHandler)).Methods("POST")
+	messages.HandleFunc("/users/me/blocks", app.requireActivatedUser(app.listBlockedUsersHandler)).Methods("GET")
+	messages.HandleFunc("/users/{id:[0-9]+}/block", app.requireInteractiveUser(app.blockUserHandler)).Methods("POST")
+	messages.HandleFunc("/users/{id:[0-9]+}/block", app.requireInteractiveUser(app.unblockUserHandler)).Methods("DELETE")
+	messages.HandleFunc("/users/{id:[0-9]+}/reports", app.requireInteractiveUser(app.reportUserHandler)).Methods("POST")
+	messages.HandleFunc("/reports", app.requirePermissions("users:manage", app.listReportsHandler)).Methods("GET")
+
+	// Offers
+	offers := r.PathPrefix("/api/v1").Subrouter()
+	offers.Use(app.rateLimit("offers"))
+
+	offers.HandleFunc("/cars/{id:[0-9]+}/offers", app.requireInteractiveUser(app.createOfferHandler)).Methods("POST")
+	offers.HandleFunc("/offers", app.requireActivatedUser(app.listOffersHandler)).Methods("GET")
+	offers.HandleFunc("/offers/{id:[0-9]+}", app.requireActivatedUser(app.showOfferHandler)).Methods("GET")
+	offers.HandleFunc("/offers/{id:[0-9]+}/counter", app.requireInteractiveUser(app.counterOfferHandler)).Methods("POST")
+	offers.HandleFunc("/offers/{id:[0-9]+}/accept", app.requireInteractiveUser(app.acceptOfferHandler)).Methods("POST")
+	offers.HandleFunc("/offers/{id:[0-9]+}/reject", app.requireInteractiveUser(app.rejectOfferHandler)).Methods("POST")
+	offers.HandleFunc("/offers/{id:[0-9]+}/withdraw", app.requireInteractiveUser(app.withdrawOfferHandler)).Methods("POST")
+
+	// Test drives
+	testDrives := r.PathPrefix("/api/v1").Subrouter()
+	testDrives.Use(app.rateLimit("test-drives"))
+
+	testDrives.HandleFunc("/users/me/availability", app.requireActivatedUser(app.showAvailabilityHandler)).Methods("GET")
+	testDrives.HandleFunc("/users/me/availability", app.requireInteractiveUser(app.updateAvailabilityHandler)).Methods("PUT")
+	testDrives.HandleFunc("/users/me/availability/blackouts", app.requireInteractiveUser(app.createBlackoutHandler)).Methods("POST")
+	testDrives.HandleFunc("/users/me/availability/blackouts/{date}", app.requireInteractiveUser(app.deleteBlackoutHandler)).Methods("DELETE")
+	testDrives.HandleFunc("/cars/{id:[0-9]+}/availability", app.showCarAvailabilityHandler).Methods("GET")
+	testDrives.HandleFunc("/cars/{id:[0-9]+}/test-drives", app.requireInteractiveUser(app.createTestDriveHandler)).Methods("POST")
+	testDrives.HandleFunc("/test-drives", app.requireActivatedUser(app.listTestDrivesHandler)).Methods("GET")
+	testDrives.HandleFunc("/test-drives/{id:[0-9]+}", app.requireActivatedUser(app.showTestDriveHandler)).Methods("GET")
+	testDrives.HandleFunc("/test-drives/{id:[0-9]+}/ics", app.requireActivatedUser(app.testDriveICSHandler)).Methods("GET")
+	testDrives.HandleFunc("/test-drives/{id:[0-9]+}/confirm", app.requireInteractiveUser(app.confirmTestDriveHandler)).Methods("POST")
+	testDrives.HandleFunc("/test-drives/{id:[0-9]+}/cancel", app.requireInteractiveUser(app.cancelTestDriveHandler)).Methods("POST")
+	testDrives.HandleFunc("/test-drives/{id:[0-9]+}/reschedule", app.requireInteractiveUser(app.rescheduleTestDriveHandler)).Methods("POST")
+	testDrives.HandleFunc("/users/me/calendar-feed", app.requireInteractiveUser(app.createCalendarFeedHandler)).Methods("POST")
+	testDrives.HandleFunc("/users/me/calendar-feed", app.requireInteractiveUser(app.deleteCalendarFeedHandler)).Methods("DELETE")
+	testDrives.HandleFunc("/calendar/{token}.ics", app.calendarFeedHandler).Methods("GET")
+
+	// Auctions
+	auctions := r.PathPrefix("/api/v1").Subrouter()
+	auctions.Use(app.rateLimit("auctions"))
+
+	auctions.HandleFunc("/cars/{id:[0-9]+}/auction", app.requirePermissions("cars:write", app.createAuctionHandler)).Methods("POST")
+	auctions.HandleFunc("/auctions", app.listAuctionsHandler).Methods("GET")
+	auctions.HandleFunc("/auctions/{id:[0-9]+}", app.showAuctionHandler).Methods("GET")
+	auctions.HandleFunc("/auctions/{id:[0-9]+}", app.requireInteractiveUser(app.cancelAuctionHandler)).Methods("DELETE")
+	auctions.HandleFunc("/auctions/{id:[0-9]+}/bids", app.listBidsHandler).Methods("GET")
+	auctions.HandleFunc("/auctions/{id:[0-9]+}/bids", app.requireInteractiveUser(app.placeBidHandler)).Methods("POST")
+
+	// Orders
+	orders := r.PathPrefix("/api/v1").Subrouter()
+	orders.Use(app.rateLimit("orders"))
+
+	orders.HandleFunc("/cars/{id:[0-9]+}/orders", app.requireInteractiveUser(app.createOrderHandler)).Methods("POST")
+	orders.HandleFunc("/orders", app.requireActivatedUser(app.listOrdersHandler)).Methods("GET")
+	orders.HandleFunc("/orders/{id:[0-9]+}", app.requireActivatedUser(app.showOrderHandler)).Methods("GET")
+	orders.HandleFunc("/orders/{id:[0-9]+}/payments", app.requireInteractiveUser(app.createOrderPaymentHandler)).Methods("POST")
+	orders.HandleFunc("/orders/{id:[0-9]+}/cancel", app.requireInteractiveUser(app.cancelOrderHandler)).Methods("POST")
+	orders.HandleFunc("/orders/{id:[0-9]+}/invoice", app.requireActivatedUser(app.showOrderInvoiceHandler)).Methods("GET")
+	orders.HandleFunc("/payments/fake/{id}", app.fakeCheckoutHandler).Methods("POST")
+
 	//Users
 	users := r.PathPrefix("/api/v1").Subrouter()
+	users.Use(app.rateLimit("users"))
 
 	users.HandleFunc("/users", app.registerUserHandler).Methods("POST")
 	users.HandleFunc("/users/activated", app.activateUserHandler).Methods("PUT")
-	users.HandleFunc("/tokens/authentication", app.createAuthenticationTokenHandler).Methods("POST")
+	users.HandleFunc("/users/password", app.updateUserPasswordHandler).Methods("PUT")
+	users.HandleFunc("/users", app.requirePermissions("users:manage", app.adminListUsersHandler)).Methods("GET")
+	users.HandleFunc("/users/{id:[0-9]+}", app.requirePermissions("users:manage", app.adminShowUserHandler)).Methods("GET")
+	users.HandleFunc("/users/{id:[0-9]+}", app.requirePermissions("users:manage", app.adminUpdateUserHandler)).Methods("PATCH")
+	users.HandleFunc("/users/{id:[0-9]+}/password-reset", app.requirePermissions("users:manage", app.adminForcePasswordResetHandler)).Methods("POST")
+	users.HandleFunc("/users/{id:[0-9]+}/tokens", app.requirePermissions("users:manage", app.adminRevokeTokensHandler)).Methods("DELETE")
+	users.HandleFunc("/users/{id:[0-9]+}/permissions", app.requirePermissions("users:manage", app.adminGrantPermissionsHandler)).Methods("POST")
+	users.HandleFunc("/users/{id:[0-9]+}/permissions/{code}", app.requirePermissions("users:manage", app.adminRevokePermissionHandler)).Methods("DELETE")
+	users.HandleFunc("/users/{id}/lockout", app.requirePermissions("users:manage", app.unlockUserHandler)).Methods("DELETE")
+	users.HandleFunc("/users/{id}/roles", app.requirePermissions("roles:manage", app.listUserRolesHandler)).Methods("GET")
+	users.HandleFunc("/users/{id}/roles", app.requirePermissions("roles:manage", app.assignUserRoleHandler)).Methods("POST")
+	users.HandleFunc("/users/{id}/roles/{role}", app.requirePermissions("roles:manage", app.removeUserRoleHandler)).Methods("DELETE")
+	users.HandleFunc("/roles", app.requirePermissions("roles:manage", app.listRolesHandler)).Methods("GET")
+	users.HandleFunc("/roles", app.requirePermissions("roles:manage", app.createRoleHandler)).Methods("POST")
+	users.HandleFunc("/roles/{name}", app.requirePermissions("roles:manage", app.updateRoleHandler)).Methods("PUT")
+	users.HandleFunc("/roles/{name}", app.requirePermissions("roles:manage", app.deleteRoleHandler)).Methods("DELETE")
+	users.HandleFunc("/users/me", app.requireAuthenticatedUser(app.showCurrentUserHandler)).Methods("GET")
+	users.HandleFunc("/users/me", app.requireInteractiveUser(app.updateCurrentUserHandler)).Methods("PATCH")
+	users.HandleFunc("/users/me", app.requireInteractiveUser(app.deleteCurrentUserHandler)).Methods("DELETE")
+	users.HandleFunc("/users/me/email", app.requireInteractiveUser(app.requestEmailChangeHandler)).Methods("POST")
+	users.HandleFunc("/users/me/email", app.requireInteractiveUser(app.confirmEmailChangeHandler)).Methods("PUT")
+	users.HandleFunc("/users/me/password", app.requireInteractiveUser(app.changePasswordHandler)).Methods("PUT")
+	users.HandleFunc("/users/me/export", app.requireInteractiveUser(app.createDataExportHandler)).Methods("POST")
+	users.HandleFunc("/users/me/export/{id:[0-9]+}", app.requireInteractiveUser(app.showDataExportHandler)).Methods("GET")
+	users.HandleFunc("/exports/{token}", app.downloadDataExportHandler).Methods("GET")
+	users.HandleFunc("/users/me/sessions", app.requireAuthenticatedUser(app.listSessionsHandler)).Methods("GET")
+	users.HandleFunc("/users/me/sessions/{id}", app.requireAuthenticatedUser(app.denyAPIKeys(app.deleteSessionHandler))).Methods("DELETE")
+	users.HandleFunc("/users/me/mfa/totp", app.requireInteractiveUser(app.enrollTOTPHandler)).Methods("POST")
+	users.HandleFunc("/users/me/mfa/totp/confirm", app.requireInteractiveUser(app.confirmTOTPHandler)).Methods("POST")
+	users.HandleFunc("/users/me/mfa/totp", app.requireInteractiveUser(app.disableTOTPHandler)).Methods("DELETE")
+	users.HandleFunc("/users/me/api-keys", app.requireInteractiveUser(app.createAPIKeyHandler)).Methods("POST")
+	users.HandleFunc("/users/me/api-keys", app.requireInteractiveUser(app.listAPIKeysHandler)).Methods("GET")
+	users.HandleFunc("/users/me/api-keys/{id}", app.requireInteractiveUser(app.deleteAPIKeyHandler)).Methods("DELETE")
+
+	// Tokens. These endpoints accept credentials, so they get their own, stricter, rate limit.
+	tokens := r.PathPrefix("/api/v1/tokens").Subrouter()
+	tokens.Use(app.rateLimit("tokens"))
+
+	tokens.HandleFunc("/authentication", app.createAuthenticationTokenHandler).Methods("POST")
+	tokens.HandleFunc("/authentication", app.requireAuthenticatedUser(app.denyAPIKeys(app.deleteAuthenticationTokenHandler))).Methods("DELETE")
+	tokens.HandleFunc("/authentication/all", app.requireAuthenticatedUser(app.denyAPIKeys(app.deleteAllAuthenticationTokensHandler))).Methods("DELETE")
+	tokens.HandleFunc("/password-reset", app.createPasswordResetTokenHandler).Methods("POST")
+	tokens.HandleFunc("/activation", app.createActivationTokenHandler).Methods("POST")
+	tokens.HandleFunc("/refresh", app.refreshTokenHandler).Methods("POST")
+	tokens.HandleFunc("/mfa", app.createMFAAuthenticationTokenHandler).Methods("POST")
+
+	// Payment provider callbacks. They come from the provider's servers, which retry failed
+	// deliveries, so they aren't rate limited.
+	r.HandleFunc("/api/v1/payments/webhook", app.paymentWebhookHandler).Methods("POST")
+
+	// Application metrics, including the permission cache hit/miss counters. The default expvar
+	// output contains the command line, and with it any secrets passed as flags, so it is only
+	// available to administrators.
+	r.HandleFunc("/debug/vars", app.requirePermissions("users:manage", expvar.Handler().ServeHTTP)).Methods("GET")
 
 	return app.authenticate(r)
 
@@ -65,6 +65,11 @@ func (app *application) serve() error {
 			"addr": srv.Addr,
 		})
 
+		// Stop the periodic jobs first, so that none of them starts another background task
+		// while we wait.
+		close(app.shutdown)
+		app.tickers.Wait()
+
 		// Call Wait() to block until our WaitGroup counter is zero. This essentially blocks
 		// until the background goroutines have finished. Then we return nil on the shutdownError
 		// channel to indicate that the shutdown as compleeted without any issues.
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/balgabekj/go_car/pkg/ical"
+	"github.com/balgabekj/go_car/pkg/model"
+	"github.com/balgabekj/go_car/pkg/validator"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// availabilityHorizon is how far ahead a car's booked slots are reported.
+	availabilityHorizon = 30 * 24 * time.Hour
+
+	// calendarFeedTTL is how long a calendar feed URL stays valid. Calendar apps poll feeds for as
+	// long as they're subscribed, so it is long-lived; users can revoke it at any time.
+	calendarFeedTTL = 365 * 24 * time.Hour
+
+	// calendarFeedHistory is how far back ended test drives are kept in calendar feeds.
+	calendarFeedHistory = 30 * 24 * time.Hour
+)
+
+// showAvailabilityHandler returns the authenticated seller's weekly test drive schedule and
+// upcoming blackout dates.
+func (app *application) showAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
+	availability, err := app.models.Availability.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"availability": availability}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateAvailabilityHandler replaces the authenticated seller's weekly windows and time zone.
+// Existing bookings are left alone, even if they no longer fit the schedule.
+func (app *application) updateAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Timezone string                     `json:"timezone"`
+		Windows  []model.AvailabilityWindow `json:"windows"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	availability := &model.Availability{
+		Timezone: input.Timezone,
+		Windows:  input.Windows,
+	}
+
+	v := validator.New()
+
+	if model.ValidateAvailability(v, availability); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.Availability.SetWindows(user.ID, availability)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	availability, err = app.models.Availability.Get(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"availability": availability}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createBlackoutHandler blocks a date, in the seller's time zone, for new test drives.
+func (app *application) createBlackoutHandler(w http.ResponseWriter, r *http.Request) {
+	var input model.Blackout
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if model.ValidateBlackout(v, input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Availability.AddBlackout(app.contextGetUser(r).ID, input)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"blackout": input}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteBlackoutHandler unblocks a date given as YYYY-MM-DD in the URL.
+func (app *application) deleteBlackoutHandler(w http.ResponseWriter, r *http.Request) {
+	date := mux.Vars(r)["date"]
+
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err := app.models.Availability.DeleteBlackout(app.contextGetUser(r).ID, date)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "blackout successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showCarAvailabilityHandler returns the seller's schedule for a car together with the slots in
+// the next 30 days which are already booked, so that clients can offer free slots to buyers.
+func (app *application) showCarAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
+	car, ok := app.readCarParam(w, r)
+	if !ok {
+		return
+	}
+
+	availability, err := app.models.Availability.Get(int64(car.UserID))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	now := time.Now()
+
+	busy, err := app.models.TestDrives.GetBusySlots(car.ID, int64(car.UserID), now, now.Add(availabilityHorizon))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"availability": availability, "busy": busy}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createTestDriveHandler lets a buyer request a test drive of a car. The slot has to fit the
+// seller's availability; overlapping bookings are rejected by the database.
+func (app *application) createTestDriveHandler(w http.ResponseWriter, r *http.Request) {
+	car, ok := app.readCarParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Start           time.Time `json:"start"`
+		DurationMinutes int       `json:"duration_minutes"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.DurationMinutes == 0 {
+		input.DurationMinutes = 30
+	}
+
+	v := validator.New()
+
+	if model.ValidateTestDriveSlot(v, input.Start, input.DurationMinutes); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	sellerID := int64(car.UserID)
+
+	if sellerID == user.ID {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "you can't book a test drive of your own car")
+		return
+	}
+
+	if car.Status == model.CarStatusSold {
+		app.errorResponse(w, r, http.StatusConflict, "the car has already been sold")
+		return
+	}
+
+	blocked, err := app.models.Blocks.IsBlocked(user.ID, sellerID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if blocked {
+		app.errorResponse(w, r, http.StatusForbidden, "you can't book a test drive with this seller")
+		return
+	}
+
+	td := &model.TestDrive{
+		CarID:      car.ID,
+		BuyerID:    user.ID,
+		SellerID:   sellerID,
+		Start:      input.Start.Truncate(time.Minute),
+		ProposedBy: user.ID,
+	}
+	td.End = td.Start.Add(time.Duration(input.DurationMinutes) * time.Minute)
+
+	if !app.checkSellerAvailability(w, r, td) {
+		return
+	}
+
+	err = app.models.TestDrives.Insert(td)
+	if err != nil {
+		app.testDriveResponse(w, r, nil, err)
+		return
+	}
+
+	// Reload the test drive to fill in the car and location.
+	td, err = app.models.TestDrives.Get(td.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/api/v1/test-drives/%d", td.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"test_drive": td}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listTestDrivesHandler lists the test drives the authenticated user booked or hosts. They can be
+// filtered by role (buyer or seller), car and status, and upcoming=true leaves out past ones.
+func (app *application) listTestDrivesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		model.TestDriveFilter
+		model.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Role = app.readStrings(qs, "role", "")
+	input.CarID = app.readInt(qs, "car_id", 0, v)
+	input.Status = app.readStrings(qs, "status", "")
+	if upcoming := app.readBool(qs, "upcoming", v); upcoming != nil {
+		input.Upcoming = *upcoming
+	}
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = "start"
+	input.Filters.SortSafeList = []string{"start"}
+
+	v.Check(validator.In(input.Role, "", "buyer", "seller"), "role", "must be buyer or seller")
+	v.Check(validator.In(input.Status, "", model.TestDriveStatusRequested, model.TestDriveStatusConfirmed,
+		model.TestDriveStatusCancelled), "status", "invalid status value")
+
+	if model.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	testDrives, metadata, err := app.models.TestDrives.GetAllForUser(app.contextGetUser(r).ID, input.TestDriveFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"test_drives": testDrives, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showTestDriveHandler returns a single test drive.
+func (app *application) showTestDriveHandler(w http.ResponseWriter, r *http.Request) {
+	td, ok := app.readTestDriveParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"test_drive": td}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmTestDriveHandler accepts the proposed slot. Only the participant who didn't propose it
+// can confirm it.
+func (app *application) confirmTestDriveHandler(w http.ResponseWriter, r *http.Request) {
+	td, ok := app.readOpenTestDrive(w, r)
+	if !ok {
+		return
+	}
+
+	if td.AwaitingConfirmationFrom() != app.contextGetUser(r).ID {
+		switch td.Status {
+		case model.TestDriveStatusConfirmed:
+			app.errorResponse(w, r, http.StatusConflict, "the test drive is already confirmed")
+		default:
+			app.errorResponse(w, r, http.StatusConflict, "the test drive is waiting for the other party to confirm")
+		}
+		return
+	}
+
+	td.Status = model.TestDriveStatusConfirmed
+
+	err := app.models.TestDrives.Update(td)
+	app.testDriveResponse(w, r, td, err)
+}
+
+// cancelTestDriveHandler calls off a test drive on behalf of either participant, which frees the
+// slot for other bookings.
+func (app *application) cancelTestDriveHandler(w http.ResponseWriter, r *http.Request) {
+	td, ok := app.readOpenTestDrive(w, r)
+	if !ok {
+		return
+	}
+
+	td.Status = model.TestDriveStatusCancelled
+
+	err := app.models.TestDrives.Update(td)
+	app.testDriveResponse(w, r, td, err)
+}
+
+// rescheduleTestDriveHandler proposes a new slot on behalf of either participant. The test drive
+// goes back to requested until the other participant confirms it. Buyers have to stay within the
+// seller's availability, while sellers are free to offer any time.
+func (app *application) rescheduleTestDriveHandler(w http.ResponseWriter, r *http.Request) {
+	td, ok := app.readOpenTestDrive(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Start           time.Time `json:"start"`
+		DurationMinutes int       `json:"duration_minutes"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.DurationMinutes == 0 {
+		input.DurationMinutes = int(td.End.Sub(td.Start).Minutes())
+	}
+
+	v := validator.New()
+
+	if model.ValidateTestDriveSlot(v, input.Start, input.DurationMinutes); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	td.Start = input.Start.Truncate(time.Minute)
+	td.End = td.Start.Add(time.Duration(input.DurationMinutes) * time.Minute)
+	td.Status = model.TestDriveStatusRequested
+	td.ProposedBy = user.ID
+
+	if user.ID == td.BuyerID && !app.checkSellerAvailability(w, r, td) {
+		return
+	}
+
+	err = app.models.TestDrives.Update(td)
+	app.testDriveResponse(w, r, td, err)
+}
+
+// testDriveICSHandler downloads a test drive as an iCalendar file, for adding it to a calendar
+// app by hand.
+func (app *application) testDriveICSHandler(w http.ResponseWriter, r *http.Request) {
+	td, ok := app.readTestDriveParam(w, r)
+	if !ok {
+		return
+	}
+
+	calendar := &ical.Calendar{
+		Events: []ical.Event{testDriveEvent(td, app.contextGetUser(r).ID)},
+	}
+
+	app.writeCalendar(w, r, calendar, fmt.Sprintf("test-drive-%d.ics", td.ID))
+}
+
+// createCalendarFeedHandler issues a secret URL for subscribing to the authenticated user's test
+// drives from a calendar app. Calendar apps can't send an Authorization header, so the token in
+// the URL is the only credential; issuing a new URL revokes the previous one.
+func (app *application) createCalendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.models.Tokens.DeleteAllForUser(model.ScopeCalendar, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, calendarFeedTTL, model.ScopeCalendar)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"calendar_feed": envelope{
+		"url":    fmt.Sprintf("/api/v1/calendar/%s.ics", token.Plaintext),
+		"expiry": token.Expiry,
+	}}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteCalendarFeedHandler revokes the authenticated user's calendar feed URL.
+func (app *application) deleteCalendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.models.Tokens.DeleteAllForUser(model.ScopeCalendar, app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "calendar feed successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// calendarFeedHandler serves the test drives of the user owning the feed token, both as buyer
+// and as seller. Cancelled test drives stay in the feed, so that calendar apps remove them.
+func (app *application) calendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+
+	v := validator.New()
+	if model.ValidateTokenPlaintext(v, token); !v.Valid() {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(model.ScopeCalendar, token)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	testDrives, err := app.models.TestDrives.GetAllInvolving(user.ID, time.Now().Add(-calendarFeedHistory))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	calendar := &ical.Calendar{Name: "Go Cars test drives"}
+	for _, td := range testDrives {
+		calendar.Events = append(calendar.Events, testDriveEvent(td, user.ID))
+	}
+
+	app.writeCalendar(w, r, calendar, "test-drives.ics")
+}
+
+// testDriveEvent describes a test drive as a calendar event, from the point of view of the given
+// participant. The version doubles as the sequence number, so calendar apps pick up changes.
+func testDriveEvent(td *model.TestDrive, userID int64) ical.Event {
+	status := ical.StatusTentative
+	switch td.Status {
+	case model.TestDriveStatusConfirmed:
+		status = ical.StatusConfirmed
+	case model.TestDriveStatusCancelled:
+		status = ical.StatusCancelled
+	}
+
+	role := "buyer"
+	if userID == td.SellerID {
+		role = "seller"
+	}
+
+	return ical.Event{
+		UID:         fmt.Sprintf("test-drive-%d@gocars", td.ID),
+		Sequence:    td.Version,
+		Start:       td.Start,
+		End:         td.End,
+		Summary:     "Test drive: " + td.Car,
+		Description: fmt.Sprintf("Test drive of the %s, booked through Go Cars. You are the %s. Status: %s.", td.Car, role, td.Status),
+		Location:    td.Location,
+		Status:      status,
+		Updated:     td.UpdatedAt,
+	}
+}
+
+// writeCalendar sends an iCalendar file as a download.
+func (app *application) writeCalendar(w http.ResponseWriter, r *http.Request, calendar *ical.Calendar, filename string) {
+	body := calendar.Bytes()
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Cache-Control", "no-store")
+
+	_, err := w.Write(body)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// checkSellerAvailability sends a failed validation response and returns false unless the slot
+// of the test drive fits the seller's availability.
+func (app *application) checkSellerAvailability(w http.ResponseWriter, r *http.Request, td *model.TestDrive) bool {
+	availability, err := app.models.Availability.Get(td.SellerID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if len(availability.Windows) == 0 {
+		app.errorResponse(w, r, http.StatusConflict, "the seller doesn't accept test drives at the moment")
+		return false
+	}
+
+	if !availability.Allows(td.Start, td.End) {
+		v := validator.New()
+		v.AddError("start", "must be within the seller's availability")
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	return true
+}
+
+// readTestDriveParam loads the test drive given by the "id" URL parameter. Test drives the
+// authenticated user isn't a party to are reported as not found.
+func (app *application) readTestDriveParam(w http.ResponseWriter, r *http.Request) (*model.TestDrive, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	td, err := app.models.TestDrives.Get(int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	if !td.HasParticipant(app.contextGetUser(r).ID) {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	return td, true
+}
+
+// readOpenTestDrive loads the test drive given by the "id" URL parameter and checks that it can
+// still be changed, i.e. it hasn't been cancelled and hasn't started yet.
+func (app *application) readOpenTestDrive(w http.ResponseWriter, r *http.Request) (*model.TestDrive, bool) {
+	td, ok := app.readTestDriveParam(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	if td.Status == model.TestDriveStatusCancelled {
+		app.errorResponse(w, r, http.StatusConflict, "the test drive has been cancelled")
+		return nil, false
+	}
+
+	if !td.Start.After(time.Now()) {
+		app.errorResponse(w, r, http.StatusConflict, "the test drive has already started")
+		return nil, false
+	}
+
+	return td, true
+}
+
+// testDriveResponse sends the updated test drive, or the appropriate error response if the
+// update failed.
+func (app *application) testDriveResponse(w http.ResponseWriter, r *http.Request, td *model.TestDrive, err error) {
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, model.ErrSlotTaken):
+			app.errorResponse(w, r, http.StatusConflict, "the slot is no longer available")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"test_drive": td}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/balgabekj/go_car/pkg/jsonlog"
+	"github.com/balgabekj/go_car/pkg/model"
+	"github.com/gorilla/mux"
+)
+
+// fakeResult is what the fake database answers a statement with: rows for a query, or the
+// number of rows affected for anything else.
+type fakeResult struct {
+	columns      []string
+	rows         [][]driver.Value
+	rowsAffected int64
+}
+
+// fakeDB is a database/sql driver answering statements from canned results, matched by a
+// fragment of their SQL, so that handlers can be tested without PostgreSQL. It records every
+// statement it is given.
+type fakeDB struct {
+	mu         sync.Mutex
+	results    map[string]fakeResult
+	statements []string
+}
+
+func newFakeDB(t *testing.T, results map[string]fakeResult) (*fakeDB, *sql.DB) {
+	f := &fakeDB{results: results}
+
+	db := sql.OpenDB(f)
+	t.Cleanup(func() { db.Close() })
+
+	return f, db
+}
+
+// executed reports whether a statement containing the given SQL fragment was run.
+func (f *fakeDB) executed(fragment string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, s := range f.statements {
+		if strings.Contains(s, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeDB) result(query string) (fakeResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.statements = append(f.statements, query)
+
+	for fragment, result := range f.results {
+		if strings.Contains(query, fragment) {
+			return result, nil
+		}
+	}
+	return fakeResult{}, errors.New("fakeDB: unexpected statement: " + query)
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fakeDB: not supported")
+}
+func (c fakeConn) Close() error              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) { return nil, errors.New("fakeDB: not supported") }
+
+func (c fakeConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	result, err := c.db.result(query)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{result: result}, nil
+}
+
+func (c fakeConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	result, err := c.db.result(query)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(result.rowsAffected), nil
+}
+
+type fakeRows struct {
+	result fakeResult
+	next   int
+}
+
+func (r *fakeRows) Columns() []string { return r.result.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next == len(r.result.rows) {
+		return io.EOF
+	}
+	copy(dest, r.result.rows[r.next])
+	r.next++
+	return nil
+}
+
+// newTestApplication returns an application using the given database, which logs nothing.
+func newTestApplication(db *sql.DB) *application {
+	return &application{
+		models: model.NewModels(db, 0),
+		logger: jsonlog.NewLogger(io.Discard, jsonlog.LevelOff),
+	}
+}
+
+// serve calls a handler with a request for the target made by the given user, with the given URL
+// parameters, and returns the response.
+func serve(app *application, handler http.HandlerFunc, method, target string, user *model.User, vars map[string]string) *http.Response {
+	r := httptest.NewRequest(method, target, nil)
+	r = mux.SetURLVars(r, vars)
+	r = app.contextSetUser(r, user)
+
+	rr := httptest.NewRecorder()
+	handler(rr, r)
+
+	return rr.Result()
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"errors"
+	"github.com/balgabekj/go_car/pkg/jwt"
 	"github.com/balgabekj/go_car/pkg/model"
+	"github.com/balgabekj/go_car/pkg/ratelimit"
 	"github.com/balgabekj/go_car/pkg/validator"
+	"github.com/gorilla/mux"
 	"net/http"
 	"time"
 )
@@ -32,6 +35,12 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	// Refuse to even look at the password while the account or the client IP is locked out after
+	// too many failed attempts.
+	if app.checkLockout(w, r, input.Email) {
+		return
+	}
+
 	// Lookup the user record based on the email address. If no matching user was found, then we
 	// call the app.invalidCredentialsResponse() helper to send a 501 Unauthorized response to
 	// the client.
@@ -39,7 +48,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
-			app.invalidCredentialsResponse(w, r)
+			app.loginFailedResponse(w, r, input.Email)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -56,21 +65,418 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	// If the passwords don't match, then call the app.invalidCredentialsResponse() helper
 	// and return
 	if !match {
-		app.invalidCredentialsResponse(w, r)
+		app.loginFailedResponse(w, r, input.Email)
+		return
+	}
+
+	// If the user has two-factor authentication enabled, the password alone isn't enough. Hand
+	// out a short-lived 'mfa-pending' token which has to be exchanged together with a valid code
+	// at POST /api/v1/tokens/mfa.
+	mfaEnabled, err := app.models.MFA.IsEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if mfaEnabled {
+		token, err := app.models.Tokens.New(user.ID, 5*time.Minute, model.ScopeMFAPending)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusAccepted, envelope{"mfa_required": true, "mfa_token": token}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.startSession(w, r, user)
+}
+
+// checkLockout sends a 429 Too Many Requests response and returns true if either the account with
+// the given email address or the client's IP address is currently locked out.
+func (app *application) checkLockout(w http.ResponseWriter, r *http.Request, email string) bool {
+	lockedUntil, err := app.models.Lockouts.LockedUntil(model.AccountLockoutKey(email), model.IPLockoutKey(app.clientIP(r)))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return true
+	}
+
+	if lockedUntil.IsZero() {
+		return false
+	}
+
+	app.lockedOutResponse(w, r, time.Until(lockedUntil))
+	return true
+}
+
+// loginFailedResponse counts a failed login against both the account and the client IP, logging
+// any lockout this triggers, and sends the client an invalid credentials response.
+func (app *application) loginFailedResponse(w http.ResponseWriter, r *http.Request, email string) {
+	failures := []struct {
+		key    model.LockoutKey
+		policy model.LockoutPolicy
+	}{
+		{model.AccountLockoutKey(email), app.config.lockout.account},
+		{model.IPLockoutKey(app.clientIP(r)), app.config.lockout.ip},
+	}
+
+	for _, f := range failures {
+		lockedUntil, err := app.models.Lockouts.RecordFailure(f.key, f.policy)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !lockedUntil.IsZero() {
+			app.logger.PrintInfo("login locked out", map[string]string{
+				"kind":         f.key.Kind,
+				"subject":      f.key.Subject,
+				"locked_until": lockedUntil.Format(time.RFC3339),
+			})
+		}
+	}
+
+	app.invalidCredentialsResponse(w, r)
+}
+
+// startSession logs the user in: it creates a long-lived 'refresh' token which can be exchanged
+// for new tokens, and a short-lived authentication token, and sends both to the client. It is
+// only called once the user is fully authenticated, including the second factor, so it is also
+// where earlier failures for the account are forgotten.
+func (app *application) startSession(w http.ResponseWriter, r *http.Request, user *model.User) {
+	err := app.models.Lockouts.Reset(model.AccountLockoutKey(user.Email))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	refresh, err := app.models.Tokens.NewSession(user.ID, app.config.auth.refreshTTL, r.UserAgent(), app.clientIP(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.newAuthenticationToken(r, user, refresh.Family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Encode the tokens to JSON and send them in the response along with a 201 Created status code.
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// activationResendLimit caps how many activation emails can be sent to one address, so the
+// endpoint can't be used to flood someone's mailbox.
+var activationResendLimit = ratelimit.Limit{Rate: 1.0 / 60, Burst: 3}
+
+// createActivationTokenHandler sends a fresh activation token to a user who hasn't activated
+// their account yet, e.g. because the one from the welcome email expired. Like the password reset
+// endpoint it always gives the same response, so it can't be used to find out which email
+// addresses are registered.
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if model.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{"message": "if an inactive account with that email address exists, an email will be sent to it containing activation instructions"}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.writeJSON(w, http.StatusAccepted, env, nil)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Activated || user.Deactivated() {
+		app.writeJSON(w, http.StatusAccepted, env, nil)
+		return
+	}
+
+	res, err := app.limiter.Take("activation:email:"+user.Email, activationResendLimit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !res.Allowed {
+		app.writeJSON(w, http.StatusAccepted, env, nil)
 		return
 	}
 
-	// Otherwise, if the password is correct, we generate a new token with a 24-hour expiry time
-	// and the scope 'authentication'.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, model.ScopeAuthentication)
+	// Only the newest activation token should work.
+	err = app.models.Tokens.DeleteAllForUser(model.ScopeActivation, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// Encode the token to JSON and send it in the response along with a 201 Created status code.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, model.ScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.sendEmail(user.Email, "token_activation.tmpl", map[string]interface{}{
+		"name":            user.Name,
+		"activationToken": token.Plaintext,
+	})
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createPasswordResetTokenHandler emails a password reset token to the owner of the provided email
+// address. To avoid revealing which email addresses are registered, the client always receives
+// the same 202 Accepted response, whether or not a matching user exists.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
 	}
+
+	v := validator.New()
+
+	if model.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{"message": "if an account with that email address exists, an email will be sent to it containing password reset instructions"}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.writeJSON(w, http.StatusAccepted, env, nil)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Generate a short-lived password reset token and email it to the user.
+	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, model.ScopePasswordReset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.sendEmail(user.Email, "password_reset.tmpl", map[string]interface{}{
+		"passwordResetToken": token.Plaintext,
+	})
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAuthenticationTokenHandler logs the client out by revoking the token the current request
+// was authenticated with, together with the refresh token issued alongside it.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	if session := app.contextGetSession(r); session != "" {
+		err = app.models.Tokens.DeleteFamily(session)
+	} else {
+		err = app.models.Tokens.DeleteSessionForPlaintext(app.contextGetToken(r))
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAllAuthenticationTokensHandler logs the user out everywhere by revoking every
+// authentication and refresh token they own, including the current ones.
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	for _, scope := range []string{model.ScopeAuthentication, model.ScopeRefresh} {
+		err := app.models.Tokens.DeleteAllForUser(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"message": "all sessions have been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listSessionsHandler lists the active sessions of the current user.
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, app.contextGetToken(r), app.contextGetSession(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteSessionHandler revokes one of the current user's sessions by its id, as listed by
+// listSessionsHandler.
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if !model.ValidSessionID(id) {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err := app.models.Tokens.DeleteSession(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// refreshTokenHandler exchanges a refresh token for a new authentication and refresh token pair.
+// Refresh tokens are single use: replaying one that was already exchanged revokes the whole
+// session, since it means either the client or an attacker is holding a stale copy.
+func (app *application) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if model.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	refresh, err := app.models.Tokens.Rotate(input.RefreshToken, app.config.auth.refreshTTL, r.UserAgent(), app.clientIP(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrTokenReused):
+			app.logger.PrintInfo("refresh token reuse detected, session revoked", map[string]string{
+				"ip":         app.clientIP(r),
+				"user_agent": r.UserAgent(),
+			})
+			app.invalidAuthenticationTokenResponse(w, r)
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(refresh.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.newAuthenticationToken(r, user, refresh.Family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// newAuthenticationToken issues an authentication token for the user's session. By default this
+// is an opaque token stored in the tokens table. With -auth-mode=signed it is instead a signed
+// token embedding the user's id, activation state and permissions, which the authenticate
+// middleware can verify without any database lookups.
+func (app *application) newAuthenticationToken(r *http.Request, user *model.User, family string) (*model.Token, error) {
+	if app.signer == nil {
+		return app.models.Tokens.NewAuthentication(user.ID, family, app.config.auth.accessTTL, r.UserAgent(), app.clientIP(r))
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiry := now.Add(app.config.auth.accessTTL)
+
+	plaintext, err := app.signer.Sign(jwt.Claims{
+		UserID:      user.ID,
+		Session:     family,
+		Activated:   user.Activated,
+		Permissions: permissions,
+		IssuedAt:    now.Unix(),
+		Expiry:      expiry.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.Token{
+		Plaintext: plaintext,
+		UserID:    user.ID,
+		Expiry:    expiry,
+		Scope:     model.ScopeAuthentication,
+		Family:    family,
+	}, nil
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/balgabekj/go_car/pkg/model"
@@ -67,7 +68,9 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.models.Permissions.AddForUser(user.ID, "cars:write")
+	// Give the new user the configured default role instead of granting permission codes one
+	// by one.
+	err = app.models.Roles.AddForUser(user.ID, app.config.defaultRole)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -81,15 +84,25 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	var res struct {
-		Token *string     `json:"token"`
-		User  *model.User `json:"user"`
-	}
+	// Send the welcome email containing the activation token in the background, so the client
+	// doesn't have to wait for the SMTP round trip.
+	app.sendEmail(user.Email, "user_welcome.tmpl", map[string]interface{}{
+		"name":            user.Name,
+		"activationToken": token.Plaintext,
+		"userID":          user.ID,
+	})
 
-	res.Token = &token.Plaintext
-	res.User = user
+	// Only echo the activation token back to the client in development, where there might not
+	// be a real mailbox to receive it.
+	env := envelope{"user": user}
+	if app.config.env == "development" {
+		env["activation_token"] = token.Plaintext
+	}
 
-	app.writeJSON(w, http.StatusCreated, envelope{"user": res}, nil)
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
 
 // activateUserHandler activates a user by setting 'activation = true' using the provided
@@ -129,6 +142,14 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// Accounts deactivated by an administrator can't be reactivated with a token the user still
+	// had lying around.
+	if user.Deactivated() {
+		v.AddError("token", "invalid or expired activation token")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	// Update the user's activation status.
 	user.Activated = true
 
@@ -154,3 +175,100 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 
 	app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
 }
+
+// updateUserPasswordHandler sets a new password for the user who owns the provided password
+// reset token. On success every outstanding password reset, authentication and refresh token for
+// the user is revoked, so existing sessions have to log in again with the new password.
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	model.ValidatePasswordPlaintext(v, input.Password)
+	model.ValidateTokenPlaintext(v, input.TokenPlaintext)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(model.ScopePasswordReset, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Save the new password hash. Update bumps the version, so any concurrent edit of the same
+	// user record will fail with an edit conflict.
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	for _, scope := range []string{model.ScopePasswordReset, model.ScopeAuthentication, model.ScopeRefresh} {
+		err = app.models.Tokens.DeleteAllForUser(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	env := envelope{"message": "your password was successfully reset"}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// unlockUserHandler lets an administrator lift a login lockout on a user's account before it
+// expires on its own.
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.Lockouts.Reset(model.AccountLockoutKey(user.Email))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo("login lockout lifted", map[string]string{
+		"user_id":  strconv.FormatInt(user.ID, 10),
+		"admin_id": strconv.FormatInt(app.contextGetUser(r).ID, 10),
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "account successfully unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/balgabekj/go_car/pkg/money"
+	"github.com/balgabekj/go_car/pkg/validator"
+	"github.com/balgabekj/go_car/pkg/valuation"
+)
+
+// valuationHandler estimates what a car is worth, e.g. as a trade-in, from comparable listings
+// and sales on the marketplace. The car is described in the query string by its brand, model,
+// year, mileage in kilometres and condition; the estimate is in the requested currency, or the
+// default currency. The comparables used are returned with the estimate.
+func (app *application) valuationHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	v := validator.New()
+
+	subject := valuation.Subject{
+		Brand:     strings.TrimSpace(app.readStrings(qs, "brand", "")),
+		Model:     strings.TrimSpace(app.readStrings(qs, "model", "")),
+		Year:      app.readInt(qs, "year", 0, v),
+		Condition: app.readStrings(qs, "condition", valuation.ConditionGood),
+	}
+
+	mileage := app.readInt(qs, "mileage", -1, v)
+	subject.Mileage = &mileage
+
+	currency := app.config.money.currency
+	if code := app.readStrings(qs, "currency", ""); code != "" {
+		var ok bool
+		currency, ok = money.LookupCurrency(strings.ToUpper(code))
+		v.Check(ok, "currency", "must be a supported ISO 4217 currency code")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	year := time.Now().Year()
+
+	v.Check(subject.Brand != "", "brand", "must be provided")
+	v.Check(subject.Model != "", "model", "must be provided")
+	v.Check(subject.Year >= 1900 && subject.Year <= year+1, "year", "must be a valid model year")
+	v.Check(mileage >= 0, "mileage", "must be provided")
+	v.Check(mileage <= 2_000_000, "mileage", "must not be more than 2,000,000 km")
+	v.Check(validator.In(subject.Condition, valuation.Conditions...), "condition", "must be excellent, good, fair or poor")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	comparables, err := app.comparables(subject, currency)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	result, err := valuation.Estimate(subject, comparables, currency, year)
+	if err != nil {
+		switch {
+		case errors.Is(err, valuation.ErrNotEnoughData):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, "there are not enough comparable cars to estimate a value")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"valuation": result}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// comparables returns the cars to value the subject against, with their prices converted to
+// the given currency. Cars priced in a currency without an exchange rate are left out.
+func (app *application) comparables(subject valuation.Subject, currency money.Currency) ([]valuation.Comparable, error) {
+	comparables, err := app.models.Cars.GetComparables(subject.Brand, subject.Model, subject.Category)
+	if err != nil {
+		return nil, err
+	}
+
+	rates, err := app.models.Rates.GetRates()
+	if err != nil {
+		return nil, err
+	}
+
+	return convertComparables(comparables, rates, currency), nil
+}
+
+// convertComparables returns a copy of the comparables with their prices converted to the given
+// currency, leaving out those priced in a currency without an exchange rate.
+func convertComparables(comparables []valuation.Comparable, rates money.Rates, currency money.Currency) []valuation.Comparable {
+	converted := make([]valuation.Comparable, 0, len(comparables))
+
+	for _, c := range comparables {
+		if price, ok := rates.Convert(c.Price, currency); ok {
+			c.Price = price
+			converted = append(converted, c)
+		}
+	}
+
+	return converted
+}
@@ -2,12 +2,15 @@ module github.com/balgabekj/go_car
 
 go 1.22.1
 
+require (
+	github.com/golang-migrate/migrate v3.5.4+incompatible
+	github.com/gorilla/mux v1.8.1
+	github.com/lib/pq v1.10.9
+	github.com/peterbourgon/ff/v3 v3.4.0
+	golang.org/x/crypto v0.22.0
+)
+
 require (
 	github.com/go-chi/chi/v5 v5.0.12 // indirect
-	github.com/golang-migrate/migrate v3.5.4+incompatible // indirect
-	github.com/gorilla/mux v1.8.1 // indirect
 	github.com/julienschmidt/httprouter v1.3.0 // indirect
-	github.com/lib/pq v1.10.9 // indirect
-	github.com/peterbourgon/ff/v3 v3.4.0 // indirect
-	golang.org/x/crypto v0.22.0 // indirect
 )
@@ -0,0 +1,185 @@
+// Package finance calculates monthly payment schedules for car loans and leases. All amounts are
+// exact: interest is worked out on rational numbers and each figure in the schedule is rounded
+// to the minor unit of the price's currency, with the last instalment absorbing the rounding
+// differences so the schedule always adds up.
+package finance
+
+import (
+	"encoding/json"
+	"math/big"
+	"strings"
+
+	"github.com/balgabekj/go_car/pkg/money"
+)
+
+// Kinds of financing.
+const (
+	Loan  = "loan"
+	Lease = "lease"
+)
+
+// Plan describes the financing to calculate. The down payment and the residual are in the
+// currency of the price. APR is the annual percentage rate, e.g. 7.9 for 7.9%. Residual is the
+// value of the car at the end of the term: for a lease it is what the car is expected to be
+// worth when it is handed back, and for a loan it is an optional balloon payment due after the
+// last instalment.
+type Plan struct {
+	Kind        string
+	Price       money.Money
+	DownPayment money.Money
+	Residual    money.Money
+	Term        int
+	APR         *big.Rat
+}
+
+// Instalment is one monthly payment. For a loan, Interest and Principal are the interest and the
+// repayment; for a lease they are the finance charge and the depreciation. Balance is what is
+// left of the amount financed after the payment.
+type Instalment struct {
+	Month     int         `json:"month"`
+	Payment   money.Money `json:"payment"`
+	Interest  money.Money `json:"interest"`
+	Principal money.Money `json:"principal"`
+	Balance   money.Money `json:"balance"`
+}
+
+// Schedule is a calculated plan with its monthly instalments. All amounts are in the currency of
+// the price.
+type Schedule struct {
+	Kind           string       `json:"type"`
+	Price          money.Money  `json:"price"`
+	DownPayment    money.Money  `json:"down_payment"`
+	AmountFinanced money.Money  `json:"amount_financed"`
+	Residual       money.Money  `json:"residual"`
+	Term           int          `json:"term"`
+	APR            json.Number  `json:"apr"`
+	MonthlyPayment money.Money  `json:"monthly_payment"`
+	TotalPayments  money.Money  `json:"total_payments"`
+	TotalInterest  money.Money  `json:"total_interest"`
+	TotalCost      money.Money  `json:"total_cost"`
+	Instalments    []Instalment `json:"instalments"`
+}
+
+// Calculate works out the schedule for a plan. The plan must already have been validated: the
+// term has to be positive, and the down payment and residual have to leave something to finance.
+//
+// Loans are amortised with equal monthly payments in arrears, each paying the month's interest
+// on the outstanding balance and repaying the rest. Leases use the usual money factor method: a
+// fixed depreciation charge of (amount financed - residual) / term plus a fixed finance charge of
+// (amount financed + residual) × APR / 2400 each month.
+func Calculate(plan Plan) *Schedule {
+	currency := plan.Price.Currency
+
+	// amount rounds an amount in major units to the minor unit of the currency, and round does
+	// the same for intermediate figures.
+	amount := func(r *big.Rat) money.Money { return money.FromRat(r, currency) }
+	round := func(r *big.Rat) *big.Rat { return amount(r).Rat() }
+
+	financed := new(big.Rat).Sub(plan.Price.Rat(), plan.DownPayment.Rat())
+	residual := plan.Residual.Rat()
+	term := big.NewRat(int64(plan.Term), 1)
+
+	var interest func(balance *big.Rat) *big.Rat
+	var payment *big.Rat
+
+	switch plan.Kind {
+	case Lease:
+		moneyFactor := new(big.Rat).Quo(plan.APR, big.NewRat(2400, 1))
+		charge := round(new(big.Rat).Mul(new(big.Rat).Add(financed, residual), moneyFactor))
+
+		depreciation := new(big.Rat).Quo(new(big.Rat).Sub(financed, residual), term)
+		payment = new(big.Rat).Add(round(depreciation), charge)
+
+		interest = func(*big.Rat) *big.Rat { return charge }
+	default:
+		rate := new(big.Rat).Quo(plan.APR, big.NewRat(1200, 1))
+
+		payment = annuity(financed, residual, rate, plan.Term)
+
+		interest = func(balance *big.Rat) *big.Rat {
+			return round(new(big.Rat).Mul(balance, rate))
+		}
+	}
+
+	payment = round(payment)
+
+	s := &Schedule{
+		Kind:           plan.Kind,
+		Price:          plan.Price,
+		DownPayment:    plan.DownPayment,
+		AmountFinanced: amount(financed),
+		Residual:       plan.Residual,
+		Term:           plan.Term,
+		APR:            decimal(plan.APR),
+		MonthlyPayment: amount(payment),
+		Instalments:    make([]Instalment, 0, plan.Term),
+	}
+
+	balance := new(big.Rat).Set(financed)
+	totalPayments := new(big.Rat)
+	totalInterest := new(big.Rat)
+
+	for month := 1; month <= plan.Term; month++ {
+		i := interest(balance)
+		principal := new(big.Rat).Sub(payment, i)
+		p := payment
+
+		// The last payment is adjusted so that exactly the residual is left.
+		if month == plan.Term {
+			principal = new(big.Rat).Sub(balance, residual)
+			p = new(big.Rat).Add(principal, i)
+		}
+
+		balance.Sub(balance, principal)
+		totalPayments.Add(totalPayments, p)
+		totalInterest.Add(totalInterest, i)
+
+		s.Instalments = append(s.Instalments, Instalment{
+			Month:     month,
+			Payment:   amount(p),
+			Interest:  amount(i),
+			Principal: amount(principal),
+			Balance:   amount(balance),
+		})
+	}
+
+	s.TotalPayments = amount(totalPayments)
+	s.TotalInterest = amount(totalInterest)
+
+	// What the buyer pays altogether. A lease residual isn't included, since the car is handed
+	// back instead; a loan's balloon payment is.
+	cost := new(big.Rat).Add(plan.DownPayment.Rat(), totalPayments)
+	if plan.Kind == Loan {
+		cost.Add(cost, residual)
+	}
+	s.TotalCost = amount(cost)
+
+	return s
+}
+
+// decimal formats a rate given as a terminating decimal, such as an APR, as an exact JSON number
+// without trailing zeros.
+func decimal(r *big.Rat) json.Number {
+	s := r.FloatString(10)
+	return json.Number(strings.TrimSuffix(strings.TrimRight(s, "0"), "."))
+}
+
+// annuity returns the exact monthly payment which pays off pv down to fv over n months at the
+// given monthly rate: (pv × (1+r)^n − fv) × r / ((1+r)^n − 1), or (pv − fv) / n without interest.
+func annuity(pv, fv, rate *big.Rat, n int) *big.Rat {
+	if rate.Sign() == 0 {
+		return new(big.Rat).Quo(new(big.Rat).Sub(pv, fv), big.NewRat(int64(n), 1))
+	}
+
+	growth := new(big.Rat).Add(big.NewRat(1, 1), rate)
+	factor := big.NewRat(1, 1)
+	for i := 0; i < n; i++ {
+		factor.Mul(factor, growth)
+	}
+
+	numerator := new(big.Rat).Mul(pv, factor)
+	numerator.Sub(numerator, fv)
+	numerator.Mul(numerator, rate)
+
+	return numerator.Quo(numerator, new(big.Rat).Sub(factor, big.NewRat(1, 1)))
+}
@@ -0,0 +1,178 @@
+package finance
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/balgabekj/go_car/pkg/money"
+)
+
+var (
+	eur = money.Currency{Code: "EUR", Exponent: 2}
+	jpy = money.Currency{Code: "JPY", Exponent: 0}
+)
+
+func amount(t *testing.T, s string, currency money.Currency) money.Money {
+	t.Helper()
+
+	m, err := money.Parse(s, currency)
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", s, err)
+	}
+
+	return m
+}
+
+func rate(t *testing.T, s string) *big.Rat {
+	t.Helper()
+
+	r, err := money.ParseRat(s, 4)
+	if err != nil {
+		t.Fatalf("ParseRat(%q): %v", s, err)
+	}
+
+	return r
+}
+
+func TestCalculate(t *testing.T) {
+	plan := func(kind, price, downPayment, residual string, term int, apr string, currency money.Currency) Plan {
+		return Plan{
+			Kind:        kind,
+			Price:       amount(t, price, currency),
+			DownPayment: amount(t, downPayment, currency),
+			Residual:    amount(t, residual, currency),
+			Term:        term,
+			APR:         rate(t, apr),
+		}
+	}
+
+	tests := []struct {
+		name         string
+		plan         Plan
+		wantPayment  string
+		wantInterest string
+	}{
+		{
+			name:        "loan",
+			plan:        plan(Loan, "20000", "0", "0", 60, "6", eur),
+			wantPayment: "386.66",
+		},
+		{
+			name:         "interest free loan",
+			plan:         plan(Loan, "12500", "500", "0", 12, "0", eur),
+			wantPayment:  "1000.00",
+			wantInterest: "0.00",
+		},
+		{
+			name:        "loan with a balloon payment",
+			plan:        plan(Loan, "30000", "3000", "9000", 48, "7.9", eur),
+			wantPayment: "497.84",
+		},
+		{
+			name:        "one month loan",
+			plan:        plan(Loan, "1000", "0", "0", 1, "12", eur),
+			wantPayment: "1010.00",
+		},
+		{
+			// Money factor 4.8 / 2400 = 0.002: a finance charge of (30000 + 18000) × 0.002 = 96
+			// and depreciation of 12000 / 36 = 333.33 a month.
+			name:         "lease",
+			plan:         plan(Lease, "30000", "0", "18000", 36, "4.8", eur),
+			wantPayment:  "429.33",
+			wantInterest: "3456.00",
+		},
+		{
+			// The yen has no minor unit, so 38665.60 is rounded to a whole yen.
+			name:        "loan in a currency without minor units",
+			plan:        plan(Loan, "2000000", "0", "0", 60, "6", jpy),
+			wantPayment: "38666",
+		},
+		{
+			// A finance charge of 4800000 × 0.002 = 9600 and depreciation of 1200000 / 36 =
+			// 33333.33, rounded to 33333, a month.
+			name:         "lease in a currency without minor units",
+			plan:         plan(Lease, "3000000", "0", "1800000", 36, "4.8", jpy),
+			wantPayment:  "42933",
+			wantInterest: "345600",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Calculate(tt.plan)
+
+			if got := s.MonthlyPayment.Decimal(); got != tt.wantPayment {
+				t.Errorf("monthly payment = %s, want %s", got, tt.wantPayment)
+			}
+			if tt.wantInterest != "" && s.TotalInterest.Decimal() != tt.wantInterest {
+				t.Errorf("total interest = %s, want %s", s.TotalInterest, tt.wantInterest)
+			}
+
+			if len(s.Instalments) != tt.plan.Term {
+				t.Fatalf("got %d instalments, want %d", len(s.Instalments), tt.plan.Term)
+			}
+
+			// The schedule has to reconcile exactly: the principal repaid brings the amount
+			// financed down to the residual, and the payments are the principal plus interest.
+			currency := tt.plan.Price.Currency
+
+			var payments, interest, principal int64
+			for _, i := range s.Instalments {
+				payments += i.Payment.Amount
+				interest += i.Interest.Amount
+				principal += i.Principal.Amount
+
+				if i.Month < tt.plan.Term && i.Payment != s.MonthlyPayment {
+					t.Errorf("instalment %d is %s, want %s", i.Month, i.Payment, s.MonthlyPayment)
+				}
+
+				for _, m := range []money.Money{i.Payment, i.Interest, i.Principal, i.Balance} {
+					if m.Currency != currency {
+						t.Fatalf("instalment %d has an amount in %q, want %s", i.Month, m.Currency.Code, currency.Code)
+					}
+				}
+			}
+
+			last := s.Instalments[len(s.Instalments)-1]
+			if last.Balance != s.Residual {
+				t.Errorf("final balance = %s, want the residual %s", last.Balance, s.Residual)
+			}
+
+			if repaid := s.AmountFinanced.Amount - s.Residual.Amount; principal != repaid {
+				t.Errorf("principal repaid = %d, want %d", principal, repaid)
+			}
+
+			if payments != s.TotalPayments.Amount {
+				t.Errorf("total payments = %s, instalments add up to %d", s.TotalPayments, payments)
+			}
+			if interest != s.TotalInterest.Amount {
+				t.Errorf("total interest = %s, instalments add up to %d", s.TotalInterest, interest)
+			}
+
+			// The last instalment only absorbs rounding, so it stays within a minor unit a month
+			// of the others.
+			diff := last.Payment.Amount - s.MonthlyPayment.Amount
+			if diff < -int64(tt.plan.Term) || diff > int64(tt.plan.Term) {
+				t.Errorf("last instalment %s is too far from the monthly payment %s", last.Payment, s.MonthlyPayment)
+			}
+		})
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	tests := []struct {
+		r    *big.Rat
+		want string
+	}{
+		{r: big.NewRat(79, 10), want: "7.9"},
+		{r: big.NewRat(6, 1), want: "6"},
+		{r: big.NewRat(0, 1), want: "0"},
+		{r: big.NewRat(41255, 10000), want: "4.1255"},
+	}
+
+	for _, tt := range tests {
+		if got := string(decimal(tt.r)); got != tt.want {
+			t.Errorf("decimal(%s) = %s, want %s", tt.r, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Package ical writes iCalendar (RFC 5545) files, so that test drives and other appointments can
+// be added to calendar apps, either as a single .ics download or as a subscribable feed.
+package ical
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Event statuses understood by calendar apps.
+const (
+	StatusTentative = "TENTATIVE"
+	StatusConfirmed = "CONFIRMED"
+	StatusCancelled = "CANCELLED"
+)
+
+// prodID identifies the application that produced the calendar.
+const prodID = "-//Go Cars//Go Cars API//EN"
+
+// Event is a single VEVENT. UID must stay the same across updates of the same appointment, and
+// Sequence must increase with each update, so that calendar apps replace the event instead of
+// adding a copy.
+type Event struct {
+	UID         string
+	Sequence    int
+	Start       time.Time
+	End         time.Time
+	Summary     string
+	Description string
+	Location    string
+	Status      string
+	Updated     time.Time
+}
+
+// Calendar is a VCALENDAR containing any number of events. Name is shown by calendar apps when
+// the calendar is subscribed to as a feed.
+type Calendar struct {
+	Name   string
+	Events []Event
+}
+
+// Bytes encodes the calendar.
+func (c *Calendar) Bytes() []byte {
+	var buf bytes.Buffer
+
+	writeLine(&buf, "BEGIN:VCALENDAR")
+	writeLine(&buf, "VERSION:2.0")
+	writeLine(&buf, "PRODID:"+prodID)
+	writeLine(&buf, "CALSCALE:GREGORIAN")
+	writeLine(&buf, "METHOD:PUBLISH")
+	if c.Name != "" {
+		writeLine(&buf, "X-WR-CALNAME:"+escape(c.Name))
+	}
+
+	for _, e := range c.Events {
+		writeLine(&buf, "BEGIN:VEVENT")
+		writeLine(&buf, "UID:"+escape(e.UID))
+		writeLine(&buf, "DTSTAMP:"+formatTime(e.Updated))
+		writeLine(&buf, "DTSTART:"+formatTime(e.Start))
+		writeLine(&buf, "DTEND:"+formatTime(e.End))
+		writeLine(&buf, fmt.Sprintf("SEQUENCE:%d", e.Sequence))
+		writeLine(&buf, "SUMMARY:"+escape(e.Summary))
+		if e.Description != "" {
+			writeLine(&buf, "DESCRIPTION:"+escape(e.Description))
+		}
+		if e.Location != "" {
+			writeLine(&buf, "LOCATION:"+escape(e.Location))
+		}
+		if e.Status != "" {
+			writeLine(&buf, "STATUS:"+e.Status)
+		}
+		writeLine(&buf, "END:VEVENT")
+	}
+
+	writeLine(&buf, "END:VCALENDAR")
+
+	return buf.Bytes()
+}
+
+// formatTime formats a time as a UTC date-time, e.g. 20240131T143000Z.
+func formatTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// escaper escapes the characters that have a special meaning in TEXT values.
+var escaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+// writeLine writes a content line terminated by CRLF, folding it so that no line is longer than
+// 75 octets. Continuation lines start with a single space, which counts towards their length, and
+// lines are never split inside a multi-byte UTF-8 character.
+func writeLine(buf *bytes.Buffer, line string) {
+	limit := 75
+
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !isRuneStart(line[cut]) {
+			cut--
+		}
+
+		buf.WriteString(line[:cut])
+		buf.WriteString("\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
@@ -0,0 +1,148 @@
+// Package invoice renders sales invoices to HTML and PDF. Both formats are produced from
+// templates embedded in the binary: the HTML version from an html/template, and the PDF version
+// from a plain-text template which is typeset in a fixed-width font.
+package invoice
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"math/big"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/balgabekj/go_car/pkg/money"
+)
+
+//go:embed "templates"
+var templateFS embed.FS
+
+// Party is the seller or the buyer, as they were when the invoice was issued.
+type Party struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Phone    string `json:"phone,omitempty"`
+	Location string `json:"location,omitempty"`
+}
+
+// Line is an invoice line item. UnitPrice and Amount include tax.
+type Line struct {
+	Description string      `json:"description"`
+	Quantity    int         `json:"quantity"`
+	UnitPrice   money.Money `json:"unit_price"`
+	Amount      money.Money `json:"amount"`
+}
+
+// Payment is a payment received against the invoice.
+type Payment struct {
+	Date   time.Time   `json:"date"`
+	Amount money.Money `json:"amount"`
+}
+
+// Document holds everything shown on an invoice. All amounts are in Currency. Prices include tax;
+// Subtotal and Tax break the total down into the net amount and the tax it contains.
+type Document struct {
+	Number   string        `json:"number"`
+	IssuedAt time.Time     `json:"issued_at"`
+	OrderID  int64         `json:"order_id"`
+	Seller   Party         `json:"seller"`
+	Buyer    Party         `json:"buyer"`
+	Lines    []Line        `json:"lines"`
+	Payments []Payment     `json:"payments"`
+	Currency string        `json:"currency"`
+	TaxName  string        `json:"tax_name"`
+	TaxRate  money.Percent `json:"tax_rate"`
+	Subtotal money.Money   `json:"subtotal"`
+	Tax      money.Money   `json:"tax"`
+	Total    money.Money   `json:"total"`
+}
+
+// CalculateTotals sets the line amounts and the document totals from the lines. The tax is worked
+// out once on the total rather than per line, so the figures always add up to the minor unit.
+func (d *Document) CalculateTotals() {
+	var total int64
+
+	for i := range d.Lines {
+		line := &d.Lines[i]
+		line.Amount = money.New(line.UnitPrice.Amount*int64(line.Quantity), d.Currency)
+		total += line.Amount.Amount
+	}
+
+	d.Total = money.New(total, d.Currency)
+
+	// Prices include tax, so the net amount is the total divided by 1 + the tax rate.
+	d.Subtotal = d.Total.Mul(new(big.Rat).Inv(new(big.Rat).Add(big.NewRat(1, 1), d.TaxRate.Rat())))
+	d.Tax = money.New(total-d.Subtotal.Amount, d.Currency)
+}
+
+// HTML renders the invoice as a standalone HTML page.
+func (d *Document) HTML() ([]byte, error) {
+	tmpl, err := htmltemplate.New("invoice.html.tmpl").Funcs(htmltemplate.FuncMap(funcs)).ParseFS(templateFS, "templates/invoice.html.tmpl")
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, d); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// PDF renders the invoice as a PDF document.
+func (d *Document) PDF() ([]byte, error) {
+	tmpl, err := template.New("invoice.txt.tmpl").Funcs(funcs).ParseFS(templateFS, "templates/invoice.txt.tmpl")
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, d); err != nil {
+		return nil, err
+	}
+
+	return typeset(strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")), nil
+}
+
+// funcs are the helpers available to both templates.
+var funcs = template.FuncMap{
+	"money": formatMoney,
+	"date": func(t time.Time) string {
+		return t.Format("2 January 2006")
+	},
+	"pad": func(width int, s string) string {
+		return fmt.Sprintf("%-*s", width, s)
+	},
+	"lpad": func(width int, s string) string {
+		return fmt.Sprintf("%*s", width, s)
+	},
+}
+
+// formatMoney formats an amount with thin groups of thousands and as many decimal places as its
+// currency has, e.g. 1 234 567.89.
+func formatMoney(m money.Money) string {
+	s := m.Decimal()
+
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+
+	whole, fraction, _ := strings.Cut(s, ".")
+	if fraction != "" {
+		fraction = "." + fraction
+	}
+
+	var b strings.Builder
+	for i, c := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteRune(c)
+	}
+
+	return sign + b.String() + fraction
+}
@@ -0,0 +1,119 @@
+package invoice
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/balgabekj/go_car/pkg/money"
+)
+
+func TestCalculateTotals(t *testing.T) {
+	tests := []struct {
+		name         string
+		currency     string
+		taxRate      money.Percent
+		lines        []Line
+		wantTotal    int64
+		wantSubtotal int64
+		wantTax      int64
+	}{
+		{
+			name:         "one line",
+			currency:     "KZT",
+			taxRate:      1200,
+			lines:        []Line{{Quantity: 1, UnitPrice: money.New(1120000, "KZT")}},
+			wantTotal:    1120000,
+			wantSubtotal: 1000000,
+			wantTax:      120000,
+		},
+		{
+			name:         "several lines",
+			currency:     "EUR",
+			taxRate:      2000,
+			lines:        []Line{{Quantity: 2, UnitPrice: money.New(1000, "EUR")}, {Quantity: 1, UnitPrice: money.New(399, "EUR")}},
+			wantTotal:    2399,
+			wantSubtotal: 1999,
+			wantTax:      400,
+		},
+		{
+			// 14 / 1.12 is exactly 12.5, which is rounded away from zero.
+			name:         "half a minor unit",
+			currency:     "EUR",
+			taxRate:      1200,
+			lines:        []Line{{Quantity: 1, UnitPrice: money.New(14, "EUR")}},
+			wantTotal:    14,
+			wantSubtotal: 13,
+			wantTax:      1,
+		},
+		{
+			// 1047 / 1.1168 is exactly 937.5, but in floating point it comes out just below and
+			// would be rounded down.
+			name:         "half a minor unit with an inexact rate",
+			currency:     "EUR",
+			taxRate:      1168,
+			lines:        []Line{{Quantity: 1, UnitPrice: money.New(1047, "EUR")}},
+			wantTotal:    1047,
+			wantSubtotal: 938,
+			wantTax:      109,
+		},
+		{
+			name:         "currency without minor units",
+			currency:     "JPY",
+			taxRate:      1000,
+			lines:        []Line{{Quantity: 1, UnitPrice: money.New(1500000, "JPY")}},
+			wantTotal:    1500000,
+			wantSubtotal: 1363636,
+			wantTax:      136364,
+		},
+		{
+			name:         "no tax",
+			currency:     "EUR",
+			lines:        []Line{{Quantity: 1, UnitPrice: money.New(1250050, "EUR")}},
+			wantTotal:    1250050,
+			wantSubtotal: 1250050,
+		},
+	}
+
+	for _, tt := range tests {
+		d := Document{Currency: tt.currency, TaxRate: tt.taxRate, Lines: tt.lines}
+		d.CalculateTotals()
+
+		if d.Total.Amount != tt.wantTotal || d.Subtotal.Amount != tt.wantSubtotal || d.Tax.Amount != tt.wantTax {
+			t.Errorf("%s: total %d, subtotal %d, tax %d; want %d, %d, %d", tt.name,
+				d.Total.Amount, d.Subtotal.Amount, d.Tax.Amount, tt.wantTotal, tt.wantSubtotal, tt.wantTax)
+		}
+
+		for _, m := range []money.Money{d.Total, d.Subtotal, d.Tax} {
+			if m.Currency.Code != tt.currency {
+				t.Errorf("%s: amount in %s, want %s", tt.name, m.Currency.Code, tt.currency)
+			}
+		}
+	}
+}
+
+// Invoices issued before tax rates were held exactly stored the rate as a plain number, which
+// still has to be read.
+func TestDocumentTaxRateJSON(t *testing.T) {
+	var d Document
+
+	err := json.Unmarshal([]byte(`{"tax_rate":12}`), &d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.TaxRate != 1200 {
+		t.Errorf("tax rate = %d basis points, want 1200", d.TaxRate)
+	}
+
+	js, err := json.Marshal(Document{TaxRate: 1250})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(js, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fields["tax_rate"]); got != "12.5" {
+		t.Errorf("tax_rate = %s, want 12.5", got)
+	}
+}
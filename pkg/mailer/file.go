@@ -0,0 +1,57 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileMailer is a development Mailer which, instead of delivering messages, writes them either
+// to an output stream (such as os.Stdout) or as individual .eml files in a directory.
+type FileMailer struct {
+	out    io.Writer
+	dir    string
+	sender string
+	mu     sync.Mutex
+}
+
+// NewFile returns a FileMailer. If dir is empty the rendered messages are written to out,
+// otherwise each message is saved to its own file inside dir.
+func NewFile(out io.Writer, dir, sender string) *FileMailer {
+	return &FileMailer{
+		out:    out,
+		dir:    dir,
+		sender: sender,
+	}
+}
+
+// Send renders the template file and writes the resulting message out.
+func (m *FileMailer) Send(recipient, templateFile string, data interface{}) error {
+	msg, err := Render(m.sender, recipient, templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	body, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.dir == "" {
+		_, err = m.out.Write(append(body, '\n'))
+		return err
+	}
+
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), recipient)
+	return os.WriteFile(filepath.Join(m.dir, name), body, 0o644)
+}
@@ -0,0 +1,55 @@
+package mailer
+
+import (
+	"fmt"
+	"net/mail"
+	"net/smtp"
+)
+
+// SMTPMailer delivers messages through an SMTP server using PLAIN authentication.
+type SMTPMailer struct {
+	host     string
+	port     int
+	username string
+	password string
+	sender   string
+}
+
+// NewSMTP returns a new SMTPMailer instance for the given server and credentials. The sender
+// is the name and address used in the From header, e.g. "Go Cars <no-reply@gocars.kz>".
+func NewSMTP(host string, port int, username, password, sender string) *SMTPMailer {
+	return &SMTPMailer{
+		host:     host,
+		port:     port,
+		username: username,
+		password: password,
+		sender:   sender,
+	}
+}
+
+// Send renders the template file and delivers the resulting message to the recipient.
+func (m *SMTPMailer) Send(recipient, templateFile string, data interface{}) error {
+	msg, err := Render(m.sender, recipient, templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	body, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	// The envelope sender must be a bare address; the name is only shown in the From header.
+	from, err := mail.ParseAddress(m.sender)
+	if err != nil {
+		return fmt.Errorf("smtp sender: %w", err)
+	}
+
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+
+	addr := fmt.Sprintf("%s:%d", m.host, m.port)
+	return smtp.SendMail(addr, auth, from.Address, []string{recipient}, body)
+}
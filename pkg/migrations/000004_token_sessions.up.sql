@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS tokens (
+                                      hash bytea PRIMARY KEY,
+                                      user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+                                      expiry timestamp(0) with time zone NOT NULL,
+                                      scope text NOT NULL
+);
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS id bigserial UNIQUE;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS created_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS last_used_at timestamp(0) with time zone;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS user_agent text NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS ip text NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS tokens_user_id_scope_idx ON tokens (user_id, scope);
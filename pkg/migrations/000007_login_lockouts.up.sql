@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS login_lockouts (
+                                              kind text NOT NULL,
+                                              subject text NOT NULL,
+                                              failures integer NOT NULL DEFAULT 0,
+                                              last_failure_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+                                              locked_until timestamp(0) with time zone,
+                                              PRIMARY KEY (kind, subject)
+);
+INSERT INTO permissions (code)
+VALUES
+    ('users:manage');
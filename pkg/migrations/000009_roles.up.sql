@@ -0,0 +1,35 @@
+CREATE TABLE IF NOT EXISTS roles (
+                                     id bigserial PRIMARY KEY,
+                                     name text UNIQUE NOT NULL,
+                                     description text NOT NULL DEFAULT '',
+                                     builtin bool NOT NULL DEFAULT false
+);
+CREATE TABLE IF NOT EXISTS roles_permissions (
+                                                 role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+                                                 permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+                                                 PRIMARY KEY (role_id, permission_id)
+);
+CREATE TABLE IF NOT EXISTS users_roles (
+                                           user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+                                           role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+                                           PRIMARY KEY (user_id, role_id)
+);
+INSERT INTO permissions (code)
+VALUES
+    ('cars:moderate'),
+    ('roles:manage');
+INSERT INTO roles (name, description, builtin)
+VALUES
+    ('buyer', 'Browses listings and contacts sellers', true),
+    ('seller', 'Private seller who lists their own cars', true),
+    ('dealer', 'Dealership managing a larger inventory', true),
+    ('moderator', 'Reviews and moderates listings', true),
+    ('admin', 'Full access, including user and role management', true);
+INSERT INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE (roles.name = 'buyer' AND permissions.code IN ('cars:read'))
+   OR (roles.name = 'seller' AND permissions.code IN ('cars:read', 'cars:write'))
+   OR (roles.name = 'dealer' AND permissions.code IN ('cars:read', 'cars:write'))
+   OR (roles.name = 'moderator' AND permissions.code IN ('cars:read', 'cars:write', 'cars:moderate'))
+   OR (roles.name = 'admin');
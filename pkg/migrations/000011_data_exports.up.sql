@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS data_exports (
+                                            id bigserial PRIMARY KEY,
+                                            user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+                                            status text NOT NULL DEFAULT 'pending',
+                                            download_hash bytea UNIQUE NOT NULL,
+                                            archive bytea,
+                                            created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+                                            completed_at timestamp(0) with time zone,
+                                            expiry timestamp(0) with time zone NOT NULL
+);
+-- Only one export per user can be in progress at a time.
+CREATE UNIQUE INDEX IF NOT EXISTS data_exports_pending_idx ON data_exports (user_id) WHERE status = 'pending';
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS tokens_expiry_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS activated_at;
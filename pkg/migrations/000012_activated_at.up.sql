@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS activated_at timestamp(0) with time zone;
+UPDATE users SET activated_at = created_at WHERE activated AND activated_at IS NULL;
+CREATE INDEX IF NOT EXISTS tokens_expiry_idx ON tokens (expiry);
@@ -0,0 +1,35 @@
+CREATE TABLE IF NOT EXISTS conversations (
+                                             id bigserial PRIMARY KEY,
+                                             car_id integer NOT NULL REFERENCES cars ON DELETE CASCADE,
+                                             buyer_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+                                             seller_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+                                             created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+                                             last_message_at timestamp(0) with time zone,
+                                             buyer_last_read_id bigint NOT NULL DEFAULT 0,
+                                             seller_last_read_id bigint NOT NULL DEFAULT 0,
+                                             UNIQUE (car_id, buyer_id)
+);
+CREATE INDEX IF NOT EXISTS conversations_buyer_id_idx ON conversations (buyer_id);
+CREATE INDEX IF NOT EXISTS conversations_seller_id_idx ON conversations (seller_id);
+CREATE TABLE IF NOT EXISTS messages (
+                                        id bigserial PRIMARY KEY,
+                                        conversation_id bigint NOT NULL REFERENCES conversations ON DELETE CASCADE,
+                                        sender_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+                                        body text NOT NULL,
+                                        created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS messages_conversation_id_idx ON messages (conversation_id, id);
+CREATE TABLE IF NOT EXISTS user_blocks (
+                                           blocker_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+                                           blocked_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+                                           created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+                                           PRIMARY KEY (blocker_id, blocked_id)
+);
+CREATE TABLE IF NOT EXISTS user_reports (
+                                            id bigserial PRIMARY KEY,
+                                            reporter_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+                                            reported_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+                                            conversation_id bigint REFERENCES conversations ON DELETE SET NULL,
+                                            reason text NOT NULL,
+                                            created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
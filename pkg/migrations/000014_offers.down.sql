@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS offer_events;
+DROP TABLE IF EXISTS offers;
+ALTER TABLE cars DROP COLUMN IF EXISTS status;
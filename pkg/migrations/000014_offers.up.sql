@@ -0,0 +1,27 @@
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'available';
+CREATE TABLE IF NOT EXISTS offers (
+                                      id bigserial PRIMARY KEY,
+                                      car_id integer NOT NULL REFERENCES cars ON DELETE CASCADE,
+                                      buyer_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+                                      seller_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+                                      amount numeric(12, 2) NOT NULL,
+                                      status text NOT NULL DEFAULT 'pending',
+                                      expiry timestamp(0) with time zone NOT NULL,
+                                      created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+                                      updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+                                      version integer NOT NULL DEFAULT 1
+);
+CREATE INDEX IF NOT EXISTS offers_buyer_id_idx ON offers (buyer_id);
+CREATE INDEX IF NOT EXISTS offers_seller_id_idx ON offers (seller_id);
+-- A car can only have one accepted offer, and a buyer only one open offer per car.
+CREATE UNIQUE INDEX IF NOT EXISTS offers_accepted_idx ON offers (car_id) WHERE status = 'accepted';
+CREATE UNIQUE INDEX IF NOT EXISTS offers_open_idx ON offers (car_id, buyer_id) WHERE status IN ('pending', 'countered');
+CREATE TABLE IF NOT EXISTS offer_events (
+                                            id bigserial PRIMARY KEY,
+                                            offer_id bigint NOT NULL REFERENCES offers ON DELETE CASCADE,
+                                            actor_id bigint REFERENCES users ON DELETE SET NULL,
+                                            action text NOT NULL,
+                                            amount numeric(12, 2) NOT NULL,
+                                            created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS offer_events_offer_id_idx ON offer_events (offer_id);
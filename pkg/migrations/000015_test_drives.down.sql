@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS test_drives;
+DROP TABLE IF EXISTS seller_blackouts;
+DROP TABLE IF EXISTS seller_availability;
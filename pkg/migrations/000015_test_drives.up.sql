@@ -0,0 +1,35 @@
+CREATE EXTENSION IF NOT EXISTS btree_gist;
+CREATE TABLE IF NOT EXISTS seller_availability (
+                                                   id bigserial PRIMARY KEY,
+                                                   seller_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+                                                   weekday smallint NOT NULL CHECK (weekday BETWEEN 0 AND 6),
+                                                   start_time time NOT NULL,
+                                                   end_time time NOT NULL,
+                                                   timezone text NOT NULL DEFAULT 'UTC',
+                                                   CHECK (start_time < end_time)
+);
+CREATE INDEX IF NOT EXISTS seller_availability_seller_id_idx ON seller_availability (seller_id);
+CREATE TABLE IF NOT EXISTS seller_blackouts (
+                                                seller_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+                                                date date NOT NULL,
+                                                reason text NOT NULL DEFAULT '',
+                                                PRIMARY KEY (seller_id, date)
+);
+CREATE TABLE IF NOT EXISTS test_drives (
+                                           id bigserial PRIMARY KEY,
+                                           car_id integer NOT NULL REFERENCES cars ON DELETE CASCADE,
+                                           buyer_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+                                           seller_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+                                           slot tstzrange NOT NULL,
+                                           status text NOT NULL DEFAULT 'requested',
+                                           proposed_by bigint NOT NULL,
+                                           created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+                                           updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+                                           version integer NOT NULL DEFAULT 1,
+    -- Neither a car nor its seller can be booked for two overlapping test drives. Cancelled
+    -- bookings free the slot again.
+                                           CONSTRAINT test_drives_car_slot_excl EXCLUDE USING gist (car_id WITH =, slot WITH &&) WHERE (status <> 'cancelled'),
+                                           CONSTRAINT test_drives_seller_slot_excl EXCLUDE USING gist (seller_id WITH =, slot WITH &&) WHERE (status <> 'cancelled')
+);
+CREATE INDEX IF NOT EXISTS test_drives_buyer_id_idx ON test_drives (buyer_id);
+CREATE INDEX IF NOT EXISTS test_drives_seller_id_idx ON test_drives (seller_id);
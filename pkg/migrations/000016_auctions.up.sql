@@ -0,0 +1,34 @@
+CREATE TABLE IF NOT EXISTS auctions (
+                                        id bigserial PRIMARY KEY,
+                                        car_id integer NOT NULL REFERENCES cars ON DELETE CASCADE,
+                                        seller_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+                                        starts_at timestamp(0) with time zone NOT NULL,
+                                        ends_at timestamp(0) with time zone NOT NULL,
+                                        starting_price numeric(12, 2) NOT NULL,
+                                        reserve_price numeric(12, 2),
+                                        min_increment numeric(12, 2) NOT NULL,
+                                        extension_seconds integer NOT NULL DEFAULT 120,
+                                        current_price numeric(12, 2) NOT NULL,
+                                        leader_id bigint REFERENCES users ON DELETE SET NULL,
+                                        leader_max numeric(12, 2),
+                                        bid_count integer NOT NULL DEFAULT 0,
+                                        status text NOT NULL DEFAULT 'open',
+                                        created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+                                        updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+                                        version integer NOT NULL DEFAULT 1,
+                                        CHECK (starts_at < ends_at)
+);
+-- A car can only be in one auction at a time.
+CREATE UNIQUE INDEX IF NOT EXISTS auctions_open_idx ON auctions (car_id) WHERE status = 'open';
+CREATE INDEX IF NOT EXISTS auctions_ends_at_idx ON auctions (ends_at) WHERE status = 'open';
+CREATE TABLE IF NOT EXISTS bids (
+                                    id bigserial PRIMARY KEY,
+                                    auction_id bigint NOT NULL REFERENCES auctions ON DELETE CASCADE,
+                                    bidder_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+                                    amount numeric(12, 2) NOT NULL,
+                                    max_amount numeric(12, 2) NOT NULL,
+                                    automatic boolean NOT NULL DEFAULT false,
+                                    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS bids_auction_id_idx ON bids (auction_id);
+CREATE INDEX IF NOT EXISTS bids_bidder_id_idx ON bids (bidder_id);
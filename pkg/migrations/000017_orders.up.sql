@@ -0,0 +1,45 @@
+-- Orders keep a snapshot of the car and the agreed price, and outlive the car and both users, so
+-- that the record of a sale isn't lost when a listing or account is deleted.
+CREATE TABLE IF NOT EXISTS orders (
+                                      id bigserial PRIMARY KEY,
+                                      car_id integer REFERENCES cars ON DELETE SET NULL,
+                                      buyer_id bigint REFERENCES users ON DELETE SET NULL,
+                                      seller_id bigint REFERENCES users ON DELETE SET NULL,
+                                      car text NOT NULL,
+                                      price numeric(12, 2) NOT NULL,
+                                      payment_type text NOT NULL,
+                                      deposit numeric(12, 2) NOT NULL,
+                                      amount_paid numeric(12, 2) NOT NULL DEFAULT 0,
+                                      status text NOT NULL DEFAULT 'pending',
+                                      reserved_car boolean NOT NULL DEFAULT false,
+                                      created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+                                      updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+                                      completed_at timestamp(0) with time zone,
+                                      version integer NOT NULL DEFAULT 1
+);
+CREATE INDEX IF NOT EXISTS orders_buyer_id_idx ON orders (buyer_id);
+CREATE INDEX IF NOT EXISTS orders_seller_id_idx ON orders (seller_id);
+-- A car can only be in one order that is still being paid.
+CREATE UNIQUE INDEX IF NOT EXISTS orders_active_idx ON orders (car_id) WHERE status IN ('pending', 'deposit_paid');
+CREATE TABLE IF NOT EXISTS payments (
+                                        id bigserial PRIMARY KEY,
+                                        order_id bigint NOT NULL REFERENCES orders ON DELETE CASCADE,
+                                        provider text NOT NULL,
+                                        provider_payment_id text,
+                                        amount numeric(12, 2) NOT NULL,
+                                        status text NOT NULL DEFAULT 'pending',
+                                        checkout_url text NOT NULL DEFAULT '',
+                                        created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+                                        updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+                                        UNIQUE (provider, provider_payment_id)
+);
+CREATE INDEX IF NOT EXISTS payments_order_id_idx ON payments (order_id);
+-- Webhook events already processed, so that a redelivered event is only applied once.
+CREATE TABLE IF NOT EXISTS payment_events (
+                                              provider text NOT NULL,
+                                              event_id text NOT NULL,
+                                              payment_id bigint REFERENCES payments ON DELETE CASCADE,
+                                              status text NOT NULL,
+                                              received_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+                                              PRIMARY KEY (provider, event_id)
+);
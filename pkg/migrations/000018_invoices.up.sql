@@ -0,0 +1,21 @@
+-- The last invoice number issued by each seller. The row is locked while an invoice is issued
+-- and the number is only used if the invoice is stored, so each seller's numbers have no gaps.
+CREATE TABLE IF NOT EXISTS invoice_sequences (
+                                                 seller_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+                                                 last_number integer NOT NULL
+);
+-- Invoices are issued once per completed order and never change. The document holds everything
+-- printed on the invoice, and html and pdf are the rendered copies handed out to the parties.
+CREATE TABLE IF NOT EXISTS invoices (
+                                        id bigserial PRIMARY KEY,
+                                        order_id bigint NOT NULL UNIQUE REFERENCES orders ON DELETE CASCADE,
+                                        seller_id bigint REFERENCES users ON DELETE SET NULL,
+                                        number integer NOT NULL,
+                                        invoice_number text NOT NULL,
+                                        issued_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+                                        total numeric(12, 2) NOT NULL,
+                                        document jsonb NOT NULL,
+                                        html text NOT NULL,
+                                        pdf bytea NOT NULL,
+                                        UNIQUE (seller_id, number)
+);
@@ -0,0 +1,6 @@
+DELETE FROM permissions WHERE code = 'rates:manage';
+DROP TABLE IF EXISTS exchange_rates;
+ALTER TABLE cars ALTER COLUMN price DROP NOT NULL;
+ALTER TABLE cars ALTER COLUMN price DROP DEFAULT;
+ALTER TABLE cars ALTER COLUMN price TYPE float USING price / 100.0;
+ALTER TABLE cars DROP COLUMN IF EXISTS currency;
@@ -0,0 +1,22 @@
+-- Car prices were floats without a currency. They are now a whole number of minor units (e.g.
+-- tiyn or cents) of an ISO 4217 currency. Existing prices are taken to be in tenge.
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS currency char(3) NOT NULL DEFAULT 'KZT';
+ALTER TABLE cars ALTER COLUMN price TYPE bigint USING round(COALESCE(price, 0)::numeric * 100);
+ALTER TABLE cars ALTER COLUMN price SET DEFAULT 0;
+ALTER TABLE cars ALTER COLUMN price SET NOT NULL;
+-- Exchange rates against a common base currency: rate is the price of one unit of the base in
+-- this currency, and the base itself has a rate of 1. Exponent is the number of decimal places of
+-- the currency's minor unit, so that prices can be converted in queries.
+CREATE TABLE IF NOT EXISTS exchange_rates (
+                                              currency char(3) PRIMARY KEY,
+                                              exponent smallint NOT NULL,
+                                              rate numeric NOT NULL CHECK (rate > 0),
+                                              updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+INSERT INTO permissions (code)
+VALUES
+    ('rates:manage');
+INSERT INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.code = 'rates:manage';
@@ -0,0 +1,12 @@
+-- The market price of each listed car, estimated from comparable cars by a periodic job, in the
+-- currency of the car's price. Amounts are in minor units, like cars.price. Listings are labelled
+-- as a great, good or fair deal, or a high price, by comparing their price with the estimate.
+CREATE TABLE IF NOT EXISTS car_price_estimates (
+                                                   car_id integer PRIMARY KEY REFERENCES cars ON DELETE CASCADE,
+                                                   currency char(3) NOT NULL,
+                                                   low bigint NOT NULL,
+                                                   value bigint NOT NULL,
+                                                   high bigint NOT NULL,
+                                                   confidence real NOT NULL,
+                                                   computed_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,3 @@
+-- Failed attempts at using a token, so that tokens which are exchanged together with a guessable
+-- code, like the mfa-pending token, can be revoked after too many wrong codes.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS failed_attempts integer NOT NULL DEFAULT 0;
@@ -0,0 +1,7 @@
+-- An order can only have one payment in progress at a time, so concurrent checkout requests can't
+-- charge the buyer twice. Any duplicates from before are given up on, keeping the newest.
+UPDATE payments SET status = 'failed', updated_at = NOW()
+WHERE status = 'pending' AND id NOT IN (
+    SELECT max(id) FROM payments WHERE status = 'pending' GROUP BY order_id
+);
+CREATE UNIQUE INDEX IF NOT EXISTS payments_pending_idx ON payments (order_id) WHERE status = 'pending';
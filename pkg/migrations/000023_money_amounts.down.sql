@@ -0,0 +1,61 @@
+UPDATE invoices SET document = document || jsonb_build_object(
+    'lines', (
+        SELECT COALESCE(jsonb_agg(line || jsonb_build_object(
+            'unit_price', line->'unit_price'->'amount',
+            'amount', line->'amount'->'amount'
+        ) ORDER BY n), '[]'::jsonb)
+        FROM jsonb_array_elements(document->'lines') WITH ORDINALITY AS lines(line, n)
+    ),
+    'payments', (
+        SELECT COALESCE(jsonb_agg(payment || jsonb_build_object(
+            'amount', payment->'amount'->'amount'
+        ) ORDER BY n), '[]'::jsonb)
+        FROM jsonb_array_elements(document->'payments') WITH ORDINALITY AS payments(payment, n)
+    ),
+    'subtotal', document->'subtotal'->'amount',
+    'tax', document->'tax'->'amount',
+    'total', document->'total'->'amount'
+);
+ALTER TABLE invoices ALTER COLUMN total TYPE numeric(12, 2)
+    USING total / CASE WHEN currency IN ('JPY', 'KRW') THEN 1.0 ELSE 100.0 END;
+ALTER TABLE invoices DROP COLUMN IF EXISTS currency;
+
+ALTER TABLE payments ALTER COLUMN amount TYPE numeric(12, 2)
+    USING amount / CASE WHEN currency IN ('JPY', 'KRW') THEN 1.0 ELSE 100.0 END;
+ALTER TABLE payments DROP COLUMN IF EXISTS currency;
+
+ALTER TABLE orders
+    ALTER COLUMN price TYPE numeric(12, 2)
+        USING price / CASE WHEN currency IN ('JPY', 'KRW') THEN 1.0 ELSE 100.0 END,
+    ALTER COLUMN deposit TYPE numeric(12, 2)
+        USING deposit / CASE WHEN currency IN ('JPY', 'KRW') THEN 1.0 ELSE 100.0 END,
+    ALTER COLUMN amount_paid TYPE numeric(12, 2)
+        USING amount_paid / CASE WHEN currency IN ('JPY', 'KRW') THEN 1.0 ELSE 100.0 END;
+ALTER TABLE orders DROP COLUMN IF EXISTS currency;
+
+ALTER TABLE bids
+    ALTER COLUMN amount TYPE numeric(12, 2)
+        USING amount / CASE WHEN currency IN ('JPY', 'KRW') THEN 1.0 ELSE 100.0 END,
+    ALTER COLUMN max_amount TYPE numeric(12, 2)
+        USING max_amount / CASE WHEN currency IN ('JPY', 'KRW') THEN 1.0 ELSE 100.0 END;
+ALTER TABLE bids DROP COLUMN IF EXISTS currency;
+
+ALTER TABLE auctions
+    ALTER COLUMN starting_price TYPE numeric(12, 2)
+        USING starting_price / CASE WHEN currency IN ('JPY', 'KRW') THEN 1.0 ELSE 100.0 END,
+    ALTER COLUMN reserve_price TYPE numeric(12, 2)
+        USING reserve_price / CASE WHEN currency IN ('JPY', 'KRW') THEN 1.0 ELSE 100.0 END,
+    ALTER COLUMN min_increment TYPE numeric(12, 2)
+        USING min_increment / CASE WHEN currency IN ('JPY', 'KRW') THEN 1.0 ELSE 100.0 END,
+    ALTER COLUMN current_price TYPE numeric(12, 2)
+        USING current_price / CASE WHEN currency IN ('JPY', 'KRW') THEN 1.0 ELSE 100.0 END,
+    ALTER COLUMN leader_max TYPE numeric(12, 2)
+        USING leader_max / CASE WHEN currency IN ('JPY', 'KRW') THEN 1.0 ELSE 100.0 END;
+ALTER TABLE auctions DROP COLUMN IF EXISTS currency;
+
+UPDATE offer_events SET amount = offer_events.amount * 100
+FROM offers WHERE offers.id = offer_events.offer_id AND offers.currency IN ('JPY', 'KRW');
+ALTER TABLE offer_events ALTER COLUMN amount TYPE numeric(12, 2) USING amount / 100.0;
+ALTER TABLE offers ALTER COLUMN amount TYPE numeric(12, 2)
+    USING amount / CASE WHEN currency IN ('JPY', 'KRW') THEN 1.0 ELSE 100.0 END;
+ALTER TABLE offers DROP COLUMN IF EXISTS currency;
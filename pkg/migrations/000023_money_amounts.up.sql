@@ -0,0 +1,82 @@
+-- Offers, bids, orders, payments and invoices held amounts as numeric(12, 2) without a currency.
+-- Like car prices, they are now a whole number of minor units of an ISO 4217 currency. Offers and
+-- auctions were made in the currency of the car, and orders were paid in the payment currency,
+-- which is taken from the order's invoice if it has one and taken to be tenge otherwise. The yen
+-- and the won are the only supported currencies without a minor unit (see pkg/money).
+ALTER TABLE offers ADD COLUMN IF NOT EXISTS currency char(3);
+UPDATE offers SET currency = cars.currency FROM cars WHERE cars.id = offers.car_id;
+ALTER TABLE offers ALTER COLUMN currency SET NOT NULL;
+ALTER TABLE offers ALTER COLUMN amount TYPE bigint
+    USING round(amount * CASE WHEN currency IN ('JPY', 'KRW') THEN 1 ELSE 100 END);
+-- Offer events are in the currency of their offer.
+ALTER TABLE offer_events ALTER COLUMN amount TYPE bigint USING round(amount * 100);
+UPDATE offer_events SET amount = offer_events.amount / 100
+FROM offers WHERE offers.id = offer_events.offer_id AND offers.currency IN ('JPY', 'KRW');
+
+ALTER TABLE auctions ADD COLUMN IF NOT EXISTS currency char(3);
+UPDATE auctions SET currency = cars.currency FROM cars WHERE cars.id = auctions.car_id;
+ALTER TABLE auctions ALTER COLUMN currency SET NOT NULL;
+ALTER TABLE auctions
+    ALTER COLUMN starting_price TYPE bigint
+        USING round(starting_price * CASE WHEN currency IN ('JPY', 'KRW') THEN 1 ELSE 100 END),
+    ALTER COLUMN reserve_price TYPE bigint
+        USING round(reserve_price * CASE WHEN currency IN ('JPY', 'KRW') THEN 1 ELSE 100 END),
+    ALTER COLUMN min_increment TYPE bigint
+        USING round(min_increment * CASE WHEN currency IN ('JPY', 'KRW') THEN 1 ELSE 100 END),
+    ALTER COLUMN current_price TYPE bigint
+        USING round(current_price * CASE WHEN currency IN ('JPY', 'KRW') THEN 1 ELSE 100 END),
+    ALTER COLUMN leader_max TYPE bigint
+        USING round(leader_max * CASE WHEN currency IN ('JPY', 'KRW') THEN 1 ELSE 100 END);
+
+ALTER TABLE bids ADD COLUMN IF NOT EXISTS currency char(3);
+UPDATE bids SET currency = auctions.currency FROM auctions WHERE auctions.id = bids.auction_id;
+ALTER TABLE bids ALTER COLUMN currency SET NOT NULL;
+ALTER TABLE bids
+    ALTER COLUMN amount TYPE bigint
+        USING round(amount * CASE WHEN currency IN ('JPY', 'KRW') THEN 1 ELSE 100 END),
+    ALTER COLUMN max_amount TYPE bigint
+        USING round(max_amount * CASE WHEN currency IN ('JPY', 'KRW') THEN 1 ELSE 100 END);
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS currency char(3) NOT NULL DEFAULT 'KZT';
+ALTER TABLE orders ALTER COLUMN currency DROP DEFAULT;
+UPDATE orders SET currency = invoices.document->>'currency'
+FROM invoices WHERE invoices.order_id = orders.id;
+ALTER TABLE orders
+    ALTER COLUMN price TYPE bigint
+        USING round(price * CASE WHEN currency IN ('JPY', 'KRW') THEN 1 ELSE 100 END),
+    ALTER COLUMN deposit TYPE bigint
+        USING round(deposit * CASE WHEN currency IN ('JPY', 'KRW') THEN 1 ELSE 100 END),
+    ALTER COLUMN amount_paid TYPE bigint
+        USING round(amount_paid * CASE WHEN currency IN ('JPY', 'KRW') THEN 1 ELSE 100 END);
+
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS currency char(3);
+UPDATE payments SET currency = orders.currency FROM orders WHERE orders.id = payments.order_id;
+ALTER TABLE payments ALTER COLUMN currency SET NOT NULL;
+ALTER TABLE payments ALTER COLUMN amount TYPE bigint
+    USING round(amount * CASE WHEN currency IN ('JPY', 'KRW') THEN 1 ELSE 100 END);
+
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS currency char(3);
+UPDATE invoices SET currency = document->>'currency';
+ALTER TABLE invoices ALTER COLUMN currency SET NOT NULL;
+ALTER TABLE invoices ALTER COLUMN total TYPE bigint
+    USING round(total * CASE WHEN currency IN ('JPY', 'KRW') THEN 1 ELSE 100 END);
+-- The amounts in invoice documents become objects holding the amount and its currency, as the
+-- API writes them.
+UPDATE invoices SET document = document || jsonb_build_object(
+    'lines', (
+        SELECT COALESCE(jsonb_agg(line || jsonb_build_object(
+            'unit_price', jsonb_build_object('amount', line->'unit_price', 'currency', currency),
+            'amount', jsonb_build_object('amount', line->'amount', 'currency', currency)
+        ) ORDER BY n), '[]'::jsonb)
+        FROM jsonb_array_elements(document->'lines') WITH ORDINALITY AS lines(line, n)
+    ),
+    'payments', (
+        SELECT COALESCE(jsonb_agg(payment || jsonb_build_object(
+            'amount', jsonb_build_object('amount', payment->'amount', 'currency', currency)
+        ) ORDER BY n), '[]'::jsonb)
+        FROM jsonb_array_elements(document->'payments') WITH ORDINALITY AS payments(payment, n)
+    ),
+    'subtotal', jsonb_build_object('amount', document->'subtotal', 'currency', currency),
+    'tax', jsonb_build_object('amount', document->'tax', 'currency', currency),
+    'total', jsonb_build_object('amount', document->'total', 'currency', currency)
+);
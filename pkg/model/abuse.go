@@ -0,0 +1,214 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/balgabekj/go_car/pkg/validator"
+)
+
+// BlockModel works with the user_blocks table. A block works in both directions: neither user can
+// message the other while it is in place.
+type BlockModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Block stops blockedID from exchanging messages with blockerID. Blocking a user twice is not an
+// error.
+func (m BlockModel) Block(blockerID, blockedID int64) error {
+	query := `
+		INSERT INTO user_blocks (blocker_id, blocked_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, blockerID, blockedID)
+	return err
+}
+
+// Unblock removes a block. If there is no such block an ErrRecordNotFound error is returned.
+func (m BlockModel) Unblock(blockerID, blockedID int64) error {
+	query := `
+		DELETE FROM user_blocks
+		WHERE blocker_id = $1 AND blocked_id = $2
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, blockerID, blockedID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// IsBlocked reports whether either user has blocked the other.
+func (m BlockModel) IsBlocked(a, b int64) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM user_blocks
+			WHERE (blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1)
+		)
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var blocked bool
+	err := m.DB.QueryRowContext(ctx, query, a, b).Scan(&blocked)
+	return blocked, err
+}
+
+// GetAllForUser returns the users blocked by the given user.
+func (m BlockModel) GetAllForUser(userID int64) ([]*Participant, error) {
+	query := `
+		SELECT users.id, users.name, users.email
+		FROM user_blocks
+		INNER JOIN users ON users.id = user_blocks.blocked_id
+		WHERE user_blocks.blocker_id = $1
+		ORDER BY user_blocks.created_at DESC
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	blocked := []*Participant{}
+
+	for rows.Next() {
+		var p Participant
+
+		if err := rows.Scan(&p.ID, &p.Name, &p.Email); err != nil {
+			return nil, err
+		}
+
+		p.Email = MaskEmail(p.Email)
+		blocked = append(blocked, &p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return blocked, nil
+}
+
+// Report is a complaint about another user's behaviour, optionally pointing at the conversation
+// it happened in, for moderators to review.
+type Report struct {
+	ID             int64     `json:"id"`
+	ReporterID     int64     `json:"reporter_id"`
+	ReportedID     int64     `json:"reported_id"`
+	ConversationID *int64    `json:"conversation_id"`
+	Reason         string    `json:"reason"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type ReportModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+func (m ReportModel) Insert(report *Report) error {
+	query := `
+		INSERT INTO user_reports (reporter_id, reported_id, conversation_id, reason)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{report.ReporterID, report.ReportedID, report.ConversationID, report.Reason}
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&report.ID, &report.CreatedAt)
+}
+
+// GetAll returns a page of reports, newest first. If reportedID is not 0, only reports about that
+// user are returned.
+func (m ReportModel) GetAll(reportedID int64, filters Filters) ([]*Report, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), id, reporter_id, reported_id, conversation_id, reason, created_at
+		FROM user_reports
+		WHERE (reported_id = $1 OR $1 = 0)
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, reportedID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	totalRecords := 0
+	reports := []*Report{}
+
+	for rows.Next() {
+		var report Report
+
+		err := rows.Scan(
+			&totalRecords,
+			&report.ID,
+			&report.ReporterID,
+			&report.ReportedID,
+			&report.ConversationID,
+			&report.Reason,
+			&report.CreatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		reports = append(reports, &report)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return reports, metadata, nil
+}
+
+func ValidateReport(v *validator.Validator, report *Report) {
+	v.Check(report.Reason != "", "reason", "must be provided")
+	v.Check(len(report.Reason) <= 2000, "reason", "must not be more than 2000 bytes long")
+	v.Check(report.ReportedID != report.ReporterID, "user", "you can't report yourself")
+}
@@ -0,0 +1,327 @@
+package model
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/balgabekj/go_car/pkg/validator"
+	"github.com/lib/pq"
+)
+
+// apiKeyPrefixLength is the length of the public, non-secret part of an API key which is used to
+// look it up.
+const apiKeyPrefixLength = 8
+
+// APIKey represents a long-lived credential that lets a dealer's integration act on behalf of a
+// user, limited to a subset of that user's permissions. Like tokens, only a SHA-256 hash of the
+// key is stored; the plaintext is returned once, when the key is created.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Prefix      string      `json:"prefix"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	AllowedIPs  []string    `json:"allowed_ips"`
+	Expiry      *time.Time  `json:"expiry"`
+	CreatedAt   time.Time   `json:"created_at"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+}
+
+// AllowsIP reports whether the key may be used from the given client IP. Keys without an
+// allow-list can be used from anywhere. Entries are either single addresses or CIDR ranges.
+func (k *APIKey) AllowsIP(ip string) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, allowed := range k.AllowedIPs {
+		if _, network, err := net.ParseCIDR(allowed); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+			continue
+		}
+
+		if allowedAddr := net.ParseIP(allowed); allowedAddr != nil && allowedAddr.Equal(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// APIKeyModel struct wraps a sql.DB connection pool and allows us to work with the api_keys table.
+type APIKeyModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// New generates a new API key for the user and inserts it into the api_keys table. The returned
+// key has its Plaintext field set.
+func (m APIKeyModel) New(userID int64, name string, permissions Permissions, allowedIPs []string, expiry *time.Time) (*APIKey, error) {
+	prefix, err := randomBase32(5)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := randomBase32(16)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &APIKey{
+		UserID:      userID,
+		Name:        name,
+		Prefix:      prefix[:apiKeyPrefixLength],
+		Permissions: permissions,
+		AllowedIPs:  allowedIPs,
+		Expiry:      expiry,
+	}
+	key.Plaintext = key.Prefix + "." + secret
+
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	if key.Permissions == nil {
+		key.Permissions = Permissions{}
+	}
+	if key.AllowedIPs == nil {
+		key.AllowedIPs = []string{}
+	}
+
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, hash, permissions, allowed_ips, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at
+		`
+
+	args := []interface{}{userID, name, key.Prefix, key.Hash, pq.Array(key.Permissions), pq.Array(key.AllowedIPs), expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// GetAllForUser returns all API keys belonging to a user, newest first.
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+		SELECT id, user_id, name, prefix, permissions, allowed_ips, expiry, created_at, last_used_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id DESC
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+
+		err := rows.Scan(
+			&key.ID,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			pq.Array(&key.Permissions),
+			pq.Array(&key.AllowedIPs),
+			&key.Expiry,
+			&key.CreatedAt,
+			&key.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// GetForKey looks up an unexpired API key by its plaintext and returns it together with the user
+// it belongs to. If no matching key exists an ErrRecordNotFound error is returned.
+func (m APIKeyModel) GetForKey(plaintext string) (*APIKey, *User, error) {
+	prefix, _, _ := strings.Cut(plaintext, ".")
+
+	query := `
+		SELECT
+			api_keys.id, api_keys.name, api_keys.prefix, api_keys.hash, api_keys.permissions,
+			api_keys.allowed_ips, api_keys.expiry, api_keys.created_at, api_keys.last_used_at,
+			users.id, users.created_at, users.name, users.email,
+			users.password_hash, users.activated, users.version
+		FROM api_keys
+		INNER JOIN users ON users.id = api_keys.user_id
+		WHERE api_keys.prefix = $1
+			AND (api_keys.expiry IS NULL OR api_keys.expiry > $2)
+		`
+
+	var (
+		key  APIKey
+		user User
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, prefix, time.Now()).Scan(
+		&key.ID,
+		&key.Name,
+		&key.Prefix,
+		&key.Hash,
+		pq.Array(&key.Permissions),
+		pq.Array(&key.AllowedIPs),
+		&key.Expiry,
+		&key.CreatedAt,
+		&key.LastUsedAt,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	// The prefix only narrows the search down; the secret part has to match too. Compare the
+	// hashes in constant time so the response time doesn't leak how much of it was right.
+	hash := sha256.Sum256([]byte(plaintext))
+	if subtle.ConstantTimeCompare(hash[:], key.Hash) != 1 {
+		return nil, nil, ErrRecordNotFound
+	}
+
+	key.UserID = user.ID
+
+	return &key, &user, nil
+}
+
+// Touch records that the key has just been used. The timestamp is refreshed at most once a minute.
+func (m APIKeyModel) Touch(id int64) error {
+	query := `
+		UPDATE api_keys
+		SET last_used_at = NOW()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// Delete revokes one of the user's API keys. If no matching key exists an ErrRecordNotFound
+// error is returned.
+func (m APIKeyModel) Delete(id, userID int64) error {
+	query := `
+		DELETE FROM api_keys
+		WHERE id = $1 AND user_id = $2
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// randomBase32 returns n random bytes encoded as an unpadded base-32 string.
+func randomBase32(n int) (string, error) {
+	randomBytes := make([]byte, n)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
+// ValidateAPIKeyPlaintext checks that an API key has the "PREFIX.SECRET" shape we hand out.
+func ValidateAPIKeyPlaintext(v *validator.Validator, plaintext string) {
+	prefix, secret, ok := strings.Cut(plaintext, ".")
+
+	v.Check(plaintext != "", "key", "must be provided")
+	v.Check(ok && len(prefix) == apiKeyPrefixLength && len(secret) == 26, "key", "must be a valid API key")
+}
+
+// ValidateAPIKey checks the name, permissions and IP allow-list of a new API key. The granted
+// permissions must be a subset of the permissions the owning user currently has.
+func ValidateAPIKey(v *validator.Validator, key *APIKey, userPermissions Permissions) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(key.Permissions) > 0, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range key.Permissions {
+		v.Check(userPermissions.Include(code), "permissions", "must only contain permissions you have")
+	}
+
+	for _, ip := range key.AllowedIPs {
+		_, _, cidrErr := net.ParseCIDR(ip)
+		v.Check(cidrErr == nil || net.ParseIP(ip) != nil, "allowed_ips", "must contain valid IP addresses or CIDR ranges")
+	}
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
@@ -0,0 +1,771 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/balgabekj/go_car/pkg/money"
+	"github.com/balgabekj/go_car/pkg/validator"
+)
+
+// Auction statuses. Only open, sold, unsold and cancelled are stored; an open auction is reported
+// as scheduled, live or ended depending on the time, so that it changes state exactly on time
+// even before the closing job has settled it.
+const (
+	AuctionStatusScheduled = "scheduled"
+	AuctionStatusLive      = "live"
+	AuctionStatusEnded     = "ended"
+	AuctionStatusSold      = "sold"
+	AuctionStatusUnsold    = "unsold"
+	AuctionStatusCancelled = "cancelled"
+)
+
+var (
+	// ErrAuctionExists is returned when a car is put up for auction while it is already in one.
+	ErrAuctionExists = errors.New("auction exists")
+
+	// ErrAuctionNotLive is returned for bids on an auction which hasn't started or has ended.
+	ErrAuctionNotLive = errors.New("auction not live")
+
+	// ErrBidTooLow is returned for bids below the minimum bid, and for a leader's bid which
+	// doesn't raise their maximum.
+	ErrBidTooLow = errors.New("bid too low")
+)
+
+// Auction sells a car to the highest bidder. Bidders give the maximum they are willing to pay and
+// the system bids on their behalf, one increment at a time, so the current price is always just
+// enough to beat the runner-up. A bid in the last ExtensionSeconds pushes the end back, so that
+// nobody can win by bidding at the last moment.
+//
+// All amounts are in the currency the car was listed in when the auction was created. The reserve
+// price and the bidders' maximums are never shown; ReserveMet tells bidders whether the current
+// price is high enough for the car to be sold.
+type Auction struct {
+	ID               int64        `json:"id"`
+	CarID            int          `json:"car_id"`
+	Car              string       `json:"car"`
+	SellerID         int64        `json:"seller_id"`
+	StartsAt         time.Time    `json:"starts_at"`
+	EndsAt           time.Time    `json:"ends_at"`
+	StartingPrice    money.Money  `json:"starting_price"`
+	ReservePrice     *money.Money `json:"-"`
+	HasReserve       bool         `json:"has_reserve"`
+	ReserveMet       bool         `json:"reserve_met"`
+	MinIncrement     money.Money  `json:"min_increment"`
+	ExtensionSeconds int          `json:"extension_seconds"`
+	CurrentPrice     money.Money  `json:"current_price"`
+	MinimumBid       money.Money  `json:"minimum_bid"`
+	BidCount         int          `json:"bid_count"`
+	LeaderID         *int64       `json:"-"`
+	LeaderMax        *money.Money `json:"-"`
+	Status           string       `json:"status"`
+	CreatedAt        time.Time    `json:"created_at"`
+	UpdatedAt        time.Time    `json:"updated_at"`
+	Version          int          `json:"version"`
+}
+
+// IsLeading reports whether the user is currently the highest bidder, or has won the auction.
+func (a *Auction) IsLeading(userID int64) bool {
+	return a.LeaderID != nil && *a.LeaderID == userID
+}
+
+// setDerived fills in the fields computed from the others.
+func (a *Auction) setDerived() {
+	a.HasReserve = a.ReservePrice != nil
+	a.ReserveMet = a.LeaderID != nil && (a.ReservePrice == nil || a.CurrentPrice.Amount >= a.ReservePrice.Amount)
+
+	a.MinimumBid = a.StartingPrice
+	if a.LeaderID != nil {
+		a.MinimumBid = money.Money{Amount: a.CurrentPrice.Amount + a.MinIncrement.Amount, Currency: a.CurrentPrice.Currency}
+	}
+}
+
+// Bid is a step in an auction's price. Bidders are identified by an alias, such as "Bidder 2",
+// which is stable within an auction. Automatic bids were placed by the system on behalf of a
+// bidder's maximum.
+type Bid struct {
+	ID        int64       `json:"id"`
+	AuctionID int64       `json:"auction_id"`
+	BidderID  int64       `json:"-"`
+	Bidder    string      `json:"bidder"`
+	Amount    money.Money `json:"amount"`
+	MaxAmount money.Money `json:"-"`
+	Automatic bool        `json:"automatic"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// UserBid is a bid as seen by the bidder, including the maximum they were willing to pay.
+type UserBid struct {
+	ID        int64       `json:"id"`
+	AuctionID int64       `json:"auction_id"`
+	Amount    money.Money `json:"amount"`
+	MaxAmount money.Money `json:"max_amount"`
+	Automatic bool        `json:"automatic"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// AuctionFilter holds the optional criteria for listing auctions. An empty Status lists live
+// auctions.
+type AuctionFilter struct {
+	Status string
+	CarID  int
+}
+
+type AuctionModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// auctionColumns selects an auction as scanned by scanAuction.
+const auctionColumns = `
+		a.id, a.car_id, c.brand || ' ' || c.model, a.seller_id, a.starts_at, a.ends_at,
+		a.starting_price, a.reserve_price, a.min_increment, a.extension_seconds, a.current_price,
+		a.bid_count, a.leader_id, a.leader_max, a.currency,
+		CASE WHEN a.status <> 'open' THEN a.status
+			WHEN NOW() < a.starts_at THEN 'scheduled'
+			WHEN NOW() < a.ends_at THEN 'live'
+			ELSE 'ended' END AS computed_status,
+		a.created_at, a.updated_at, a.version
+		FROM auctions a
+		INNER JOIN cars c ON c.id = a.car_id`
+
+func scanAuction(row scanner, dest ...interface{}) (*Auction, error) {
+	var (
+		a                                         Auction
+		startingPrice, minIncrement, currentPrice int64
+		reservePrice, leaderMax                   sql.NullInt64
+		currency                                  string
+	)
+
+	err := row.Scan(append(dest,
+		&a.ID,
+		&a.CarID,
+		&a.Car,
+		&a.SellerID,
+		&a.StartsAt,
+		&a.EndsAt,
+		&startingPrice,
+		&reservePrice,
+		&minIncrement,
+		&a.ExtensionSeconds,
+		&currentPrice,
+		&a.BidCount,
+		&a.LeaderID,
+		&leaderMax,
+		&currency,
+		&a.Status,
+		&a.CreatedAt,
+		&a.UpdatedAt,
+		&a.Version,
+	)...)
+	if err != nil {
+		return nil, err
+	}
+
+	a.StartingPrice = money.New(startingPrice, currency)
+	a.MinIncrement = money.New(minIncrement, currency)
+	a.CurrentPrice = money.New(currentPrice, currency)
+	if reservePrice.Valid {
+		reserve := money.New(reservePrice.Int64, currency)
+		a.ReservePrice = &reserve
+	}
+	if leaderMax.Valid {
+		leader := money.New(leaderMax.Int64, currency)
+		a.LeaderMax = &leader
+	}
+
+	a.setDerived()
+
+	return &a, nil
+}
+
+// Insert puts a car up for auction. The prices must all be in the same currency. If the car is
+// already in an open auction an ErrAuctionExists error is returned.
+func (m AuctionModel) Insert(a *Auction) error {
+	query := `
+		INSERT INTO auctions (car_id, seller_id, starts_at, ends_at, starting_price, reserve_price,
+			min_increment, extension_seconds, current_price, currency)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $5, $9)
+		RETURNING id, created_at, updated_at, version
+		`
+
+	var reservePrice *int64
+	if a.ReservePrice != nil {
+		reservePrice = &a.ReservePrice.Amount
+	}
+
+	args := []interface{}{a.CarID, a.SellerID, a.StartsAt, a.EndsAt, a.StartingPrice.Amount, reservePrice, a.MinIncrement.Amount, a.ExtensionSeconds, a.StartingPrice.Currency.Code}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	a.CurrentPrice = a.StartingPrice
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&a.ID, &a.CreatedAt, &a.UpdatedAt, &a.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "auctions_open_idx"`:
+			return ErrAuctionExists
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get returns an auction. If no matching auction is found an ErrRecordNotFound error is
+// returned.
+func (m AuctionModel) Get(id int64) (*Auction, error) {
+	query := `SELECT ` + auctionColumns + `
+		WHERE a.id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	a, err := scanAuction(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// GetSoldForCar returns the most recent auction in which the car was sold, if any. If there is
+// none an ErrRecordNotFound error is returned.
+func (m AuctionModel) GetSoldForCar(carID int) (*Auction, error) {
+	query := `SELECT ` + auctionColumns + `
+		WHERE a.car_id = $1 AND a.status = 'sold'
+		ORDER BY a.ends_at DESC
+		LIMIT 1
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	a, err := scanAuction(m.DB.QueryRowContext(ctx, query, carID))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// HasOpen reports whether the car is in an auction which hasn't been settled yet.
+func (m AuctionModel) HasOpen(carID int) (bool, error) {
+	query := `
+		SELECT EXISTS (SELECT 1 FROM auctions WHERE car_id = $1 AND status = 'open')
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var open bool
+	err := m.DB.QueryRowContext(ctx, query, carID).Scan(&open)
+	return open, err
+}
+
+// GetAll returns a page of auctions in the given status, by default those ending soonest first.
+func (m AuctionModel) GetAll(filter AuctionFilter, filters Filters) ([]*Auction, Metadata, error) {
+	query := fmt.Sprintf(`SELECT count(*) OVER(), `+auctionColumns+`
+		WHERE (a.car_id = $1 OR $1 = 0)
+		AND CASE WHEN a.status <> 'open' THEN a.status
+			WHEN NOW() < a.starts_at THEN 'scheduled'
+			WHEN NOW() < a.ends_at THEN 'live'
+			ELSE 'ended' END = $2
+		ORDER BY %s %s, a.id ASC
+		LIMIT $3 OFFSET $4
+		`, filters.sortColumn(), filters.sortDirection())
+
+	status := filter.Status
+	if status == "" {
+		status = AuctionStatusLive
+	}
+
+	args := []interface{}{filter.CarID, status, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	totalRecords := 0
+	auctions := []*Auction{}
+
+	for rows.Next() {
+		a, err := scanAuction(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		auctions = append(auctions, a)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return auctions, metadata, nil
+}
+
+// PlaceBid bids up to maxAmount on behalf of the bidder, and returns the auction as it stands
+// afterwards. The auction row is locked for the duration, so concurrent bids are applied one
+// after the other against the latest price.
+//
+// A new leader pays one increment more than the previous leader's maximum (or their own maximum,
+// if that is lower). A bid which doesn't beat the leader's maximum raises the price to one
+// increment above it, and the leader keeps the lead; on a tie the earlier bid wins. Once the
+// leader's maximum reaches the reserve, the price jumps to the reserve.
+//
+// maxAmount must be in the auction's currency.
+func (m AuctionModel) PlaceBid(id, bidderID int64, maxAmount money.Money) (*Auction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT ` + auctionColumns + `
+		WHERE a.id = $1
+		FOR UPDATE OF a
+		`
+
+	a, err := scanAuction(tx.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if a.Status != AuctionStatusLive {
+		return nil, ErrAuctionNotLive
+	}
+
+	// Work in minor units of the auction's currency, which keeps repeated increments exact.
+	currency := a.CurrentPrice.Currency
+	amount := func(minorUnits int64) money.Money {
+		return money.Money{Amount: minorUnits, Currency: currency}
+	}
+
+	bid := maxAmount.Amount
+	price := a.CurrentPrice.Amount
+	increment := a.MinIncrement.Amount
+
+	var bids []*Bid
+
+	switch {
+	case a.LeaderID == nil:
+		if bid < a.StartingPrice.Amount {
+			return nil, ErrBidTooLow
+		}
+
+		price = a.StartingPrice.Amount
+		bids = append(bids, &Bid{BidderID: bidderID, Amount: amount(price), MaxAmount: maxAmount})
+		a.LeaderID = &bidderID
+		a.LeaderMax = &maxAmount
+
+	case *a.LeaderID == bidderID:
+		if bid <= a.LeaderMax.Amount {
+			return nil, ErrBidTooLow
+		}
+
+		bids = append(bids, &Bid{BidderID: bidderID, Amount: amount(price), MaxAmount: maxAmount})
+		a.LeaderMax = &maxAmount
+
+	default:
+		if bid < price+increment {
+			return nil, ErrBidTooLow
+		}
+
+		leaderMax := a.LeaderMax.Amount
+
+		if bid > leaderMax {
+			// The previous leader's proxy bids up to their maximum before being outbid.
+			if leaderMax > price {
+				bids = append(bids, &Bid{BidderID: *a.LeaderID, Amount: *a.LeaderMax, MaxAmount: *a.LeaderMax, Automatic: true})
+			}
+
+			price = min(bid, leaderMax+increment)
+			bids = append(bids, &Bid{BidderID: bidderID, Amount: amount(price), MaxAmount: maxAmount})
+			a.LeaderID = &bidderID
+			a.LeaderMax = &maxAmount
+		} else {
+			price = min(leaderMax, bid+increment)
+			bids = append(bids,
+				&Bid{BidderID: bidderID, Amount: maxAmount, MaxAmount: maxAmount},
+				&Bid{BidderID: *a.LeaderID, Amount: amount(price), MaxAmount: *a.LeaderMax, Automatic: true},
+			)
+		}
+	}
+
+	// The last bid is always the leader's, so the reserve jump is applied to it.
+	if a.ReservePrice != nil {
+		reserve := a.ReservePrice.Amount
+		if price < reserve && a.LeaderMax.Amount >= reserve {
+			price = reserve
+			bids[len(bids)-1].Amount = *a.ReservePrice
+		}
+	}
+
+	a.CurrentPrice = amount(price)
+	a.BidCount += len(bids)
+
+	extension := time.Duration(a.ExtensionSeconds) * time.Second
+	if extended := time.Now().Add(extension).Truncate(time.Second); extended.After(a.EndsAt) {
+		a.EndsAt = extended
+	}
+
+	query = `
+		UPDATE auctions
+		SET current_price = $1, leader_id = $2, leader_max = $3, bid_count = $4, ends_at = $5,
+			updated_at = NOW(), version = version + 1
+		WHERE id = $6
+		RETURNING updated_at, version
+		`
+
+	args := []interface{}{a.CurrentPrice.Amount, a.LeaderID, a.LeaderMax.Amount, a.BidCount, a.EndsAt, a.ID}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&a.UpdatedAt, &a.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+		INSERT INTO bids (auction_id, bidder_id, amount, max_amount, currency, automatic)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		`
+
+	for _, b := range bids {
+		_, err = tx.ExecContext(ctx, query, a.ID, b.BidderID, b.Amount.Amount, b.MaxAmount.Amount, currency.Code, b.Automatic)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	a.setDerived()
+
+	return a, nil
+}
+
+// GetBids returns the bid history of an auction, oldest first. Bidders are numbered in the order
+// they first bid.
+func (m AuctionModel) GetBids(auctionID int64) ([]*Bid, error) {
+	query := `
+		SELECT id, auction_id, bidder_id, amount, max_amount, currency, automatic, created_at
+		FROM bids
+		WHERE auction_id = $1
+		ORDER BY id
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, auctionID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	bids := []*Bid{}
+	aliases := make(map[int64]string)
+
+	for rows.Next() {
+		var (
+			b                 Bid
+			amount, maxAmount int64
+			currency          string
+		)
+
+		err := rows.Scan(&b.ID, &b.AuctionID, &b.BidderID, &amount, &maxAmount, &currency, &b.Automatic, &b.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		b.Amount = money.New(amount, currency)
+		b.MaxAmount = money.New(maxAmount, currency)
+
+		if _, ok := aliases[b.BidderID]; !ok {
+			aliases[b.BidderID] = fmt.Sprintf("Bidder %d", len(aliases)+1)
+		}
+		b.Bidder = aliases[b.BidderID]
+
+		bids = append(bids, &b)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return bids, nil
+}
+
+// GetBidsForUser returns every bid placed by or on behalf of a user, including their maximums.
+// It is used for personal data exports.
+func (m AuctionModel) GetBidsForUser(userID int64) ([]*UserBid, error) {
+	query := `
+		SELECT id, auction_id, amount, max_amount, currency, automatic, created_at
+		FROM bids
+		WHERE bidder_id = $1
+		ORDER BY id
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	bids := []*UserBid{}
+
+	for rows.Next() {
+		var (
+			b                 UserBid
+			amount, maxAmount int64
+			currency          string
+		)
+
+		err := rows.Scan(&b.ID, &b.AuctionID, &amount, &maxAmount, &currency, &b.Automatic, &b.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		b.Amount = money.New(amount, currency)
+		b.MaxAmount = money.New(maxAmount, currency)
+
+		bids = append(bids, &b)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return bids, nil
+}
+
+// Cancel withdraws an auction which nobody has bid on yet. It returns an ErrEditConflict error if
+// the auction has changed since it was read, e.g. because a bid came in.
+func (m AuctionModel) Cancel(a *Auction) error {
+	query := `
+		UPDATE auctions
+		SET status = 'cancelled', updated_at = NOW(), version = version + 1
+		WHERE id = $1 AND version = $2 AND status = 'open' AND bid_count = 0
+		RETURNING updated_at, version
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, a.ID, a.Version).Scan(&a.UpdatedAt, &a.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	a.Status = AuctionStatusCancelled
+	return nil
+}
+
+// GetEndedIDs returns the IDs of up to 100 auctions which have ended but haven't been settled.
+func (m AuctionModel) GetEndedIDs() ([]int64, error) {
+	query := `
+		SELECT id
+		FROM auctions
+		WHERE status = 'open' AND ends_at <= NOW()
+		ORDER BY ends_at
+		LIMIT 100
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	ids := []int64{}
+
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// Settle determines the outcome of an ended auction. If there is a leader and the reserve was
+// met, the auction is sold and the car is reserved for the winner, rejecting any open offers for
+// it; otherwise it is unsold. If the car was reserved or sold some other way in the meantime, the
+// auction is cancelled.
+//
+// Auctions which are already being settled elsewhere are skipped rather than waited for, so that
+// several instances can run the closing job at once. In that case, and if the auction has already
+// been settled, an ErrRecordNotFound error is returned.
+func (m AuctionModel) Settle(id int64) (*Auction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT ` + auctionColumns + `
+		WHERE a.id = $1 AND a.status = 'open' AND a.ends_at <= NOW()
+		FOR UPDATE OF a SKIP LOCKED
+		`
+
+	a, err := scanAuction(tx.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	status := AuctionStatusUnsold
+
+	if a.ReserveMet {
+		var carStatus string
+
+		err = tx.QueryRowContext(ctx, `SELECT status FROM cars WHERE id = $1 FOR UPDATE`, a.CarID).Scan(&carStatus)
+		if err != nil {
+			return nil, err
+		}
+
+		if carStatus == CarStatusAvailable {
+			status = AuctionStatusSold
+
+			_, err = tx.ExecContext(ctx, `UPDATE cars SET status = $1 WHERE id = $2`, CarStatusReserved, a.CarID)
+			if err != nil {
+				return nil, err
+			}
+
+			err = rejectOpenOffers(ctx, tx, a.CarID, 0)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			status = AuctionStatusCancelled
+		}
+	}
+
+	query = `
+		UPDATE auctions
+		SET status = $1, updated_at = NOW(), version = version + 1
+		WHERE id = $2
+		RETURNING updated_at, version
+		`
+
+	err = tx.QueryRowContext(ctx, query, status, a.ID).Scan(&a.UpdatedAt, &a.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	a.Status = status
+
+	return a, nil
+}
+
+func ValidateAuction(v *validator.Validator, a *Auction) {
+	v.Check(!a.StartsAt.IsZero(), "starts_at", "must be provided")
+	v.Check(!a.EndsAt.IsZero(), "ends_at", "must be provided")
+	v.Check(a.StartsAt.After(time.Now().Add(-time.Minute)), "starts_at", "must not be in the past")
+	v.Check(a.EndsAt.Sub(a.StartsAt) >= time.Hour, "ends_at", "must be at least an hour after starts_at")
+	v.Check(a.EndsAt.Sub(a.StartsAt) <= 30*24*time.Hour, "ends_at", "must be at most 30 days after starts_at")
+
+	validateAmount(v, "starting_price", a.StartingPrice)
+	v.Check(a.MinIncrement.Rat().Cmp(big.NewRat(1, 1)) >= 0, "min_increment", "must be at least 1")
+	v.Check(a.MinIncrement.Rat().Cmp(maxAmount) < 0, "min_increment", "must be less than 10 billion")
+	if a.ReservePrice != nil {
+		v.Check(a.ReservePrice.Amount >= a.StartingPrice.Amount, "reserve_price", "must not be less than starting_price")
+		v.Check(a.ReservePrice.Rat().Cmp(maxAmount) < 0, "reserve_price", "must be less than 10 billion")
+	}
+
+	v.Check(a.ExtensionSeconds >= 0, "extension_minutes", "must not be negative")
+	v.Check(a.ExtensionSeconds <= 30*60, "extension_minutes", "must not be more than 30")
+}
+
+func ValidateBidAmount(v *validator.Validator, amount money.Money) {
+	validateAmount(v, "max_amount", amount)
+}
+
+// maxAmount is the upper limit on the amounts of offers, bids and auction prices.
+var maxAmount = big.NewRat(1e10, 1)
+
+// validateAmount checks that an amount given by the user is positive and below maxAmount.
+func validateAmount(v *validator.Validator, key string, amount money.Money) {
+	v.Check(amount.Amount > 0, key, "must be greater than zero")
+	v.Check(amount.Rat().Cmp(maxAmount) < 0, key, "must be less than 10 billion")
+}
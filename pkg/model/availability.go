@@ -0,0 +1,247 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	// Embed the time zone database, so that sellers' time zones can be loaded even on hosts
+	// without one installed, e.g. in scratch containers.
+	_ "time/tzdata"
+
+	"github.com/balgabekj/go_car/pkg/validator"
+)
+
+// AvailabilityWindow is a weekly recurring period in which a seller accepts test drives. Weekday
+// is 0 for Sunday through 6 for Saturday, and Start and End are local times in the HH:MM format.
+type AvailabilityWindow struct {
+	Weekday int    `json:"weekday"`
+	Start   string `json:"start"`
+	End     string `json:"end"`
+}
+
+// Blackout is a date, in the seller's time zone, on which no test drives can be booked.
+type Blackout struct {
+	Date   string `json:"date"`
+	Reason string `json:"reason"`
+}
+
+// Availability is a seller's weekly schedule for test drives, in the given IANA time zone.
+type Availability struct {
+	Timezone  string               `json:"timezone"`
+	Windows   []AvailabilityWindow `json:"windows"`
+	Blackouts []Blackout           `json:"blackouts"`
+}
+
+// Allows reports whether a test drive from start to end fits entirely into one of the windows
+// and doesn't fall on a blackout date.
+func (a *Availability) Allows(start, end time.Time) bool {
+	loc, err := time.LoadLocation(a.Timezone)
+	if err != nil {
+		return false
+	}
+
+	start, end = start.In(loc), end.In(loc)
+
+	date := start.Format("2006-01-02")
+	if end.Format("2006-01-02") != date {
+		return false
+	}
+
+	for _, blackout := range a.Blackouts {
+		if blackout.Date == date {
+			return false
+		}
+	}
+
+	// HH:MM strings compare in the same order as the times they represent.
+	from, to := start.Format("15:04"), end.Format("15:04")
+
+	for _, window := range a.Windows {
+		if window.Weekday == int(start.Weekday()) && window.Start <= from && to <= window.End {
+			return true
+		}
+	}
+
+	return false
+}
+
+type AvailabilityModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Get returns the seller's windows and their blackout dates from today onwards. A seller who
+// hasn't set up a schedule gets an empty one in UTC.
+func (m AvailabilityModel) Get(sellerID int64) (*Availability, error) {
+	query := `
+		SELECT weekday, to_char(start_time, 'HH24:MI'), to_char(end_time, 'HH24:MI'), timezone
+		FROM seller_availability
+		WHERE seller_id = $1
+		ORDER BY weekday, start_time
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, sellerID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	availability := &Availability{
+		Timezone:  "UTC",
+		Windows:   []AvailabilityWindow{},
+		Blackouts: []Blackout{},
+	}
+
+	for rows.Next() {
+		var window AvailabilityWindow
+
+		err := rows.Scan(&window.Weekday, &window.Start, &window.End, &availability.Timezone)
+		if err != nil {
+			return nil, err
+		}
+
+		availability.Windows = append(availability.Windows, window)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `
+		SELECT to_char(date, 'YYYY-MM-DD'), reason
+		FROM seller_blackouts
+		WHERE seller_id = $1 AND date >= CURRENT_DATE - 1
+		ORDER BY date
+		`
+
+	rows, err = m.DB.QueryContext(ctx, query, sellerID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	for rows.Next() {
+		var blackout Blackout
+
+		if err := rows.Scan(&blackout.Date, &blackout.Reason); err != nil {
+			return nil, err
+		}
+
+		availability.Blackouts = append(availability.Blackouts, blackout)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return availability, nil
+}
+
+// SetWindows replaces the seller's weekly windows and time zone. Blackout dates are kept.
+func (m AvailabilityModel) SetWindows(sellerID int64, availability *Availability) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM seller_availability WHERE seller_id = $1`, sellerID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO seller_availability (seller_id, weekday, start_time, end_time, timezone)
+		VALUES ($1, $2, $3, $4, $5)
+		`
+
+	for _, window := range availability.Windows {
+		_, err = tx.ExecContext(ctx, query, sellerID, window.Weekday, window.Start, window.End, availability.Timezone)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// AddBlackout blocks a date for test drives, replacing the reason if the date is already blocked.
+func (m AvailabilityModel) AddBlackout(sellerID int64, blackout Blackout) error {
+	query := `
+		INSERT INTO seller_blackouts (seller_id, date, reason)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (seller_id, date) DO UPDATE SET reason = EXCLUDED.reason
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, sellerID, blackout.Date, blackout.Reason)
+	return err
+}
+
+// DeleteBlackout unblocks a date. If the date isn't blocked an ErrRecordNotFound error is
+// returned.
+func (m AvailabilityModel) DeleteBlackout(sellerID int64, date string) error {
+	query := `
+		DELETE FROM seller_blackouts
+		WHERE seller_id = $1 AND date = $2
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, sellerID, date)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func ValidateAvailability(v *validator.Validator, availability *Availability) {
+	_, err := time.LoadLocation(availability.Timezone)
+	v.Check(availability.Timezone != "" && err == nil, "timezone", "must be a valid IANA time zone, e.g. Asia/Almaty")
+	v.Check(len(availability.Windows) <= 50, "windows", "must not contain more than 50 windows")
+
+	for _, window := range availability.Windows {
+		v.Check(window.Weekday >= 0 && window.Weekday <= 6, "windows", "weekday must be between 0 (Sunday) and 6 (Saturday)")
+
+		start, err1 := time.Parse("15:04", window.Start)
+		end, err2 := time.Parse("15:04", window.End)
+		v.Check(err1 == nil && err2 == nil, "windows", "start and end must be times in the HH:MM format")
+		v.Check(start.Before(end), "windows", "start must be before end")
+	}
+}
+
+func ValidateBlackout(v *validator.Validator, blackout Blackout) {
+	_, err := time.Parse("2006-01-02", blackout.Date)
+	v.Check(err == nil, "date", "must be a date in the YYYY-MM-DD format")
+	v.Check(len(blackout.Reason) <= 200, "reason", "must not be more than 200 bytes long")
+}
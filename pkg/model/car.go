@@ -3,21 +3,62 @@ package model
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"time"
+
+	"github.com/balgabekj/go_car/pkg/money"
+)
+
+// Car statuses. A car is reserved once an offer for it has been accepted.
+const (
+	CarStatusAvailable = "available"
+	CarStatusReserved  = "reserved"
+	CarStatusSold      = "sold"
 )
 
+// ErrCarNotAvailable is returned when a car can't be reserved or bought because it already is.
+var ErrCarNotAvailable = errors.New("car not available")
+
 type Car struct {
-	ID           int     `json:"id"`
-	Model        string  `json:"model"`
-	Brand        string  `json:"brand"`
-	Year         int     `json:"year"`
-	Price        float64 `json:"price"`
-	Color        string  `json:"color"`
-	IsUsed       bool    `json:"isUsed"`
-	UserID       int     `json:"userId"`
-	CategoryName string  `json:"categoryName"`
+	ID             int            `json:"id"`
+	Model          string         `json:"model"`
+	Brand          string         `json:"brand"`
+	Year           int            `json:"year"`
+	Price          money.Money    `json:"-"`
+	ConvertedPrice *money.Money   `json:"converted_price,omitempty"`
+	Color          string         `json:"color"`
+	IsUsed         bool           `json:"isUsed"`
+	UserID         int            `json:"userId"`
+	CategoryName   string         `json:"categoryName"`
+	Status         string         `json:"status"`
+	Deal           string         `json:"deal,omitempty"`
+	SuggestedPrice *PriceEstimate `json:"suggested_price,omitempty"`
+}
+
+// MarshalJSON writes the price as a plain decimal number next to its currency code, so clients
+// written before prices had a currency keep working.
+func (c Car) MarshalJSON() ([]byte, error) {
+	type car Car
+
+	return json.Marshal(struct {
+		car
+		Price    json.Number `json:"price"`
+		Currency string      `json:"currency"`
+	}{car(c), json.Number(c.Price.Decimal()), c.Price.Currency.Code})
+}
+
+// PriceFilter filters and sorts cars by their price in one currency, converting prices listed
+// in other currencies at the stored exchange rates. Min and Max are in minor units of Currency,
+// and zero means no bound. Cars whose price can't be converted are left out if a bound is set,
+// and sorted last otherwise. If Convert is set, each car comes with its converted price.
+type PriceFilter struct {
+	Currency money.Currency
+	Min      int64
+	Max      int64
+	Convert  bool
 }
 
 type CarModel struct {
@@ -28,50 +69,85 @@ type CarModel struct {
 
 func (m *CarModel) Insert(car *Car) error {
 	query := `
-        INSERT INTO cars (model, brand, year, color, price, isUsed, userId, categoryName)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-        RETURNING id
+        INSERT INTO cars (model, brand, year, color, price, currency, isUsed, userId, categoryName)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+        RETURNING id, status
     `
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, car.Model, car.Brand, car.Year, car.Color, car.Price, car.IsUsed, car.UserID, car.CategoryName).Scan(&car.ID)
+	return m.DB.QueryRowContext(ctx, query, car.Model, car.Brand, car.Year, car.Color, car.Price.Amount, car.Price.Currency.Code, car.IsUsed, car.UserID, car.CategoryName).Scan(&car.ID, &car.Status)
 }
 
 func (m CarModel) Get(id string) (*Car, error) {
 	query := `
-        SELECT id, model, brand, year, color, price, isUsed, userID, categoryName
+        SELECT id, model, brand, year, color, price, currency, isUsed, userID, categoryName, status
         FROM cars
         WHERE id = $1
     `
 
-	var car Car
+	var (
+		car      Car
+		price    int64
+		currency string
+	)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	row := m.DB.QueryRowContext(ctx, query, id)
-	err := row.Scan(&car.ID, &car.Model, &car.Brand, &car.Year, &car.Color, &car.Price, &car.IsUsed, &car.UserID, &car.CategoryName)
+	err := row.Scan(&car.ID, &car.Model, &car.Brand, &car.Year, &car.Color, &price, &currency, &car.IsUsed, &car.UserID, &car.CategoryName, &car.Status)
 	if err != nil {
 		return nil, err
 	}
+	car.Price = money.New(price, currency)
 	return &car, nil
 }
 
-func (m CarModel) GetAll(brand string, minYear int, maxYear int, filters Filters) ([]Car, Metadata, error) {
+func (m CarModel) GetAll(brand string, minYear int, maxYear int, prices PriceFilter, filters Filters) ([]Car, Metadata, error) {
+	// Prices are compared in the requested currency. Rates are stored against a common base, so
+	// the rate between two currencies is the ratio of their rates, and the exponents scale the
+	// result from minor units of one currency to minor units of the other. Available cars with a
+	// market price estimate are labelled by how their price compares with it; cars without a price,
+	// which are only up for auction, aren't labelled even if an old estimate is still stored.
+	column := filters.sortColumn()
+	if column == "price" {
+		column = "converted_price"
+	}
+
 	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id,model, brand, year,color, price, isUsed, userId
-		FROM cars
-		WHERE (LOWER(brand) = LOWER($1) OR $1 = '')
-		AND (year >= $2 OR $2 = 0)
-		AND (year <= $3 OR $3 = 0)
-		ORDER BY %s %s, id ASC
-		LIMIT $4 OFFSET $5
-	`, filters.sortColumn(), filters.sortDirection())
+		SELECT count(*) OVER(), id, model, brand, year, color, price, currency, isUsed, userId, status, converted_price, deal
+		FROM (
+			SELECT c.id, c.model, c.brand, c.year, c.color, c.price, c.currency, c.isUsed, c.userId, c.status,
+				CASE
+					WHEN c.currency = $4 THEN c.price
+					ELSE round(c.price * t.rate / f.rate * power(10::numeric, t.exponent - f.exponent))::bigint
+				END AS converted_price,
+				CASE
+					WHEN e.car_id IS NULL OR c.status <> 'available' THEN ''
+					WHEN c.price <= 0 THEN ''
+					WHEN c.price <= e.low THEN 'great'
+					WHEN c.price <= e.value THEN 'good'
+					WHEN c.price <= e.high THEN 'fair'
+					ELSE 'high'
+				END AS deal
+			FROM cars c
+			LEFT JOIN exchange_rates f ON f.currency = c.currency
+			LEFT JOIN exchange_rates t ON t.currency = $4
+			LEFT JOIN car_price_estimates e ON e.car_id = c.id AND e.currency = c.currency
+			WHERE (LOWER(c.brand) = LOWER($1) OR $1 = '')
+			AND (c.year >= $2 OR $2 = 0)
+			AND (c.year <= $3 OR $3 = 0)
+		) cars
+		WHERE (converted_price >= $5 OR $5 = 0)
+		AND (converted_price <= $6 OR $6 = 0)
+		ORDER BY %s %s NULLS LAST, id ASC
+		LIMIT $7 OFFSET $8
+	`, column, filters.sortDirection())
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	args := []interface{}{brand, minYear, maxYear, filters.limit(), filters.offset()}
+	args := []interface{}{brand, minYear, maxYear, prices.Currency.Code, prices.Min, prices.Max, filters.limit(), filters.offset()}
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
@@ -89,11 +165,20 @@ func (m CarModel) GetAll(brand string, minYear int, maxYear int, filters Filters
 	var cars []Car
 
 	for rows.Next() {
-		var car Car
-		err := rows.Scan(&totalRecords, &car.ID, &car.Model, &car.Brand, &car.Year, &car.Color, &car.Price, &car.IsUsed, &car.UserID)
+		var (
+			car       Car
+			price     int64
+			currency  string
+			converted sql.NullInt64
+		)
+		err := rows.Scan(&totalRecords, &car.ID, &car.Model, &car.Brand, &car.Year, &car.Color, &price, &currency, &car.IsUsed, &car.UserID, &car.Status, &converted, &car.Deal)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
+		car.Price = money.New(price, currency)
+		if prices.Convert && converted.Valid {
+			car.ConvertedPrice = &money.Money{Amount: converted.Int64, Currency: prices.Currency}
+		}
 		cars = append(cars, car)
 	}
 
@@ -106,30 +191,130 @@ func (m CarModel) GetAll(brand string, minYear int, maxYear int, filters Filters
 	return cars, metadata, nil
 }
 
+// Update saves the car's details. The price and currency of a car which is no longer available
+// can't be changed, since it may be being bought at that price; trying to returns
+// ErrCarNotAvailable. The check is part of the UPDATE, so it holds even if the car is reserved
+// concurrently.
 func (m CarModel) Update(car *Car) error {
 	query := `
         UPDATE cars
-        SET model = $1, brand = $2, year = $3, color = $4, price = $5, isUsed = $6
-        WHERE id = $7
+        SET model = $1, brand = $2, year = $3, color = $4, price = $5, currency = $6, isUsed = $7
+        WHERE id = $8 AND (status = $9 OR (price = $5 AND currency = $6))
     `
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, car.Model, car.Brand, car.Year, car.Color, car.Price, car.IsUsed, car.ID)
-	return err
+	args := []interface{}{car.Model, car.Brand, car.Year, car.Color, car.Price.Amount, car.Price.Currency.Code, car.IsUsed, car.ID, CarStatusAvailable}
+
+	result, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrCarNotAvailable
+	}
+
+	return nil
+}
+
+// Delete deletes a car. Deleting a car also deletes its auctions, offers, test drives and
+// conversations, so only an available car without an open auction or an order in progress can
+// be deleted; otherwise ErrCarNotAvailable is returned. As in Update, the check is part of the
+// DELETE, so a car reserved in the meantime isn't deleted.
+func (m CarModel) Delete(id int) error {
+	query := `
+		DELETE FROM cars
+		WHERE id = $1 AND status = $2
+		AND NOT EXISTS (SELECT 1 FROM auctions WHERE car_id = cars.id AND status = 'open')
+		AND NOT EXISTS (SELECT 1 FROM orders WHERE car_id = cars.id AND status IN ($3, $4))
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{id, CarStatusAvailable, OrderStatusPending, OrderStatusDepositPaid}
+
+	result, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrCarNotAvailable
+	}
+
+	return nil
 }
 
-func (m CarModel) Delete(id string) error {
+// GetAllForUser returns every car listed by a user.
+func (m CarModel) GetAllForUser(userID int64) ([]Car, error) {
+	query := `
+		SELECT id, model, brand, year, color, price, currency, isUsed, userId, COALESCE(categoryName, ''), status
+		FROM cars
+		WHERE userId = $1
+		ORDER BY id
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	cars := []Car{}
 
+	for rows.Next() {
+		var (
+			car      Car
+			price    int64
+			currency string
+		)
+		err := rows.Scan(&car.ID, &car.Model, &car.Brand, &car.Year, &car.Color, &price, &currency, &car.IsUsed, &car.UserID, &car.CategoryName, &car.Status)
+		if err != nil {
+			return nil, err
+		}
+		car.Price = money.New(price, currency)
+		cars = append(cars, car)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return cars, nil
+}
+
+// CountForUser returns the number of cars listed by a user.
+func (m CarModel) CountForUser(userID int64) (int, error) {
 	query := `
-        DELETE FROM cars
-        WHERE id = $1
-    `
+		SELECT count(*)
+		FROM cars
+		WHERE userId = $1
+	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, id)
-	return err
+	var count int
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&count)
+	return count, err
 }
@@ -5,6 +5,8 @@ import (
 	"database/sql"
 	"log"
 	"time"
+
+	"github.com/balgabekj/go_car/pkg/money"
 )
 
 type Category struct {
@@ -62,6 +64,7 @@ func (m *CarModel) GetByCategory(categoryName string) ([]*Car, error) {
 			c.brand, 
 			c.year, 
 			c.price, 
+			c.currency, 
 			c.color, 
 			c.isUsed, 
 			c.userId, 
@@ -88,11 +91,16 @@ func (m *CarModel) GetByCategory(categoryName string) ([]*Car, error) {
 	defer rows.Close()
 
 	for rows.Next() {
-		var car Car
-		err := rows.Scan(&car.ID, &car.Model, &car.Brand, &car.Year, &car.Price, &car.Color, &car.IsUsed, &car.UserID, &car.CategoryName)
+		var (
+			car      Car
+			price    int64
+			currency string
+		)
+		err := rows.Scan(&car.ID, &car.Model, &car.Brand, &car.Year, &price, &currency, &car.Color, &car.IsUsed, &car.UserID, &car.CategoryName)
 		if err != nil {
 			return nil, err
 		}
+		car.Price = money.New(price, currency)
 		cars = append(cars, &car)
 	}
 
@@ -0,0 +1,239 @@
+package model
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// Data export statuses.
+const (
+	ExportStatusPending = "pending"
+	ExportStatusReady   = "ready"
+	ExportStatusFailed  = "failed"
+)
+
+// ErrExportInProgress is returned when a user requests a data export while a previous one is
+// still being generated.
+var ErrExportInProgress = errors.New("export in progress")
+
+// DataExport is a ZIP archive containing a copy of a user's personal data. The archive is
+// generated in the background and can be downloaded with a secret link until it expires. As with
+// tokens, only the SHA-256 hash of the link's secret is stored.
+type DataExport struct {
+	ID            int64      `json:"id"`
+	UserID        int64      `json:"-"`
+	Status        string     `json:"status"`
+	DownloadToken string     `json:"-"`
+	Size          int        `json:"size"`
+	CreatedAt     time.Time  `json:"created_at"`
+	CompletedAt   *time.Time `json:"completed_at"`
+	Expiry        time.Time  `json:"expiry"`
+}
+
+type DataExportModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// New records a pending export for the user together with the secret needed to download it
+// later. The export, and therefore its download link, expires after ttl.
+func (m DataExportModel) New(userID int64, ttl time.Duration) (*DataExport, error) {
+	token, err := generateToken(userID, ttl, "")
+	if err != nil {
+		return nil, err
+	}
+
+	export := &DataExport{
+		UserID:        userID,
+		Status:        ExportStatusPending,
+		DownloadToken: token.Plaintext,
+		Expiry:        token.Expiry,
+	}
+
+	query := `
+		INSERT INTO data_exports (user_id, download_hash, expiry)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, userID, token.Hash, token.Expiry).Scan(&export.ID, &export.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "data_exports_pending_idx"`:
+			return nil, ErrExportInProgress
+		default:
+			return nil, err
+		}
+	}
+
+	return export, nil
+}
+
+// Get returns an export belonging to the user, without the archive itself.
+func (m DataExportModel) Get(id, userID int64) (*DataExport, error) {
+	query := `
+		SELECT id, user_id, status, COALESCE(length(archive), 0), created_at, completed_at, expiry
+		FROM data_exports
+		WHERE id = $1 AND user_id = $2
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var export DataExport
+
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(
+		&export.ID,
+		&export.UserID,
+		&export.Status,
+		&export.Size,
+		&export.CreatedAt,
+		&export.CompletedAt,
+		&export.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &export, nil
+}
+
+// Complete stores the generated archive and marks the export as ready for download. If the export
+// is no longer pending, e.g. because it was given up on by FailStale or deleted along with the
+// user, an ErrRecordNotFound error is returned.
+func (m DataExportModel) Complete(id int64, archive []byte) error {
+	query := `
+		UPDATE data_exports
+		SET status = $1, archive = $2, completed_at = NOW()
+		WHERE id = $3 AND status = $4
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, ExportStatusReady, archive, id, ExportStatusPending)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Fail marks an export as failed, so that the user can request a new one.
+func (m DataExportModel) Fail(id int64) error {
+	query := `
+		UPDATE data_exports
+		SET status = $1, completed_at = NOW()
+		WHERE id = $2
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, ExportStatusFailed, id)
+	return err
+}
+
+// GetArchive returns a ready, unexpired export and its archive for the download secret. If no
+// such export exists an ErrRecordNotFound error is returned.
+func (m DataExportModel) GetArchive(downloadToken string) (*DataExport, []byte, error) {
+	query := `
+		SELECT id, user_id, status, created_at, completed_at, expiry, archive
+		FROM data_exports
+		WHERE download_hash = $1 AND status = $2 AND expiry > $3
+		`
+
+	hash := sha256.Sum256([]byte(downloadToken))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var (
+		export  DataExport
+		archive []byte
+	)
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], ExportStatusReady, time.Now()).Scan(
+		&export.ID,
+		&export.UserID,
+		&export.Status,
+		&export.CreatedAt,
+		&export.CompletedAt,
+		&export.Expiry,
+		&archive,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	export.Size = len(archive)
+
+	return &export, archive, nil
+}
+
+// FailStale marks exports which have been pending for longer than olderThan as failed. They were
+// lost, most likely because the process building them stopped, and would otherwise stop the user
+// from requesting a new export until they expire. It returns the number of failed exports.
+func (m DataExportModel) FailStale(olderThan time.Duration) (int64, error) {
+	query := `
+		UPDATE data_exports
+		SET status = $1, completed_at = NOW()
+		WHERE status = $2 AND created_at < $3
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, ExportStatusFailed, ExportStatusPending, time.Now().Add(-olderThan))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// DeleteExpired deletes every export which can no longer be downloaded, along with its archive.
+// It returns the number of deleted exports.
+func (m DataExportModel) DeleteExpired() (int64, error) {
+	query := `
+		DELETE FROM data_exports
+		WHERE expiry < $1
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
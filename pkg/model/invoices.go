@@ -0,0 +1,200 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/balgabekj/go_car/pkg/invoice"
+	"github.com/balgabekj/go_car/pkg/money"
+)
+
+// ErrInvoiceExists is returned when an invoice has already been issued for an order.
+var ErrInvoiceExists = errors.New("invoice exists")
+
+// Invoice is the invoice issued for a completed order. Number is the seller's invoice number,
+// made of the seller ID and their own running count, e.g. 42-000007.
+type Invoice struct {
+	ID       int64            `json:"id"`
+	OrderID  int64            `json:"order_id"`
+	SellerID int64            `json:"seller_id"`
+	Number   string           `json:"number"`
+	IssuedAt time.Time        `json:"issued_at"`
+	Total    money.Money      `json:"total"`
+	Document invoice.Document `json:"document"`
+	HTML     []byte           `json:"-"`
+	PDF      []byte           `json:"-"`
+}
+
+type InvoiceModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Issue numbers and stores a new invoice. The next number in the seller's sequence is taken in
+// the same transaction as the invoice is stored, and render is called in between to produce the
+// HTML and PDF copies once the number is known. If anything fails the number is given back, so
+// a seller's invoice numbers have no gaps. If the order already has an invoice an
+// ErrInvoiceExists error is returned.
+func (m InvoiceModel) Issue(inv *Invoice, render func(*Invoice) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO invoice_sequences (seller_id, last_number)
+		VALUES ($1, 1)
+		ON CONFLICT (seller_id) DO UPDATE SET last_number = invoice_sequences.last_number + 1
+		RETURNING last_number
+		`
+
+	var number int
+
+	err = tx.QueryRowContext(ctx, query, inv.SellerID).Scan(&number)
+	if err != nil {
+		return err
+	}
+
+	inv.Number = fmt.Sprintf("%d-%06d", inv.SellerID, number)
+	inv.IssuedAt = time.Now().UTC().Truncate(time.Second)
+	inv.Document.Number = inv.Number
+	inv.Document.IssuedAt = inv.IssuedAt
+	inv.Total = inv.Document.Total
+
+	err = render(inv)
+	if err != nil {
+		return err
+	}
+
+	document, err := json.Marshal(inv.Document)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		INSERT INTO invoices (order_id, seller_id, number, invoice_number, issued_at, total, currency, document, html, pdf)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id
+		`
+
+	args := []interface{}{inv.OrderID, inv.SellerID, number, inv.Number, inv.IssuedAt, inv.Total.Amount, inv.Total.Currency.Code, document, string(inv.HTML), inv.PDF}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&inv.ID)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "invoices_order_id_key"`:
+			return ErrInvoiceExists
+		default:
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetForOrder returns the invoice issued for an order, including its rendered copies. If the
+// order has no invoice yet an ErrRecordNotFound error is returned.
+func (m InvoiceModel) GetForOrder(orderID int64) (*Invoice, error) {
+	query := `
+		SELECT id, order_id, COALESCE(seller_id, 0), invoice_number, issued_at, total, currency, document, html, pdf
+		FROM invoices
+		WHERE order_id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var (
+		inv      Invoice
+		total    int64
+		currency string
+		document []byte
+		html     string
+	)
+
+	err := m.DB.QueryRowContext(ctx, query, orderID).Scan(&inv.ID, &inv.OrderID, &inv.SellerID, &inv.Number, &inv.IssuedAt, &total, &currency, &document, &html, &inv.PDF)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	err = json.Unmarshal(document, &inv.Document)
+	if err != nil {
+		return nil, err
+	}
+
+	inv.Total = money.New(total, currency)
+	inv.HTML = []byte(html)
+
+	return &inv, nil
+}
+
+// GetAllInvolving returns the invoices for every order the user placed or received, without the
+// rendered copies. It is used for personal data exports.
+func (m InvoiceModel) GetAllInvolving(userID int64) ([]*Invoice, error) {
+	query := `
+		SELECT i.id, i.order_id, COALESCE(i.seller_id, 0), i.invoice_number, i.issued_at, i.total, i.currency, i.document
+		FROM invoices i
+		INNER JOIN orders o ON o.id = i.order_id
+		WHERE o.buyer_id = $1 OR o.seller_id = $1
+		ORDER BY i.id
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	invoices := []*Invoice{}
+
+	for rows.Next() {
+		var (
+			inv      Invoice
+			total    int64
+			currency string
+			document []byte
+		)
+
+		err := rows.Scan(&inv.ID, &inv.OrderID, &inv.SellerID, &inv.Number, &inv.IssuedAt, &total, &currency, &document)
+		if err != nil {
+			return nil, err
+		}
+
+		inv.Total = money.New(total, currency)
+
+		err = json.Unmarshal(document, &inv.Document)
+		if err != nil {
+			return nil, err
+		}
+
+		invoices = append(invoices, &inv)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return invoices, nil
+}
@@ -0,0 +1,159 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// Kinds of subject that failed logins are counted against.
+const (
+	LockoutAccount = "account"
+	LockoutIP      = "ip"
+)
+
+// LockoutKey identifies what a failed login is counted against: an account (by email address) or
+// a client IP address.
+type LockoutKey struct {
+	Kind    string
+	Subject string
+}
+
+// AccountLockoutKey returns the key for the account with the given email address.
+func AccountLockoutKey(email string) LockoutKey {
+	return LockoutKey{Kind: LockoutAccount, Subject: strings.ToLower(email)}
+}
+
+// IPLockoutKey returns the key for the given client IP address.
+func IPLockoutKey(ip string) LockoutKey {
+	return LockoutKey{Kind: LockoutIP, Subject: ip}
+}
+
+// LockoutPolicy describes when and for how long a key is locked. Once Threshold consecutive
+// failures have been recorded within Window, the key is locked for Base, doubling with each
+// further failure up to Max.
+type LockoutPolicy struct {
+	Threshold int
+	Window    time.Duration
+	Base      time.Duration
+	Max       time.Duration
+}
+
+// duration returns how long to lock a key out for after the given number of failures, or zero
+// if the threshold hasn't been reached yet.
+func (p LockoutPolicy) duration(failures int) time.Duration {
+	if p.Threshold <= 0 || failures < p.Threshold {
+		return 0
+	}
+
+	d := p.Base
+	for i := p.Threshold; i < failures && d < p.Max; i++ {
+		d *= 2
+	}
+
+	if d > p.Max {
+		d = p.Max
+	}
+
+	return d
+}
+
+// LockoutModel struct wraps a sql.DB connection pool and allows us to work with the
+// login_lockouts table.
+type LockoutModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// LockedUntil returns the time until which the most restrictive of the given keys is locked, or
+// the zero time if none of them is currently locked.
+func (m LockoutModel) LockedUntil(keys ...LockoutKey) (time.Time, error) {
+	query := `
+		SELECT locked_until
+		FROM login_lockouts
+		WHERE kind = $1 AND subject = $2 AND locked_until > NOW()
+		`
+
+	var until time.Time
+
+	for _, key := range keys {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+
+		var lockedUntil time.Time
+		err := m.DB.QueryRowContext(ctx, query, key.Kind, key.Subject).Scan(&lockedUntil)
+		cancel()
+
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			return time.Time{}, err
+		}
+
+		if lockedUntil.After(until) {
+			until = lockedUntil
+		}
+	}
+
+	return until, nil
+}
+
+// RecordFailure counts a failed login against the key. Failures older than the policy window are
+// forgotten. If the key has now reached the policy threshold it is locked, and the time it is
+// locked until is returned; otherwise the zero time is returned.
+func (m LockoutModel) RecordFailure(key LockoutKey, policy LockoutPolicy) (time.Time, error) {
+	query := `
+		INSERT INTO login_lockouts (kind, subject, failures, last_failure_at)
+		VALUES ($1, $2, 1, NOW())
+		ON CONFLICT (kind, subject) DO UPDATE
+		SET failures = CASE
+				WHEN login_lockouts.last_failure_at < $3 THEN 1
+				ELSE login_lockouts.failures + 1
+			END,
+			last_failure_at = NOW()
+		RETURNING failures
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var failures int
+
+	err := m.DB.QueryRowContext(ctx, query, key.Kind, key.Subject, time.Now().Add(-policy.Window)).Scan(&failures)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	d := policy.duration(failures)
+	if d == 0 {
+		return time.Time{}, nil
+	}
+
+	lockedUntil := time.Now().Add(d)
+
+	_, err = m.DB.ExecContext(ctx, `UPDATE login_lockouts SET locked_until = $3 WHERE kind = $1 AND subject = $2`,
+		key.Kind, key.Subject, lockedUntil)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return lockedUntil, nil
+}
+
+// Reset clears the failure count and any lock for the key.
+func (m LockoutModel) Reset(key LockoutKey) error {
+	query := `
+		DELETE FROM login_lockouts
+		WHERE kind = $1 AND subject = $2
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key.Kind, key.Subject)
+	return err
+}
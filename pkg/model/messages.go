@@ -0,0 +1,384 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/balgabekj/go_car/pkg/validator"
+)
+
+// Participant is one side of a conversation. The email address is always masked, so that buyers
+// and sellers can recognise each other without being able to take the conversation off-platform.
+type Participant struct {
+	ID    int64  `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// Conversation is the message thread between a buyer and the seller of a car. There is at most
+// one conversation per car and buyer. Unread is the number of messages from the other
+// participant that the requesting user hasn't seen yet.
+type Conversation struct {
+	ID            int64       `json:"id"`
+	CarID         int         `json:"car_id"`
+	Buyer         Participant `json:"buyer"`
+	Seller        Participant `json:"seller"`
+	CreatedAt     time.Time   `json:"created_at"`
+	LastMessageAt *time.Time  `json:"last_message_at"`
+	Unread        int         `json:"unread"`
+}
+
+// HasParticipant reports whether the user takes part in the conversation.
+func (c *Conversation) HasParticipant(userID int64) bool {
+	return c.Buyer.ID == userID || c.Seller.ID == userID
+}
+
+// OtherParticipant returns the ID of the participant who isn't userID.
+func (c *Conversation) OtherParticipant(userID int64) int64 {
+	if c.Buyer.ID == userID {
+		return c.Seller.ID
+	}
+	return c.Buyer.ID
+}
+
+type Message struct {
+	ID             int64     `json:"id"`
+	ConversationID int64     `json:"conversation_id"`
+	SenderID       int64     `json:"sender_id"`
+	Body           string    `json:"body"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type MessageModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// conversationColumns selects a conversation with both participants, as scanned by
+// scanConversation. The unread count is calculated for the user given as $1.
+const conversationColumns = `
+		conversations.id, conversations.car_id, conversations.created_at,
+		conversations.last_message_at,
+		buyers.id, buyers.name, buyers.email, sellers.id, sellers.name, sellers.email,
+		(SELECT count(*) FROM messages
+			WHERE messages.conversation_id = conversations.id AND messages.sender_id <> $1
+			AND messages.id > CASE WHEN conversations.buyer_id = $1
+				THEN conversations.buyer_last_read_id ELSE conversations.seller_last_read_id END)
+		FROM conversations
+		INNER JOIN users buyers ON buyers.id = conversations.buyer_id
+		INNER JOIN users sellers ON sellers.id = conversations.seller_id`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanConversation(row scanner, dest ...interface{}) (*Conversation, error) {
+	var c Conversation
+
+	err := row.Scan(append(dest,
+		&c.ID,
+		&c.CarID,
+		&c.CreatedAt,
+		&c.LastMessageAt,
+		&c.Buyer.ID,
+		&c.Buyer.Name,
+		&c.Buyer.Email,
+		&c.Seller.ID,
+		&c.Seller.Name,
+		&c.Seller.Email,
+		&c.Unread,
+	)...)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Buyer.Email = MaskEmail(c.Buyer.Email)
+	c.Seller.Email = MaskEmail(c.Seller.Email)
+
+	return &c, nil
+}
+
+// StartConversation returns the conversation between the buyer and the seller about the car,
+// creating it if it doesn't exist yet.
+func (m MessageModel) StartConversation(carID int, buyerID, sellerID int64) (*Conversation, error) {
+	query := `
+		INSERT INTO conversations (car_id, buyer_id, seller_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (car_id, buyer_id) DO UPDATE SET car_id = EXCLUDED.car_id
+		RETURNING id
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int64
+
+	err := m.DB.QueryRowContext(ctx, query, carID, buyerID, sellerID).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.GetConversation(id, buyerID)
+}
+
+// GetConversation returns a conversation the user takes part in. If there is no such
+// conversation an ErrRecordNotFound error is returned.
+func (m MessageModel) GetConversation(id, userID int64) (*Conversation, error) {
+	query := `SELECT ` + conversationColumns + `
+		WHERE conversations.id = $2
+			AND (conversations.buyer_id = $1 OR conversations.seller_id = $1)
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	conversation, err := scanConversation(m.DB.QueryRowContext(ctx, query, userID, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return conversation, nil
+}
+
+// GetConversationsForUser returns a page of the user's inbox, with the most recently active
+// conversations first.
+func (m MessageModel) GetConversationsForUser(userID int64, filters Filters) ([]*Conversation, Metadata, error) {
+	query := `SELECT count(*) OVER(), ` + conversationColumns + `
+		WHERE conversations.buyer_id = $1 OR conversations.seller_id = $1
+		ORDER BY COALESCE(conversations.last_message_at, conversations.created_at) DESC,
+			conversations.id DESC
+		LIMIT $2 OFFSET $3
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	totalRecords := 0
+	conversations := []*Conversation{}
+
+	for rows.Next() {
+		conversation, err := scanConversation(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		conversations = append(conversations, conversation)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return conversations, metadata, nil
+}
+
+// CountUnread returns the total number of unread messages across all of the user's
+// conversations.
+func (m MessageModel) CountUnread(userID int64) (int, error) {
+	query := `
+		SELECT count(*)
+		FROM messages
+		INNER JOIN conversations ON conversations.id = messages.conversation_id
+		WHERE messages.sender_id <> $1
+			AND ((conversations.buyer_id = $1 AND messages.id > conversations.buyer_last_read_id)
+			OR (conversations.seller_id = $1 AND messages.id > conversations.seller_last_read_id))
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&count)
+	return count, err
+}
+
+// Insert adds a message to a conversation. Sending a message also marks the conversation as
+// read for the sender.
+func (m MessageModel) Insert(message *Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO messages (conversation_id, sender_id, body)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+		`
+
+	err = tx.QueryRowContext(ctx, query, message.ConversationID, message.SenderID, message.Body).Scan(&message.ID, &message.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		UPDATE conversations
+		SET last_message_at = $2,
+			buyer_last_read_id = CASE WHEN buyer_id = $3 THEN $4 ELSE buyer_last_read_id END,
+			seller_last_read_id = CASE WHEN seller_id = $3 THEN $4 ELSE seller_last_read_id END
+		WHERE id = $1
+		`
+
+	_, err = tx.ExecContext(ctx, query, message.ConversationID, message.CreatedAt, message.SenderID, message.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetAllForConversation returns a page of the messages in a conversation.
+func (m MessageModel) GetAllForConversation(conversationID int64, filters Filters) ([]*Message, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, conversation_id, sender_id, body, created_at
+		FROM messages
+		WHERE conversation_id = $1
+		ORDER BY %s %s
+		LIMIT $2 OFFSET $3
+		`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, conversationID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	totalRecords := 0
+	messages := []*Message{}
+
+	for rows.Next() {
+		var message Message
+
+		err := rows.Scan(
+			&totalRecords,
+			&message.ID,
+			&message.ConversationID,
+			&message.SenderID,
+			&message.Body,
+			&message.CreatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		messages = append(messages, &message)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return messages, metadata, nil
+}
+
+// MarkRead marks every message currently in the conversation as read by the user.
+func (m MessageModel) MarkRead(conversationID, userID int64) error {
+	query := `
+		UPDATE conversations
+		SET buyer_last_read_id = CASE WHEN buyer_id = $2 THEN latest.id ELSE buyer_last_read_id END,
+			seller_last_read_id = CASE WHEN seller_id = $2 THEN latest.id ELSE seller_last_read_id END
+		FROM (SELECT COALESCE(max(id), 0) AS id FROM messages WHERE conversation_id = $1) latest
+		WHERE conversations.id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, conversationID, userID)
+	return err
+}
+
+// GetAllForUser returns every message the user has sent, oldest first. It is used for personal
+// data exports.
+func (m MessageModel) GetAllForUser(userID int64) ([]*Message, error) {
+	query := `
+		SELECT id, conversation_id, sender_id, body, created_at
+		FROM messages
+		WHERE sender_id = $1
+		ORDER BY id
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	messages := []*Message{}
+
+	for rows.Next() {
+		var message Message
+
+		err := rows.Scan(&message.ID, &message.ConversationID, &message.SenderID, &message.Body, &message.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, &message)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// MaskEmail hides most of the local part of an email address, e.g. "alice@example.com" becomes
+// "a****@example.com".
+func MaskEmail(email string) string {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" {
+		return "****"
+	}
+
+	return string([]rune(local)[:1]) + strings.Repeat("*", 4) + "@" + domain
+}
+
+func ValidateMessage(v *validator.Validator, message *Message) {
+	v.Check(strings.TrimSpace(message.Body) != "", "body", "must be provided")
+	v.Check(len(message.Body) <= 5000, "body", "must not be more than 5000 bytes long")
+}
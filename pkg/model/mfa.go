@@ -0,0 +1,248 @@
+package model
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/balgabekj/go_car/pkg/validator"
+)
+
+// ScopeMFAPending is the scope of the short-lived token handed out after a correct password when
+// the user has two-factor authentication enabled. It can only be exchanged, together with a valid
+// code, for a real authentication token.
+const ScopeMFAPending = "mfa-pending"
+
+// recoveryCodeCount is the number of recovery codes generated when 2FA is enabled.
+const recoveryCodeCount = 10
+
+// MFA holds the two-factor authentication settings of a user.
+type MFA struct {
+	UserID      int64
+	Secret      string
+	Enabled     bool
+	LastCounter uint64
+}
+
+// MFAModel struct wraps a sql.DB connection pool and allows us to work with the user_mfa and
+// mfa_recovery_codes tables.
+type MFAModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// GetForUser returns the 2FA settings for a user, or ErrRecordNotFound if they have never started
+// enrolment.
+func (m MFAModel) GetForUser(userID int64) (*MFA, error) {
+	query := `
+		SELECT user_id, totp_secret, enabled, last_counter
+		FROM user_mfa
+		WHERE user_id = $1
+		`
+
+	var mfa MFA
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&mfa.UserID, &mfa.Secret, &mfa.Enabled, &mfa.LastCounter)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &mfa, nil
+}
+
+// IsEnabled reports whether the user has confirmed 2FA enrolment.
+func (m MFAModel) IsEnabled(userID int64) (bool, error) {
+	mfa, err := m.GetForUser(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return mfa.Enabled, nil
+}
+
+// SetPendingSecret stores a new, not yet confirmed, TOTP secret for the user, replacing any
+// previous unconfirmed one. It doesn't touch an enabled configuration.
+func (m MFAModel) SetPendingSecret(userID int64, secret string) error {
+	query := `
+		INSERT INTO user_mfa (user_id, totp_secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET totp_secret = EXCLUDED.totp_secret, last_counter = 0, created_at = NOW()
+		WHERE user_mfa.enabled = false
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, secret)
+	return err
+}
+
+// UseCounter records that the TOTP code for the given time step counter was used. It returns
+// false if that counter (or a later one) was already used, so a code can't be replayed.
+func (m MFAModel) UseCounter(userID int64, counter uint64) (bool, error) {
+	query := `
+		UPDATE user_mfa
+		SET last_counter = $2
+		WHERE user_id = $1 AND last_counter < $2
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, counter)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// Enable turns on 2FA for the user and replaces their recovery codes with a fresh set, returning
+// the plaintext codes. Only their hashes are stored, so this is the only time they can be shown.
+func (m MFAModel) Enable(userID int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE user_mfa SET enabled = true, enabled_at = NOW() WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+
+		hash := sha256.Sum256([]byte(code))
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO mfa_recovery_codes (user_id, hash) VALUES ($1, $2)`, userID, hash[:])
+		if err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, code)
+	}
+
+	return codes, tx.Commit()
+}
+
+// Disable removes the user's 2FA configuration and recovery codes.
+func (m MFAModel) Disable(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM user_mfa WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseRecoveryCode marks a matching, unused recovery code as used. It returns false if the code
+// doesn't match any of the user's remaining codes.
+func (m MFAModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	query := `
+		UPDATE mfa_recovery_codes
+		SET used_at = NOW()
+		WHERE user_id = $1 AND hash = $2 AND used_at IS NULL
+		`
+
+	hash := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, hash[:])
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// generateRecoveryCode returns a random code formatted as two groups of five characters, e.g.
+// "K3TZQ-8WXAP", which is easy to write down.
+func generateRecoveryCode() (string, error) {
+	randomBytes := make([]byte, 10)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)[:10]
+
+	return code[:5] + "-" + code[5:], nil
+}
+
+// normalizeRecoveryCode accepts codes typed in lowercase or without the dash.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	if len(code) != 10 {
+		return code
+	}
+	return code[:5] + "-" + code[5:]
+}
+
+// ValidateTOTPCode checks that a one-time code is provided and consists of six digits.
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) == 6, "code", "must be 6 digits long")
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"log"
 	"os"
+	"time"
 )
 
 var (
@@ -16,16 +17,34 @@ var (
 )
 
 type Models struct {
-	Cars        CarModel
-	Users       UserModel
-	Tokens      TokenModel
-	Permissions PermissionModel
-	Categories  CategoryModel
+	Cars         CarModel
+	Users        UserModel
+	Tokens       TokenModel
+	Permissions  PermissionModel
+	Categories   CategoryModel
+	MFA          MFAModel
+	Lockouts     LockoutModel
+	APIKeys      APIKeyModel
+	Roles        RoleModel
+	Exports      DataExportModel
+	Messages     MessageModel
+	Blocks       BlockModel
+	Reports      ReportModel
+	Offers       OfferModel
+	Availability AvailabilityModel
+	TestDrives   TestDriveModel
+	Auctions     AuctionModel
+	Orders       OrderModel
+	Invoices     InvoiceModel
+	Rates        ExchangeRateModel
 }
 
-func NewModels(db *sql.DB) Models {
+// NewModels returns the models wrapping the given connection pool. Effective permissions are
+// cached in process for permissionCacheTTL; a TTL of zero disables the cache.
+func NewModels(db *sql.DB, permissionCacheTTL time.Duration) Models {
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+	permissionCache := NewPermissionCache(permissionCacheTTL)
 	return Models{
 		Cars: CarModel{
 			DB:       db,
@@ -46,11 +65,88 @@ func NewModels(db *sql.DB) Models {
 			DB:       db,
 			InfoLog:  infoLog,
 			ErrorLog: errorLog,
+			Cache:    permissionCache,
 		},
 		Categories: CategoryModel{
 			DB:       db,
 			InfoLog:  infoLog,
 			ErrorLog: errorLog,
 		},
+		MFA: MFAModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Lockouts: LockoutModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		APIKeys: APIKeyModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Roles: RoleModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+			Cache:    permissionCache,
+		},
+		Exports: DataExportModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Messages: MessageModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Blocks: BlockModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Reports: ReportModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Offers: OfferModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Availability: AvailabilityModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		TestDrives: TestDriveModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Auctions: AuctionModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Orders: OrderModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Invoices: InvoiceModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
+		Rates: ExchangeRateModel{
+			DB:       db,
+			InfoLog:  infoLog,
+			ErrorLog: errorLog,
+		},
 	}
 }
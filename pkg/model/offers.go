@@ -0,0 +1,521 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/balgabekj/go_car/pkg/money"
+	"github.com/balgabekj/go_car/pkg/validator"
+)
+
+// Offer statuses. A pending offer waits for the seller to respond and a countered one for the
+// buyer. Open offers whose expiry has passed are reported as expired straight away, even before
+// the purge job has updated them.
+const (
+	OfferStatusPending   = "pending"
+	OfferStatusCountered = "countered"
+	OfferStatusAccepted  = "accepted"
+	OfferStatusRejected  = "rejected"
+	OfferStatusWithdrawn = "withdrawn"
+	OfferStatusExpired   = "expired"
+)
+
+// Actions recorded in an offer's history.
+const (
+	OfferActionCreated   = "created"
+	OfferActionCountered = "countered"
+	OfferActionAccepted  = "accepted"
+	OfferActionRejected  = "rejected"
+	OfferActionWithdrawn = "withdrawn"
+	OfferActionExpired   = "expired"
+)
+
+// ErrOpenOfferExists is returned when a buyer makes an offer for a car while a previous offer of
+// theirs for the same car is still open.
+var ErrOpenOfferExists = errors.New("open offer exists")
+
+// Offer is a buyer's proposed price for a car, in the currency the car is listed in. The buyer
+// and seller take turns to counter it until one of them accepts or rejects it, the buyer
+// withdraws it, or it expires.
+type Offer struct {
+	ID        int64         `json:"id"`
+	CarID     int           `json:"car_id"`
+	BuyerID   int64         `json:"buyer_id"`
+	SellerID  int64         `json:"seller_id"`
+	Amount    money.Money   `json:"amount"`
+	Status    string        `json:"status"`
+	Expiry    time.Time     `json:"expiry"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	Version   int           `json:"version"`
+	Events    []*OfferEvent `json:"events,omitempty"`
+}
+
+// OfferEvent records one step in the negotiation of an offer. ActorID is nil for steps taken by
+// the system, such as expiry or rejection because another offer was accepted.
+type OfferEvent struct {
+	ID        int64       `json:"id"`
+	ActorID   *int64      `json:"actor_id"`
+	Action    string      `json:"action"`
+	Amount    money.Money `json:"amount"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// IsOpen reports whether the offer can still be countered, accepted, rejected or withdrawn.
+func (o *Offer) IsOpen() bool {
+	return o.Status == OfferStatusPending || o.Status == OfferStatusCountered
+}
+
+// AwaitingResponseFrom returns the ID of the participant whose turn it is to respond, or 0 if the
+// offer is no longer open.
+func (o *Offer) AwaitingResponseFrom() int64 {
+	switch o.Status {
+	case OfferStatusPending:
+		return o.SellerID
+	case OfferStatusCountered:
+		return o.BuyerID
+	default:
+		return 0
+	}
+}
+
+// HasParticipant reports whether the user is the buyer or the seller.
+func (o *Offer) HasParticipant(userID int64) bool {
+	return o.BuyerID == userID || o.SellerID == userID
+}
+
+// OfferFilter holds the optional criteria for listing a user's offers. Role is "buyer", "seller"
+// or empty for both.
+type OfferFilter struct {
+	Role   string
+	CarID  int
+	Status string
+}
+
+type OfferModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// offerColumns selects an offer as scanned by scanOffer.
+const offerColumns = `
+		id, car_id, buyer_id, seller_id, amount, currency,
+		CASE WHEN status IN ('pending', 'countered') AND expiry <= NOW() THEN 'expired' ELSE status END,
+		expiry, created_at, updated_at, version
+		FROM offers`
+
+func scanOffer(row scanner, dest ...interface{}) (*Offer, error) {
+	var (
+		o        Offer
+		amount   int64
+		currency string
+	)
+
+	err := row.Scan(append(dest,
+		&o.ID,
+		&o.CarID,
+		&o.BuyerID,
+		&o.SellerID,
+		&amount,
+		&currency,
+		&o.Status,
+		&o.Expiry,
+		&o.CreatedAt,
+		&o.UpdatedAt,
+		&o.Version,
+	)...)
+	if err != nil {
+		return nil, err
+	}
+
+	o.Amount = money.New(amount, currency)
+
+	return &o, nil
+}
+
+// Insert records a new pending offer which expires after ttl.
+func (m OfferModel) Insert(offer *Offer, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO offers (car_id, buyer_id, seller_id, amount, currency, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, status, created_at, updated_at, version
+		`
+
+	offer.Expiry = time.Now().Add(ttl).Truncate(time.Second)
+	args := []interface{}{offer.CarID, offer.BuyerID, offer.SellerID, offer.Amount.Amount, offer.Amount.Currency.Code, offer.Expiry}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&offer.ID, &offer.Status, &offer.CreatedAt, &offer.UpdatedAt, &offer.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "offers_open_idx"`:
+			return ErrOpenOfferExists
+		default:
+			return err
+		}
+	}
+
+	err = insertOfferEvent(ctx, tx, offer, offer.BuyerID, OfferActionCreated)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Get returns an offer together with its history. If no matching offer is found an
+// ErrRecordNotFound error is returned.
+func (m OfferModel) Get(id int64) (*Offer, error) {
+	query := `SELECT ` + offerColumns + `
+		WHERE id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	offer, err := scanOffer(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	query = `
+		SELECT id, actor_id, action, amount, created_at
+		FROM offer_events
+		WHERE offer_id = $1
+		ORDER BY id
+		`
+
+	rows, err := m.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	for rows.Next() {
+		event := OfferEvent{Amount: offer.Amount}
+
+		err := rows.Scan(&event.ID, &event.ActorID, &event.Action, &event.Amount.Amount, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		offer.Events = append(offer.Events, &event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return offer, nil
+}
+
+// GetAcceptedForCar returns the accepted offer for a car, if any. If there is none an
+// ErrRecordNotFound error is returned.
+func (m OfferModel) GetAcceptedForCar(carID int) (*Offer, error) {
+	query := `SELECT ` + offerColumns + `
+		WHERE car_id = $1 AND status = 'accepted'
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	offer, err := scanOffer(m.DB.QueryRowContext(ctx, query, carID))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return offer, nil
+}
+
+// GetAllForUser returns a page of the offers the user made or received, most recently updated
+// first.
+func (m OfferModel) GetAllForUser(userID int64, filter OfferFilter, filters Filters) ([]*Offer, Metadata, error) {
+	query := `SELECT count(*) OVER(), ` + offerColumns + `
+		WHERE ((buyer_id = $1 AND $2 IN ('', 'buyer')) OR (seller_id = $1 AND $2 IN ('', 'seller')))
+			AND (car_id = $3 OR $3 = 0)
+			AND (CASE WHEN status IN ('pending', 'countered') AND expiry <= NOW() THEN 'expired' ELSE status END = $4 OR $4 = '')
+		ORDER BY updated_at DESC, id DESC
+		LIMIT $5 OFFSET $6
+		`
+
+	args := []interface{}{userID, filter.Role, filter.CarID, filter.Status, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	totalRecords := 0
+	offers := []*Offer{}
+
+	for rows.Next() {
+		offer, err := scanOffer(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		offers = append(offers, offer)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return offers, metadata, nil
+}
+
+// GetAllInvolving returns every offer the user made or received. It is used for personal data
+// exports.
+func (m OfferModel) GetAllInvolving(userID int64) ([]*Offer, error) {
+	query := `SELECT ` + offerColumns + `
+		WHERE buyer_id = $1 OR seller_id = $1
+		ORDER BY id
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	offers := []*Offer{}
+
+	for rows.Next() {
+		offer, err := scanOffer(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		offers = append(offers, offer)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return offers, nil
+}
+
+// Counter replaces the amount of an open offer and hands the turn to the other participant. The
+// expiry is extended by ttl, so that they have the full time to respond. The amount must be in
+// the offer's currency.
+func (m OfferModel) Counter(offer *Offer, actorID int64, amount money.Money, ttl time.Duration) error {
+	status := OfferStatusCountered
+	if actorID == offer.BuyerID {
+		status = OfferStatusPending
+	}
+
+	return m.respond(offer, actorID, status, OfferActionCountered, amount, time.Now().Add(ttl).Truncate(time.Second))
+}
+
+// Reject closes an open offer on behalf of the participant whose turn it is.
+func (m OfferModel) Reject(offer *Offer, actorID int64) error {
+	return m.respond(offer, actorID, OfferStatusRejected, OfferActionRejected, offer.Amount, offer.Expiry)
+}
+
+// Withdraw closes an open offer on behalf of the buyer.
+func (m OfferModel) Withdraw(offer *Offer, actorID int64) error {
+	return m.respond(offer, actorID, OfferStatusWithdrawn, OfferActionWithdrawn, offer.Amount, offer.Expiry)
+}
+
+func (m OfferModel) respond(offer *Offer, actorID int64, status, action string, amount money.Money, expiry time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = updateOffer(ctx, tx, offer, actorID, status, action, amount, expiry)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Accept closes an open offer on behalf of the participant whose turn it is and reserves the car
+// for the buyer. Any other open offers for the car are rejected. If the car has already been
+// reserved or sold an ErrCarNotAvailable error is returned.
+func (m OfferModel) Accept(offer *Offer, actorID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the car, so that two offers for it can't be accepted at the same time.
+	var carStatus string
+
+	err = tx.QueryRowContext(ctx, `SELECT status FROM cars WHERE id = $1 FOR UPDATE`, offer.CarID).Scan(&carStatus)
+	if err != nil {
+		return err
+	}
+
+	if carStatus != CarStatusAvailable {
+		return ErrCarNotAvailable
+	}
+
+	err = updateOffer(ctx, tx, offer, actorID, OfferStatusAccepted, OfferActionAccepted, offer.Amount, offer.Expiry)
+	if err != nil {
+		if err.Error() == `pq: duplicate key value violates unique constraint "offers_accepted_idx"` {
+			return ErrCarNotAvailable
+		}
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE cars SET status = $1 WHERE id = $2`, CarStatusReserved, offer.CarID)
+	if err != nil {
+		return err
+	}
+
+	err = rejectOpenOffers(ctx, tx, offer.CarID, offer.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// rejectOpenOffers rejects every open offer for a car except exceptID, once the car has been
+// reserved for someone. Pass 0 to reject them all.
+func rejectOpenOffers(ctx context.Context, tx *sql.Tx, carID int, exceptID int64) error {
+	query := `
+		WITH rejected AS (
+			UPDATE offers
+			SET status = 'rejected', updated_at = NOW(), version = version + 1
+			WHERE car_id = $1 AND id <> $2 AND status IN ('pending', 'countered')
+			RETURNING id, amount
+		)
+		INSERT INTO offer_events (offer_id, action, amount)
+		SELECT id, $3, amount FROM rejected
+		`
+
+	_, err := tx.ExecContext(ctx, query, carID, exceptID, OfferActionRejected)
+	return err
+}
+
+// ExpireStale marks open offers whose expiry has passed as expired, recording the step in their
+// history. It returns the number of expired offers.
+func (m OfferModel) ExpireStale() (int64, error) {
+	query := `
+		WITH expired AS (
+			UPDATE offers
+			SET status = 'expired', updated_at = NOW(), version = version + 1
+			WHERE status IN ('pending', 'countered') AND expiry <= NOW()
+			RETURNING id, amount
+		)
+		INSERT INTO offer_events (offer_id, action, amount)
+		SELECT id, $1, amount FROM expired
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, OfferActionExpired)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// updateOffer moves an open offer to a new status and records the step. It returns an
+// ErrEditConflict error if the offer has changed since it was read or has expired in the
+// meantime.
+func updateOffer(ctx context.Context, tx *sql.Tx, offer *Offer, actorID int64, status, action string, amount money.Money, expiry time.Time) error {
+	query := `
+		UPDATE offers
+		SET status = $1, amount = $2, expiry = $3, updated_at = NOW(), version = version + 1
+		WHERE id = $4 AND version = $5 AND status IN ('pending', 'countered') AND expiry > NOW()
+		RETURNING updated_at, version
+		`
+
+	args := []interface{}{status, amount.Amount, expiry, offer.ID, offer.Version}
+
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&offer.UpdatedAt, &offer.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	offer.Status = status
+	offer.Amount = amount
+	offer.Expiry = expiry
+
+	return insertOfferEvent(ctx, tx, offer, actorID, action)
+}
+
+func insertOfferEvent(ctx context.Context, tx *sql.Tx, offer *Offer, actorID int64, action string) error {
+	query := `
+		INSERT INTO offer_events (offer_id, actor_id, action, amount)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+		`
+
+	event := &OfferEvent{ActorID: &actorID, Action: action, Amount: offer.Amount}
+
+	err := tx.QueryRowContext(ctx, query, offer.ID, actorID, action, offer.Amount.Amount).Scan(&event.ID, &event.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	offer.Events = append(offer.Events, event)
+	return nil
+}
+
+func ValidateOfferAmount(v *validator.Validator, amount money.Money) {
+	validateAmount(v, "amount", amount)
+}
@@ -0,0 +1,619 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/balgabekj/go_car/pkg/money"
+)
+
+// Order statuses. An order is pending until its first payment succeeds. Orders paid by deposit
+// then wait for the balance; once everything is paid the order is completed and the car sold.
+const (
+	OrderStatusPending     = "pending"
+	OrderStatusDepositPaid = "deposit_paid"
+	OrderStatusCompleted   = "completed"
+	OrderStatusCancelled   = "cancelled"
+)
+
+// Payment types. Buyers pay either the full price at once, or a deposit first and the balance
+// later.
+const (
+	PaymentTypeFull    = "full"
+	PaymentTypeDeposit = "deposit"
+)
+
+// Payment statuses. They match the statuses reported by payment providers.
+const (
+	PaymentStatusPending   = "pending"
+	PaymentStatusSucceeded = "succeeded"
+	PaymentStatusFailed    = "failed"
+)
+
+var (
+	// ErrActiveOrderExists is returned when a car is ordered while another order for it is still
+	// being paid.
+	ErrActiveOrderExists = errors.New("active order exists")
+
+	// ErrDuplicateEvent is returned when a payment webhook event has already been processed.
+	ErrDuplicateEvent = errors.New("duplicate event")
+
+	// ErrPaymentInProgress is returned when a payment is started for an order which already has
+	// one in progress.
+	ErrPaymentInProgress = errors.New("payment in progress")
+)
+
+// Order is a buyer's purchase of a car. Car, Price and Deposit are a snapshot taken when the
+// order was placed, so later changes to the listing don't affect it. All amounts are in the
+// currency the order is paid in.
+type Order struct {
+	ID          int64       `json:"id"`
+	CarID       int         `json:"car_id"`
+	Car         string      `json:"car"`
+	BuyerID     int64       `json:"buyer_id"`
+	SellerID    int64       `json:"seller_id"`
+	Price       money.Money `json:"price"`
+	PaymentType string      `json:"payment_type"`
+	Deposit     money.Money `json:"deposit"`
+	AmountPaid  money.Money `json:"amount_paid"`
+	Balance     money.Money `json:"balance"`
+	Status      string      `json:"status"`
+	ReservedCar bool        `json:"-"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+	CompletedAt *time.Time  `json:"completed_at,omitempty"`
+	Version     int         `json:"version"`
+	Payments    []*Payment  `json:"payments,omitempty"`
+}
+
+// HasParticipant reports whether the user is the buyer or the seller. Participants whose account
+// has been deleted are stored as 0.
+func (o *Order) HasParticipant(userID int64) bool {
+	return userID != 0 && (o.BuyerID == userID || o.SellerID == userID)
+}
+
+// IsPayable reports whether the order is still waiting for a payment.
+func (o *Order) IsPayable() bool {
+	return o.Status == OrderStatusPending || o.Status == OrderStatusDepositPaid
+}
+
+// NextPaymentAmount returns the amount the buyer has to pay next: the deposit if nothing has been
+// paid on a deposit order yet, otherwise the balance.
+func (o *Order) NextPaymentAmount() money.Money {
+	if o.PaymentType == PaymentTypeDeposit && o.AmountPaid.Amount == 0 {
+		return o.Deposit
+	}
+	return o.Balance
+}
+
+// Payment is an attempt to pay (part of) an order through a payment provider. Reference is the
+// provider's ID for the payment.
+type Payment struct {
+	ID          int64       `json:"id"`
+	OrderID     int64       `json:"order_id"`
+	Provider    string      `json:"provider"`
+	Reference   string      `json:"reference"`
+	Amount      money.Money `json:"amount"`
+	Status      string      `json:"status"`
+	CheckoutURL string      `json:"checkout_url,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+}
+
+// OrderFilter holds the optional criteria for listing a user's orders. Role is "buyer", "seller"
+// or empty for both.
+type OrderFilter struct {
+	Role   string
+	Status string
+}
+
+type OrderModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// orderColumns selects an order as scanned by scanOrder.
+const orderColumns = `
+		id, COALESCE(car_id, 0), car, COALESCE(buyer_id, 0), COALESCE(seller_id, 0), price,
+		payment_type, deposit, amount_paid, currency, status, reserved_car, created_at, updated_at,
+		completed_at, version
+		FROM orders`
+
+func scanOrder(row scanner, dest ...interface{}) (*Order, error) {
+	var (
+		o                          Order
+		price, deposit, amountPaid int64
+		currency                   string
+	)
+
+	err := row.Scan(append(dest,
+		&o.ID,
+		&o.CarID,
+		&o.Car,
+		&o.BuyerID,
+		&o.SellerID,
+		&price,
+		&o.PaymentType,
+		&deposit,
+		&amountPaid,
+		&currency,
+		&o.Status,
+		&o.ReservedCar,
+		&o.CreatedAt,
+		&o.UpdatedAt,
+		&o.CompletedAt,
+		&o.Version,
+	)...)
+	if err != nil {
+		return nil, err
+	}
+
+	o.Price = money.New(price, currency)
+	o.Deposit = money.New(deposit, currency)
+	o.AmountPaid = money.New(amountPaid, currency)
+	o.Balance = money.New(price-amountPaid, currency)
+
+	return &o, nil
+}
+
+// paymentColumns selects a payment as scanned by scanPayment.
+const paymentColumns = `
+		id, order_id, provider, COALESCE(provider_payment_id, ''), amount, currency, status,
+		checkout_url, created_at, updated_at
+		FROM payments`
+
+func scanPayment(row scanner) (*Payment, error) {
+	var (
+		p        Payment
+		amount   int64
+		currency string
+	)
+
+	err := row.Scan(&p.ID, &p.OrderID, &p.Provider, &p.Reference, &amount, &currency, &p.Status, &p.CheckoutURL, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Amount = money.New(amount, currency)
+
+	return &p, nil
+}
+
+// Insert places a new pending order, in the currency of its price. If ReservedCar is set the car must still be available and
+// is reserved for the buyer; otherwise it must already have been reserved for them, by an
+// accepted offer or a won auction. An ErrCarNotAvailable error is returned if the car's status
+// has changed, and an ErrActiveOrderExists error if the car is already in an order.
+func (m OrderModel) Insert(order *Order) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var carStatus string
+
+	err = tx.QueryRowContext(ctx, `SELECT status FROM cars WHERE id = $1 FOR UPDATE`, order.CarID).Scan(&carStatus)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case order.ReservedCar && carStatus == CarStatusAvailable:
+		_, err = tx.ExecContext(ctx, `UPDATE cars SET status = $1 WHERE id = $2`, CarStatusReserved, order.CarID)
+		if err != nil {
+			return err
+		}
+	case !order.ReservedCar && carStatus == CarStatusReserved:
+	default:
+		return ErrCarNotAvailable
+	}
+
+	query := `
+		INSERT INTO orders (car_id, buyer_id, seller_id, car, price, payment_type, deposit, currency, reserved_car)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, status, created_at, updated_at, version
+		`
+
+	args := []interface{}{order.CarID, order.BuyerID, order.SellerID, order.Car, order.Price.Amount, order.PaymentType, order.Deposit.Amount, order.Price.Currency.Code, order.ReservedCar}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&order.ID, &order.Status, &order.CreatedAt, &order.UpdatedAt, &order.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "orders_active_idx"`:
+			return ErrActiveOrderExists
+		default:
+			return err
+		}
+	}
+
+	order.AmountPaid = money.Money{Currency: order.Price.Currency}
+	order.Balance = order.Price
+
+	return tx.Commit()
+}
+
+// Get returns an order together with its payments. If no matching order is found an
+// ErrRecordNotFound error is returned.
+func (m OrderModel) Get(id int64) (*Order, error) {
+	query := `SELECT ` + orderColumns + `
+		WHERE id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	order, err := scanOrder(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	query = `SELECT ` + paymentColumns + `
+		WHERE order_id = $1
+		ORDER BY id
+		`
+
+	rows, err := m.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		order.Payments = append(order.Payments, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+// GetAllForUser returns a page of the orders the user placed or received, most recent first.
+func (m OrderModel) GetAllForUser(userID int64, filter OrderFilter, filters Filters) ([]*Order, Metadata, error) {
+	query := `SELECT count(*) OVER(), ` + orderColumns + `
+		WHERE ((buyer_id = $1 AND $2 IN ('', 'buyer')) OR (seller_id = $1 AND $2 IN ('', 'seller')))
+			AND (status = $3 OR $3 = '')
+		ORDER BY created_at DESC, id DESC
+		LIMIT $4 OFFSET $5
+		`
+
+	args := []interface{}{userID, filter.Role, filter.Status, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	totalRecords := 0
+	orders := []*Order{}
+
+	for rows.Next() {
+		order, err := scanOrder(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		orders = append(orders, order)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return orders, metadata, nil
+}
+
+// GetAllInvolving returns every order the user placed or received. It is used for personal data
+// exports.
+func (m OrderModel) GetAllInvolving(userID int64) ([]*Order, error) {
+	query := `SELECT ` + orderColumns + `
+		WHERE buyer_id = $1 OR seller_id = $1
+		ORDER BY id
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	orders := []*Order{}
+
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		orders = append(orders, order)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return orders, nil
+}
+
+// Cancel calls off an order on which nothing has been paid yet. If the order reserved the car,
+// the car becomes available again. It returns an ErrEditConflict error if the order has changed
+// since it was read, e.g. because a payment came in.
+func (m OrderModel) Cancel(order *Order) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE orders
+		SET status = 'cancelled', updated_at = NOW(), version = version + 1
+		WHERE id = $1 AND version = $2 AND status = 'pending'
+		RETURNING updated_at, version
+		`
+
+	err = tx.QueryRowContext(ctx, query, order.ID, order.Version).Scan(&order.UpdatedAt, &order.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	if order.ReservedCar && order.CarID != 0 {
+		query = `
+			UPDATE cars
+			SET status = $1
+			WHERE id = $2 AND status = $3
+			`
+
+		_, err = tx.ExecContext(ctx, query, CarStatusAvailable, order.CarID, CarStatusReserved)
+		if err != nil {
+			return err
+		}
+	}
+
+	order.Status = OrderStatusCancelled
+
+	return tx.Commit()
+}
+
+// InsertPayment records a pending payment for an order, before it is created at the provider.
+// The amount must be in the order's currency.
+// Only one payment per order can be pending, so if there already is one an ErrPaymentInProgress
+// error is returned. A pending payment which never got a reference from the provider within
+// a minute was lost, e.g. in a crash, and is failed to make way for the new one.
+func (m OrderModel) InsertPayment(p *Payment) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		UPDATE payments
+		SET status = $1, updated_at = NOW()
+		WHERE order_id = $2 AND status = $3 AND provider_payment_id IS NULL
+			AND created_at < NOW() - INTERVAL '1 minute'
+		`
+
+	_, err := m.DB.ExecContext(ctx, query, PaymentStatusFailed, p.OrderID, PaymentStatusPending)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		INSERT INTO payments (order_id, provider, amount, currency)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, status, created_at, updated_at
+		`
+
+	err = m.DB.QueryRowContext(ctx, query, p.OrderID, p.Provider, p.Amount.Amount, p.Amount.Currency.Code).Scan(&p.ID, &p.Status, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "payments_pending_idx"`:
+			return ErrPaymentInProgress
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UpdatePayment saves the provider's reference, checkout URL and status for a payment.
+func (m OrderModel) UpdatePayment(p *Payment) error {
+	query := `
+		UPDATE payments
+		SET provider_payment_id = NULLIF($1, ''), checkout_url = $2, status = $3, updated_at = NOW()
+		WHERE id = $4
+		RETURNING updated_at
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, p.Reference, p.CheckoutURL, p.Status, p.ID).Scan(&p.UpdatedAt)
+}
+
+// ApplyPaymentEvent processes a payment status callback from a provider. Events are recorded by
+// their ID, so a redelivered event returns an ErrDuplicateEvent error without changing anything.
+// Events for a payment which has already succeeded or failed are recorded but otherwise ignored.
+//
+// When a payment succeeds it is added to the amount paid; once the full price has been paid the
+// order is completed and the car marked as sold. Payments for an order which is no longer
+// payable, e.g. one cancelled while the buyer was at the checkout, don't change the order and
+// have to be refunded by hand. If the payment is unknown an ErrRecordNotFound error is returned.
+func (m OrderModel) ApplyPaymentEvent(provider, eventID, reference, status string) (*Order, *Payment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT ` + paymentColumns + `
+		WHERE provider = $1 AND provider_payment_id = $2
+		FOR UPDATE
+		`
+
+	p, err := scanPayment(tx.QueryRowContext(ctx, query, provider, reference))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	query = `
+		INSERT INTO payment_events (provider, event_id, payment_id, status)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT DO NOTHING
+		`
+
+	result, err := tx.ExecContext(ctx, query, provider, eventID, p.ID, status)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if rows == 0 {
+		return nil, nil, ErrDuplicateEvent
+	}
+
+	query = `SELECT ` + orderColumns + `
+		WHERE id = $1
+		FOR UPDATE
+		`
+
+	order, err := scanOrder(tx.QueryRowContext(ctx, query, p.OrderID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if p.Status != PaymentStatusPending || status == PaymentStatusPending {
+		return order, p, tx.Commit()
+	}
+
+	query = `
+		UPDATE payments
+		SET status = $1, updated_at = NOW()
+		WHERE id = $2
+		RETURNING updated_at
+		`
+
+	err = tx.QueryRowContext(ctx, query, status, p.ID).Scan(&p.UpdatedAt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.Status = status
+
+	if status != PaymentStatusSucceeded || !order.IsPayable() {
+		return order, p, tx.Commit()
+	}
+
+	paid := order.AmountPaid.Amount + p.Amount.Amount
+
+	order.AmountPaid.Amount = paid
+	order.Balance.Amount = order.Price.Amount - paid
+	order.Status = OrderStatusDepositPaid
+	if paid >= order.Price.Amount {
+		order.Status = OrderStatusCompleted
+	}
+
+	query = `
+		UPDATE orders
+		SET amount_paid = $1, status = $2, updated_at = NOW(), version = version + 1,
+			completed_at = CASE WHEN $2 = 'completed' THEN NOW() END
+		WHERE id = $3
+		RETURNING updated_at, completed_at, version
+		`
+
+	err = tx.QueryRowContext(ctx, query, order.AmountPaid.Amount, order.Status, order.ID).Scan(&order.UpdatedAt, &order.CompletedAt, &order.Version)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if order.Status == OrderStatusCompleted && order.CarID != 0 {
+		_, err = tx.ExecContext(ctx, `UPDATE cars SET status = $1 WHERE id = $2`, CarStatusSold, order.CarID)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return order, p, tx.Commit()
+}
+
+// GetPendingPayment returns the payment of an order which is still waiting for the buyer, if
+// any. If there is none an ErrRecordNotFound error is returned. A payment which is still being
+// created at the provider has no reference yet.
+func (m OrderModel) GetPendingPayment(orderID int64) (*Payment, error) {
+	query := `SELECT ` + paymentColumns + `
+		WHERE order_id = $1 AND status = 'pending'
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	p, err := scanPayment(m.DB.QueryRowContext(ctx, query, orderID))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
@@ -0,0 +1,147 @@
+package model
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PermissionCache is an in-process cache of effective permissions keyed by user id. Entries
+// expire after the TTL, and are dropped explicitly whenever a user's direct permissions or roles
+// change, so a stale entry can only survive a change made by another instance of the API. A nil
+// *PermissionCache is valid and caches nothing.
+//
+// Permissions read from the database can already be stale by the time they are cached, if they
+// were invalidated in between. To catch that, callers take the user's Generation before reading
+// and pass it to Set, which ignores the permissions if the generation has moved on since.
+type PermissionCache struct {
+	ttl     time.Duration
+	mu      sync.RWMutex
+	entries map[int64]permissionCacheEntry
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+
+	// epoch counts purges, and invalidations counts the invalidations of each user since the
+	// last purge.
+	epoch         uint64
+	invalidations map[int64]uint64
+}
+
+// PermissionGeneration identifies the state of a user's cached permissions, see Generation.
+type PermissionGeneration struct {
+	epoch        uint64
+	invalidation uint64
+}
+
+type permissionCacheEntry struct {
+	permissions Permissions
+	expires     time.Time
+}
+
+// NewPermissionCache returns a cache whose entries live for ttl. A ttl of zero or less disables
+// caching and returns nil.
+func NewPermissionCache(ttl time.Duration) *PermissionCache {
+	if ttl <= 0 {
+		return nil
+	}
+
+	return &PermissionCache{
+		ttl:           ttl,
+		entries:       make(map[int64]permissionCacheEntry),
+		invalidations: make(map[int64]uint64),
+	}
+}
+
+// Get returns a copy of the cached permissions for the user, if there is an unexpired entry.
+func (c *PermissionCache) Get(userID int64) (Permissions, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.RLock()
+	entry, ok := c.entries[userID]
+	c.mu.RUnlock()
+
+	if !ok || time.Now().After(entry.expires) {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	c.hits.Add(1)
+	return slices.Clone(entry.permissions), true
+}
+
+// Generation returns the user's current generation, to pass to Set.
+func (c *PermissionCache) Generation(userID int64) PermissionGeneration {
+	if c == nil {
+		return PermissionGeneration{}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return PermissionGeneration{epoch: c.epoch, invalidation: c.invalidations[userID]}
+}
+
+// Set stores a copy of the permissions for the user, unless they were invalidated after the
+// given generation was taken.
+func (c *PermissionCache) Set(userID int64, generation PermissionGeneration, permissions Permissions) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != (PermissionGeneration{epoch: c.epoch, invalidation: c.invalidations[userID]}) {
+		return
+	}
+
+	// Expired entries are only removed when they're overwritten, so clear them out now and then
+	// to stop users who never come back from piling up.
+	if len(c.entries) >= 10_000 {
+		now := time.Now()
+		for id, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, id)
+			}
+		}
+	}
+
+	c.entries[userID] = permissionCacheEntry{permissions: slices.Clone(permissions), expires: time.Now().Add(c.ttl)}
+}
+
+// Invalidate drops the cached permissions for a single user.
+func (c *PermissionCache) Invalidate(userID int64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	delete(c.entries, userID)
+	c.invalidations[userID]++
+	c.mu.Unlock()
+}
+
+// Purge drops every cached entry. It is used when a role's permissions change, since that can
+// affect any number of users.
+func (c *PermissionCache) Purge() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.entries = make(map[int64]permissionCacheEntry)
+	c.invalidations = make(map[int64]uint64)
+	c.epoch++
+	c.mu.Unlock()
+}
+
+// Stats returns the number of cache hits and misses so far.
+func (c *PermissionCache) Stats() (hits, misses uint64) {
+	if c == nil {
+		return 0, 0
+	}
+	return c.hits.Load(), c.misses.Load()
+}
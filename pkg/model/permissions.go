@@ -27,16 +27,30 @@ type PermissionModel struct {
 	DB       *sql.DB
 	InfoLog  *log.Logger
 	ErrorLog *log.Logger
+	Cache    *PermissionCache
 }
 
-// GetAllForUser returns all permission codes for a specific user in a Permissions slice.
+// GetAllForUser returns the effective permission codes for a specific user in a Permissions
+// slice: the codes granted to the user directly plus those bundled in any of the user's roles.
+// Results are served from the permission cache when possible.
 func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	if permissions, ok := m.Cache.Get(userID); ok {
+		return permissions, nil
+	}
+
+	generation := m.Cache.Generation(userID)
+
 	query := `
 		SELECT permissions.code
 		FROM permissions
 			INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-			INNER JOIN users ON users_permissions.user_id = users.id
-		WHERE users.id = $1
+		WHERE users_permissions.user_id = $1
+		UNION
+		SELECT permissions.code
+		FROM permissions
+			INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+			INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+		WHERE users_roles.user_id = $1
 		`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -69,6 +83,8 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 		return nil, err
 	}
 
+	m.Cache.Set(userID, generation, permissions)
+
 	return permissions, nil
 }
 
@@ -77,39 +93,112 @@ func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	query := `
 		INSERT INTO users_permissions
 		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	if err != nil {
+		return err
+	}
+
+	m.Cache.Invalidate(userID)
+	return nil
+}
+
+// RemoveForUser takes the provided codes away from a specific user. Codes the user gets through a
+// role are not affected.
+func (m PermissionModel) RemoveForUser(userID int64, codes ...string) error {
+	query := `
+		DELETE FROM users_permissions
+		USING permissions
+		WHERE users_permissions.permission_id = permissions.id
+			AND users_permissions.user_id = $1
+			AND permissions.code = ANY($2)
 		`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
-	return err
+	if err != nil {
+		return err
+	}
+
+	m.Cache.Invalidate(userID)
+	return nil
 }
 
-func (m PermissionModel) CheckPermission(userID int64, requiredPermissionID int) (bool, error) {
-	var permissionID int
-	query := ` 
-  SELECT permission_id 
-  FROM users_permissions 
-  WHERE user_id = $1 
-    `
+// GetAllCodes returns every permission code known to the system.
+func (m PermissionModel) GetAllCodes() (Permissions, error) {
+	query := `
+		SELECT code
+		FROM permissions
+		ORDER BY code
+		`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&permissionID)
+	rows, err := m.DB.QueryContext(ctx, query)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return false, nil // No permission found for the user
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
 		}
-		m.ErrorLog.Printf("Error checking permission: %v", err)
-		return false, err
+	}()
+
+	var codes Permissions
+
+	for rows.Next() {
+		var code string
+
+		if err := rows.Scan(&code); err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, code)
 	}
 
-	// Check if the user has the required permission
-	if permissionID == requiredPermissionID {
-		return true, nil // User has the required permission
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// CheckPermission reports whether the user effectively has the permission code, either directly
+// or through one of their roles.
+func (m PermissionModel) CheckPermission(userID int64, code string) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM users_permissions
+				INNER JOIN permissions ON permissions.id = users_permissions.permission_id
+			WHERE users_permissions.user_id = $1 AND permissions.code = $2
+			UNION ALL
+			SELECT 1
+			FROM users_roles
+				INNER JOIN roles_permissions ON roles_permissions.role_id = users_roles.role_id
+				INNER JOIN permissions ON permissions.id = roles_permissions.permission_id
+			WHERE users_roles.user_id = $1 AND permissions.code = $2
+		)
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var ok bool
+
+	err := m.DB.QueryRowContext(ctx, query, userID, code).Scan(&ok)
+	if err != nil {
+		m.ErrorLog.Printf("Error checking permission: %v", err)
+		return false, err
 	}
 
-	return false, nil // User does not have the required permission
+	return ok, nil
 }
@@ -0,0 +1,215 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/balgabekj/go_car/pkg/money"
+	"github.com/balgabekj/go_car/pkg/validator"
+)
+
+// ErrNoExchangeRate is returned when there is no rate to convert between two currencies.
+var ErrNoExchangeRate = errors.New("no exchange rate")
+
+// RateTable is a set of exchange rates against a base currency, in the form most central banks
+// publish them: Rates holds the price of one unit of Base in each other currency. Rates are
+// decimal numbers, kept as they were written so that no precision is lost.
+type RateTable struct {
+	Base  string                 `json:"base"`
+	Rates map[string]json.Number `json:"rates"`
+}
+
+// ExchangeRate is the stored rate of a currency against the base of the last rate table loaded.
+type ExchangeRate struct {
+	Currency  string      `json:"currency"`
+	Rate      json.Number `json:"rate"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+func ValidateRateTable(v *validator.Validator, t *RateTable) {
+	_, ok := money.LookupCurrency(t.Base)
+	v.Check(ok, "base", "must be a supported ISO 4217 currency code")
+	v.Check(len(t.Rates) > 0, "rates", "must contain at least one rate")
+
+	for code, rate := range t.Rates {
+		_, ok := money.LookupCurrency(code)
+		v.Check(ok, "rates", "must only contain supported ISO 4217 currency codes")
+		v.Check(code != t.Base, "rates", "must not contain the base currency")
+
+		r, ok := new(big.Rat).SetString(rate.String())
+		v.Check(ok && r.Sign() > 0, "rates", "must be positive numbers")
+	}
+}
+
+type ExchangeRateModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// Replace replaces all stored rates with those of the table. Rates are only comparable against
+// the same base, so rates missing from the table are removed rather than kept.
+func (m ExchangeRateModel) Replace(t *RateTable) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM exchange_rates`)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO exchange_rates (currency, exponent, rate)
+		VALUES ($1, $2, $3)
+		`
+
+	rates := map[string]json.Number{t.Base: "1"}
+	for code, rate := range t.Rates {
+		rates[code] = rate
+	}
+
+	for code, rate := range rates {
+		currency, _ := money.LookupCurrency(code)
+
+		_, err = tx.ExecContext(ctx, query, code, currency.Exponent, rate.String())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetAll returns all stored rates, ordered by currency code.
+func (m ExchangeRateModel) GetAll() ([]*ExchangeRate, error) {
+	query := `
+		SELECT currency, rate, updated_at
+		FROM exchange_rates
+		ORDER BY currency
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	rates := []*ExchangeRate{}
+
+	for rows.Next() {
+		var rate ExchangeRate
+
+		err := rows.Scan(&rate.Currency, &rate.Rate, &rate.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		rates = append(rates, &rate)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rates, nil
+}
+
+// GetRates returns all stored rates, for converting many amounts at once.
+func (m ExchangeRateModel) GetRates() (money.Rates, error) {
+	query := `
+		SELECT currency, rate::text
+		FROM exchange_rates
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	rates := money.Rates{}
+
+	for rows.Next() {
+		var currency, rate string
+
+		err := rows.Scan(&currency, &rate)
+		if err != nil {
+			return nil, err
+		}
+
+		r, ok := new(big.Rat).SetString(rate)
+		if !ok {
+			return nil, fmt.Errorf("invalid exchange rate %q for %s", rate, currency)
+		}
+
+		rates[currency] = r
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rates, nil
+}
+
+// Convert converts an amount to another currency at the stored rates. If either currency has
+// no rate an ErrNoExchangeRate error is returned.
+func (m ExchangeRateModel) Convert(amount money.Money, to money.Currency) (money.Money, error) {
+	if amount.Currency.Code == to.Code {
+		return amount, nil
+	}
+
+	query := `
+		SELECT f.rate::text, t.rate::text
+		FROM exchange_rates f, exchange_rates t
+		WHERE f.currency = $1 AND t.currency = $2
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var from, rate string
+
+	err := m.DB.QueryRowContext(ctx, query, amount.Currency.Code, to.Code).Scan(&from, &rate)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return money.Money{}, ErrNoExchangeRate
+		default:
+			return money.Money{}, err
+		}
+	}
+
+	// Both rates are against the same base, so one unit of the amount's currency is worth
+	// rate / from units of the other.
+	fromRat, _ := new(big.Rat).SetString(from)
+	rateRat, _ := new(big.Rat).SetString(rate)
+
+	return amount.Convert(to, rateRat.Quo(rateRat, fromRat)), nil
+}
@@ -0,0 +1,341 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/balgabekj/go_car/pkg/validator"
+)
+
+// Test drive statuses. A requested test drive waits for the participant who didn't propose the
+// slot to confirm it. Rescheduling proposes a new slot, which puts the booking back to requested.
+const (
+	TestDriveStatusRequested = "requested"
+	TestDriveStatusConfirmed = "confirmed"
+	TestDriveStatusCancelled = "cancelled"
+)
+
+// ErrSlotTaken is returned when a test drive would overlap another booking of the same car or
+// with the same seller. The check is done by exclusion constraints in the database, so it also
+// holds when two buyers book at the same moment.
+var ErrSlotTaken = errors.New("slot taken")
+
+// TestDrive is a buyer's booking to drive a car. Car and Location are taken from the listing and
+// the seller's profile, so they can be shown without further lookups.
+type TestDrive struct {
+	ID         int64     `json:"id"`
+	CarID      int       `json:"car_id"`
+	Car        string    `json:"car"`
+	BuyerID    int64     `json:"buyer_id"`
+	SellerID   int64     `json:"seller_id"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Location   string    `json:"location"`
+	Status     string    `json:"status"`
+	ProposedBy int64     `json:"proposed_by"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	Version    int       `json:"version"`
+}
+
+// HasParticipant reports whether the user is the buyer or the seller.
+func (td *TestDrive) HasParticipant(userID int64) bool {
+	return td.BuyerID == userID || td.SellerID == userID
+}
+
+// AwaitingConfirmationFrom returns the ID of the participant who has to confirm the proposed
+// slot, or 0 if the test drive isn't waiting for confirmation.
+func (td *TestDrive) AwaitingConfirmationFrom() int64 {
+	if td.Status != TestDriveStatusRequested {
+		return 0
+	}
+
+	if td.ProposedBy == td.BuyerID {
+		return td.SellerID
+	}
+
+	return td.BuyerID
+}
+
+// Slot is a period in which a car or seller is already booked.
+type Slot struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// TestDriveFilter holds the optional criteria for listing a user's test drives. Role is "buyer",
+// "seller" or empty for both, and Upcoming leaves out test drives which have already ended.
+type TestDriveFilter struct {
+	Role     string
+	CarID    int
+	Status   string
+	Upcoming bool
+}
+
+type TestDriveModel struct {
+	DB       *sql.DB
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
+
+// testDriveColumns selects a test drive as scanned by scanTestDrive.
+const testDriveColumns = `
+		td.id, td.car_id, c.brand || ' ' || c.model, td.buyer_id, td.seller_id,
+		lower(td.slot), upper(td.slot), s.location, td.status, td.proposed_by,
+		td.created_at, td.updated_at, td.version
+		FROM test_drives td
+		INNER JOIN cars c ON c.id = td.car_id
+		INNER JOIN users s ON s.id = td.seller_id`
+
+func scanTestDrive(row scanner, dest ...interface{}) (*TestDrive, error) {
+	var td TestDrive
+
+	err := row.Scan(append(dest,
+		&td.ID,
+		&td.CarID,
+		&td.Car,
+		&td.BuyerID,
+		&td.SellerID,
+		&td.Start,
+		&td.End,
+		&td.Location,
+		&td.Status,
+		&td.ProposedBy,
+		&td.CreatedAt,
+		&td.UpdatedAt,
+		&td.Version,
+	)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &td, nil
+}
+
+// slotError translates a violation of the exclusion constraints into ErrSlotTaken.
+func slotError(err error) error {
+	switch err.Error() {
+	case `pq: conflicting key value violates exclusion constraint "test_drives_car_slot_excl"`,
+		`pq: conflicting key value violates exclusion constraint "test_drives_seller_slot_excl"`:
+		return ErrSlotTaken
+	default:
+		return err
+	}
+}
+
+// Insert records a new requested test drive, proposed by the buyer. The slot includes its start
+// and excludes its end, so back-to-back bookings don't overlap.
+func (m TestDriveModel) Insert(td *TestDrive) error {
+	query := `
+		INSERT INTO test_drives (car_id, buyer_id, seller_id, slot, proposed_by)
+		VALUES ($1, $2, $3, tstzrange($4, $5, '[)'), $6)
+		RETURNING id, status, created_at, updated_at, version
+		`
+
+	args := []interface{}{td.CarID, td.BuyerID, td.SellerID, td.Start, td.End, td.ProposedBy}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&td.ID, &td.Status, &td.CreatedAt, &td.UpdatedAt, &td.Version)
+	if err != nil {
+		return slotError(err)
+	}
+
+	return nil
+}
+
+// Get returns a test drive. If no matching test drive is found an ErrRecordNotFound error is
+// returned.
+func (m TestDriveModel) Get(id int64) (*TestDrive, error) {
+	query := `SELECT ` + testDriveColumns + `
+		WHERE td.id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	td, err := scanTestDrive(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return td, nil
+}
+
+// GetAllForUser returns a page of the test drives the user booked or hosts, soonest first.
+func (m TestDriveModel) GetAllForUser(userID int64, filter TestDriveFilter, filters Filters) ([]*TestDrive, Metadata, error) {
+	query := `SELECT count(*) OVER(), ` + testDriveColumns + `
+		WHERE ((td.buyer_id = $1 AND $2 IN ('', 'buyer')) OR (td.seller_id = $1 AND $2 IN ('', 'seller')))
+			AND (td.car_id = $3 OR $3 = 0)
+			AND (td.status = $4 OR $4 = '')
+			AND (upper(td.slot) > NOW() OR NOT $5)
+		ORDER BY lower(td.slot), td.id
+		LIMIT $6 OFFSET $7
+		`
+
+	args := []interface{}{userID, filter.Role, filter.CarID, filter.Status, filter.Upcoming, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	totalRecords := 0
+	testDrives := []*TestDrive{}
+
+	for rows.Next() {
+		td, err := scanTestDrive(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		testDrives = append(testDrives, td)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return testDrives, metadata, nil
+}
+
+// GetAllInvolving returns every test drive the user booked or hosts that ended after since. A
+// zero since returns them all, as used for personal data exports.
+func (m TestDriveModel) GetAllInvolving(userID int64, since time.Time) ([]*TestDrive, error) {
+	query := `SELECT ` + testDriveColumns + `
+		WHERE (td.buyer_id = $1 OR td.seller_id = $1) AND upper(td.slot) > $2
+		ORDER BY lower(td.slot), td.id
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	testDrives := []*TestDrive{}
+
+	for rows.Next() {
+		td, err := scanTestDrive(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		testDrives = append(testDrives, td)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return testDrives, nil
+}
+
+// GetBusySlots returns the booked slots between from and to which would prevent a test drive of
+// the car, because either the car or its seller is busy.
+func (m TestDriveModel) GetBusySlots(carID int, sellerID int64, from, to time.Time) ([]Slot, error) {
+	query := `
+		SELECT lower(slot), upper(slot)
+		FROM test_drives
+		WHERE (car_id = $1 OR seller_id = $2)
+			AND status <> 'cancelled'
+			AND slot && tstzrange($3, $4, '[)')
+		ORDER BY lower(slot)
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, carID, sellerID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	slots := []Slot{}
+
+	for rows.Next() {
+		var slot Slot
+
+		if err := rows.Scan(&slot.Start, &slot.End); err != nil {
+			return nil, err
+		}
+
+		slots = append(slots, slot)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return slots, nil
+}
+
+// Update saves a change of slot, status or proposer. It returns an ErrEditConflict error if the
+// test drive has changed since it was read or has been cancelled, and an ErrSlotTaken error if
+// the new slot overlaps another booking.
+func (m TestDriveModel) Update(td *TestDrive) error {
+	query := `
+		UPDATE test_drives
+		SET slot = tstzrange($1, $2, '[)'), status = $3, proposed_by = $4, updated_at = NOW(), version = version + 1
+		WHERE id = $5 AND version = $6 AND status <> 'cancelled'
+		RETURNING updated_at, version
+		`
+
+	args := []interface{}{td.Start, td.End, td.Status, td.ProposedBy, td.ID, td.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&td.UpdatedAt, &td.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return slotError(err)
+		}
+	}
+
+	return nil
+}
+
+// ValidateTestDriveSlot checks a proposed slot. Durations are whole minutes between 15 minutes
+// and 3 hours, and bookings can be made up to 90 days ahead.
+func ValidateTestDriveSlot(v *validator.Validator, start time.Time, durationMinutes int) {
+	v.Check(!start.IsZero(), "start", "must be provided")
+	v.Check(start.After(time.Now()), "start", "must be in the future")
+	v.Check(start.Before(time.Now().AddDate(0, 0, 90)), "start", "must be within the next 90 days")
+	v.Check(durationMinutes >= 15, "duration_minutes", "must be at least 15")
+	v.Check(durationMinutes <= 180, "duration_minutes", "must not be more than 180")
+}
@@ -6,6 +6,8 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"encoding/hex"
+	"errors"
 	"github.com/balgabekj/go_car/pkg/validator"
 	"log"
 	"time"
@@ -15,8 +17,16 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+	ScopeEmailChange    = "email-change"
+	ScopeCalendar       = "calendar"
 )
 
+// ErrTokenReused is returned when a refresh token that has already been exchanged is presented
+// again. This usually means the token was stolen, so the whole token family is revoked.
+var ErrTokenReused = errors.New("refresh token reused")
+
 type (
 	// Token represents a token record in our tokens table.
 	// Note, it includes plaintext and hashed version of the token.
@@ -26,6 +36,24 @@ type (
 		UserID    int64     `json:"-"`
 		Expiry    time.Time `json:"expiry"`
 		Scope     string    `json:"-"`
+		UserAgent string    `json:"-"`
+		IP        string    `json:"-"`
+		Family    string    `json:"-"`
+	}
+
+	// Session describes an active login without exposing the token itself, so
+	// that users can see where they are logged in and revoke individual sessions.
+	// The id is the session's token family, which stays the same when its refresh
+	// token is rotated.
+	Session struct {
+		ID         string     `json:"id,omitempty"`
+		Scope      string     `json:"scope,omitempty"`
+		CreatedAt  time.Time  `json:"created_at"`
+		LastUsedAt *time.Time `json:"last_used_at"`
+		Expiry     time.Time  `json:"expiry"`
+		UserAgent  string     `json:"user_agent"`
+		IP         string     `json:"ip"`
+		Current    bool       `json:"current"`
 	}
 
 	// TokenModel struct wraps a sql.DB connection pool and allows us to work with the Token struct
@@ -49,19 +77,152 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 
 }
 
-// Insert inserts a new token record into the tokens table.
-func (m TokenModel) Insert(token *Token) error {
+// NewSession starts a new login session for the user by creating a long-lived refresh token in a
+// freshly generated token family. Authentication tokens for the session are issued separately,
+// see NewAuthentication. The user agent and IP address of the client are recorded so the session
+// can be identified later.
+func (m TokenModel) NewSession(userID int64, refreshTTL time.Duration, userAgent, ip string) (*Token, error) {
+	family, err := generateFamily()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := generateToken(userID, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+
+	token.UserAgent = userAgent
+	token.IP = ip
+	token.Family = family
+
+	err = m.Insert(token)
+	return token, err
+}
+
+// NewAuthentication creates a new opaque authentication token belonging to the given session
+// family.
+func (m TokenModel) NewAuthentication(userID int64, family string, ttl time.Duration, userAgent, ip string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+
+	token.UserAgent = userAgent
+	token.IP = ip
+	token.Family = family
+
+	err = m.Insert(token)
+	return token, err
+}
+
+// Rotate exchanges a refresh token for a new one in the same family. The presented refresh token
+// is marked as used rather than deleted, so that if it is ever replayed we can detect it: in that
+// case every token in the family is revoked and ErrTokenReused is returned. Unknown or expired
+// refresh tokens return ErrRecordNotFound. The family's outstanding authentication tokens are
+// revoked too, since the client is about to be issued a new one.
+func (m TokenModel) Rotate(refreshPlaintext string, refreshTTL time.Duration, userAgent, ip string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(refreshPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES ($1, $2, $3, $4)
+		SELECT user_id, family, expiry, used_at
+		FROM tokens
+		WHERE hash = $1 AND scope = $2
+		FOR UPDATE
 		`
 
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+	var (
+		userID int64
+		family sql.NullString
+		expiry time.Time
+		usedAt sql.NullTime
+	)
+
+	err = tx.QueryRowContext(ctx, query, tokenHash[:], ScopeRefresh).Scan(&userID, &family, &expiry, &usedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if usedAt.Valid {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1`, family.String)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = tx.Commit(); err != nil {
+			return nil, err
+		}
+
+		return nil, ErrTokenReused
+	}
+
+	if !expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET used_at = NOW() WHERE hash = $1`, tokenHash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1 AND scope = $2`, family.String, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := generateToken(userID, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+
+	token.UserAgent = userAgent
+	token.IP = ip
+	token.Family = family.String
 
+	if err = insertToken(ctx, tx, token); err != nil {
+		return nil, err
+	}
+
+	return token, tx.Commit()
+}
+
+// Insert inserts a new token record into the tokens table.
+func (m TokenModel) Insert(token *Token) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
+	return insertToken(ctx, m.DB, token)
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx, so token inserts can take part in a
+// transaction when needed.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertToken(ctx context.Context, db execer, token *Token) error {
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, user_agent, ip, family)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))
+		`
+
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.UserAgent, token.IP, token.Family}
+
+	_, err := db.ExecContext(ctx, query, args...)
 	return err
 }
 
@@ -79,6 +240,248 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	return err
 }
 
+// RecordFailedAttempt counts a failed attempt at using the token with the given plaintext and
+// scope. Once maxAttempts is reached the token is deleted.
+func (m TokenModel) RecordFailedAttempt(scope, tokenPlaintext string, maxAttempts int) error {
+	query := `
+		UPDATE tokens
+		SET failed_attempts = failed_attempts + 1
+		WHERE hash = $1 AND scope = $2
+		RETURNING failed_attempts
+		`
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var attempts int
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], scope).Scan(&attempts)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil
+		default:
+			return err
+		}
+	}
+
+	if attempts < maxAttempts {
+		return nil
+	}
+
+	_, err = m.DB.ExecContext(ctx, `DELETE FROM tokens WHERE hash = $1`, tokenHash[:])
+	return err
+}
+
+// DeleteExpired deletes every token which has expired and returns the number of deleted tokens.
+func (m TokenModel) DeleteExpired() (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE expiry < $1
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// DeleteFamily deletes every token belonging to the given session family.
+func (m TokenModel) DeleteFamily(family string) error {
+	query := `
+		DELETE FROM tokens
+		WHERE family = $1
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, family)
+	return err
+}
+
+// DeleteSessionForPlaintext ends the session the given token belongs to. The token itself is
+// deleted along with every other token in its family, so the matching refresh token can't be
+// used to log back in.
+func (m TokenModel) DeleteSessionForPlaintext(tokenPlaintext string) error {
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1 OR family = (SELECT family FROM tokens WHERE hash = $1)
+		`
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:])
+	return err
+}
+
+// DeleteSession revokes a single session, identified by its token family, by deleting every
+// token in the family. The user id is part of the WHERE clause so that users can only revoke
+// their own sessions. If no matching session exists an ErrRecordNotFound error is returned.
+func (m TokenModel) DeleteSession(family string, userID int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE family = $1 AND user_id = $2
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, family, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetSessionsForUser returns the active sessions for a user, most recently used first. Each
+// session is represented by the unused, unexpired refresh token of its family. The current
+// session is identified either by its family, when known, or by the opaque authentication token
+// currentPlaintext the request was made with.
+func (m TokenModel) GetSessionsForUser(userID int64, currentPlaintext, currentFamily string) ([]*Session, error) {
+	query := `
+		SELECT family, created_at, last_used_at, expiry, user_agent, ip,
+			COALESCE(family = COALESCE(NULLIF($5, ''), (SELECT family FROM tokens WHERE hash = $4)), false)
+		FROM tokens
+		WHERE user_id = $1 AND scope = $2 AND expiry > $3 AND used_at IS NULL AND family IS NOT NULL
+		ORDER BY COALESCE(last_used_at, created_at) DESC, id DESC
+		`
+
+	currentHash := sha256.Sum256([]byte(currentPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, ScopeRefresh, time.Now(), currentHash[:], currentFamily)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.UserAgent,
+			&session.IP,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// GetAllForUser describes every token a user holds, of any scope and including expired and used
+// ones that haven't been cleaned up yet. It is used for personal data exports. Tokens which
+// belong to a login session carry the session's id.
+func (m TokenModel) GetAllForUser(userID int64) ([]*Session, error) {
+	query := `
+		SELECT COALESCE(family, ''), scope, created_at, last_used_at, expiry, user_agent, ip
+		FROM tokens
+		WHERE user_id = $1
+		ORDER BY id
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	tokens := []*Session{}
+
+	for rows.Next() {
+		var token Session
+
+		err := rows.Scan(
+			&token.ID,
+			&token.Scope,
+			&token.CreatedAt,
+			&token.LastUsedAt,
+			&token.Expiry,
+			&token.UserAgent,
+			&token.IP,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, &token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// Touch records that the token matching the given plaintext has just been used, along with the
+// live refresh token of its family so the session list stays accurate. To avoid a write on
+// every single request the timestamp is only refreshed once a minute.
+func (m TokenModel) Touch(tokenPlaintext string) error {
+	query := `
+		UPDATE tokens
+		SET last_used_at = NOW()
+		WHERE (hash = $1 OR (family = (SELECT family FROM tokens WHERE hash = $1) AND used_at IS NULL))
+			AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+		`
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:])
+	return err
+}
+
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
 	// Create a Token instance containing the user ID, expiry, and scope information.
 	// Notice that we add the provided ttl (time-to-live) duration parameter to the
@@ -122,6 +525,29 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 	return token, nil
 }
 
+// generateFamily returns a random identifier that links the tokens issued for one login session.
+func generateFamily() (string, error) {
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(randomBytes), nil
+}
+
+// ValidSessionID reports whether id has the form of a session id, i.e. a token family generated
+// by generateFamily.
+func ValidSessionID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(tokenPlaintext != "", "token", "must be provided")
 	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
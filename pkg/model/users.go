@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"log"
 	"time"
 
@@ -26,15 +27,28 @@ type User struct {
 	CreatedAt time.Time `json:"created_at"`
 	Name      string    `json:"name"`
 	Email     string    `json:"email"`
+	Phone     string    `json:"phone"`
+	Location  string    `json:"location"`
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
 	Version   int       `json:"-"`
+
+	// ActivatedAt is when the user first activated their account. It stays set if the account
+	// is deactivated later.
+	ActivatedAt *time.Time `json:"-"`
 }
 
 func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
+// Deactivated reports whether the user activated their account once but it has been deactivated
+// since, by an administrator or because the account was deleted. Such accounts can only be
+// reactivated by an administrator.
+func (u *User) Deactivated() bool {
+	return !u.Activated && u.ActivatedAt != nil
+}
+
 // UserModel struct wraps a sql.DB connection pool and allows us to work with the User struct type
 // and the users table in our database.
 type UserModel struct {
@@ -87,8 +101,8 @@ func (p *password) Matches(plaintextPassword string) (bool, error) {
 // if our table already contains the same email address and if so return ErrDuplicateEmail error.
 func (m UserModel) Insert(user *User) error {
 	query := `
-		INSERT INTO users (name, email, password_hash, activated)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO users (name, email, password_hash, activated, activated_at)
+		VALUES ($1, $2, $3, $4, CASE WHEN $4 THEN NOW() END)
 		RETURNING id, created_at, version
 		`
 
@@ -115,12 +129,138 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+// Get retrieves the User details from the database based on the user's id. If no matching
+// record is found an ErrRecordNotFound error is returned.
+func (m UserModel) Get(id int64) (*User, error) {
+	query := `
+		SELECT id, created_at, name, email, phone, location, password_hash, activated, version, activated_at
+		FROM users
+		WHERE id = $1
+		`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Phone,
+		&user.Location,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.ActivatedAt,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// UserFilter holds the optional search criteria for listing users. Empty strings, a nil
+// Activated and zero times mean "don't filter on this".
+type UserFilter struct {
+	Email         string
+	Name          string
+	Activated     *bool
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+// GetAll returns a paginated list of users matching the filter. Email and name are matched as
+// case-insensitive substrings.
+func (m UserModel) GetAll(filter UserFilter, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, name, email, phone, location, password_hash, activated, version
+		FROM users
+		WHERE (email ILIKE '%%' || $1::text || '%%' OR $1 = '')
+		AND (name ILIKE '%%' || $2::text || '%%' OR $2 = '')
+		AND (activated = $3::boolean OR $3 IS NULL)
+		AND (created_at >= $4::timestamptz OR $4 IS NULL)
+		AND (created_at < $5::timestamptz OR $5 IS NULL)
+		ORDER BY %s %s, id ASC
+		LIMIT $6 OFFSET $7
+		`, filters.sortColumn(), filters.sortDirection())
+
+	args := []interface{}{
+		filter.Email,
+		filter.Name,
+		filter.Activated,
+		nullTime(filter.CreatedAfter),
+		nullTime(filter.CreatedBefore),
+		filters.limit(),
+		filters.offset(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Phone,
+			&user.Location,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
+
+// nullTime converts the zero time to a SQL NULL, so it can be used for optional filters.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
 // GetByEmail retrieves the User details from the database based on the user's email address.
 // Because we have a UNIQUE constraint on the email column, this query will only return one record,
 // or none at all, upon which we return a ErrRecordNotFound error).
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-		SELECT id, created_at, name, email, password_hash, activated, version
+		SELECT id, created_at, name, email, phone, location, password_hash, activated, version, activated_at
 		FROM users
 		WHERE email = $1
 		`
@@ -135,9 +275,12 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
+		&user.Phone,
+		&user.Location,
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&user.ActivatedAt,
 	)
 
 	if err != nil {
@@ -158,14 +301,17 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 func (m UserModel) Update(user *User) error {
 	query := `
 		UPDATE users
-		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET name = $1, email = $2, phone = $3, location = $4, password_hash = $5, activated = $6,
+			activated_at = COALESCE(activated_at, CASE WHEN $6 THEN NOW() END), version = version + 1
+		WHERE id = $7 AND version = $8
 		RETURNING version
 		`
 
 	args := []interface{}{
 		user.Name,
 		user.Email,
+		user.Phone,
+		user.Location,
 		user.Password.hash,
 		user.Activated,
 		user.ID,
@@ -190,6 +336,170 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
+// SetPendingEmail records the address a user wants to change their email to. The address only
+// replaces the current one once ConfirmEmailChange is called with a valid email change token.
+func (m UserModel) SetPendingEmail(id int64, email string) error {
+	query := `
+		UPDATE users
+		SET pending_email = $1
+		WHERE id = $2
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, email, id)
+	return err
+}
+
+// ConfirmEmailChange swaps the user's email for their pending one. Like Insert and Update it
+// returns ErrDuplicateEmail if another account took the address in the meantime, and
+// ErrEditConflict if the record has changed or there is no pending address.
+func (m UserModel) ConfirmEmailChange(user *User) error {
+	query := `
+		UPDATE users
+		SET email = pending_email, pending_email = NULL, version = version + 1
+		WHERE id = $1 AND version = $2 AND pending_email IS NOT NULL
+		RETURNING email, version
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user.ID, user.Version).Scan(&user.Email, &user.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+			return ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteUnactivated deletes users who registered more than olderThan ago and never activated
+// their account. Users who were deactivated later, or who have listed cars, are kept. It returns
+// the number of deleted users.
+func (m UserModel) DeleteUnactivated(olderThan time.Duration) (int64, error) {
+	query := `
+		DELETE FROM users
+		WHERE activated_at IS NULL AND created_at < $1
+			AND NOT EXISTS (SELECT 1 FROM cars WHERE cars.userId = users.id)
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now().Add(-olderThan))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// Anonymise removes the personal data of a user while keeping the users row, so that the cars
+// they listed stay attached to a placeholder account. The password is replaced with a random one
+// and every credential, role and permission of the user is deleted.
+func (m UserModel) Anonymise(id int64) error {
+	secret, err := generateFamily()
+	if err != nil {
+		return err
+	}
+
+	var pw password
+	if err := pw.Set(secret); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users
+		SET name = 'Deleted user', email = 'deleted-' || id || '@users.invalid', phone = '',
+			location = '', pending_email = NULL, password_hash = $2, activated = false,
+			version = version + 1
+		WHERE id = $1
+		`
+
+	result, err := tx.ExecContext(ctx, query, id, pw.hash)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+
+	for _, table := range []string{"tokens", "api_keys", "mfa_recovery_codes", "user_mfa", "users_roles", "users_permissions", "data_exports"} {
+		_, err = tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE user_id = $1`, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The listings stay up, but nobody is left to show them, so no more test drives can be booked.
+	for _, table := range []string{"seller_availability", "seller_blackouts"} {
+		_, err = tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE seller_id = $1`, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Delete removes a user. Any cars the user listed are first handed over to newOwnerID; a user who
+// still owns cars can't be deleted without a new owner, so pass 0 only when CountForUser is 0.
+// Tokens, keys, roles and permissions are removed by the ON DELETE CASCADE constraints.
+func (m UserModel) Delete(id, newOwnerID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if newOwnerID != 0 {
+		_, err = tx.ExecContext(ctx, `UPDATE cars SET userId = $1 WHERE userId = $2`, newOwnerID, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+
+	return tx.Commit()
+}
+
 // GetForToken retrieves a user record from the users table for an associated token and token scope.
 func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
 	// Calculate the SHA-256 hash for the plaintext token provided by the client.
@@ -198,8 +508,8 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	query := `
 		SELECT 
-			users.id, users.created_at, users.name, users.email, 
-			users.password_hash, users.activated, users.version
+			users.id, users.created_at, users.name, users.email, users.phone, 
+			users.location, users.password_hash, users.activated, users.version, users.activated_at
 		FROM       users
         INNER JOIN tokens
 			ON users.id = tokens.user_id
@@ -228,9 +538,12 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
+		&user.Phone,
+		&user.Location,
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&user.ActivatedAt,
 	)
 	if err != nil {
 		switch {
@@ -260,6 +573,12 @@ func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
 }
 
+// ValidateContactDetails checks the optional contact details a user can add to their profile.
+func ValidateContactDetails(v *validator.Validator, user *User) {
+	v.Check(user.Phone == "" || validator.Matches(user.Phone, validator.PhoneRX), "phone", "must be a valid phone number")
+	v.Check(len(user.Location) <= 200, "location", "must not be more than 200 bytes long")
+}
+
 func ValidateUser(v *validator.Validator, user *User) {
 	// validate user.Name
 	v.Check(user.Name != "", "name", "must be provided")
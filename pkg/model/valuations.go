@@ -0,0 +1,168 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/balgabekj/go_car/pkg/money"
+	"github.com/balgabekj/go_car/pkg/valuation"
+	"github.com/lib/pq"
+)
+
+// Deal labels, given to listed cars by comparing their price with the estimated market price.
+const (
+	DealGreat = "great"
+	DealGood  = "good"
+	DealFair  = "fair"
+	DealHigh  = "high"
+)
+
+// PriceEstimate is the estimated market price of a listed car, in the currency of its price.
+type PriceEstimate struct {
+	CarID      int         `json:"-"`
+	Low        money.Money `json:"low"`
+	Value      money.Money `json:"value"`
+	High       money.Money `json:"high"`
+	Confidence float64     `json:"confidence"`
+}
+
+// GetComparables returns the priced cars of a brand, together with the priced cars of a category,
+// for valuing a car of the given model. If no category is given, the one most cars of the model
+// are listed in is used. The price of a sold car is what its completed order was paid, and
+// otherwise its asking price; either is in its own currency, and has to be converted before cars
+// can be compared.
+func (m CarModel) GetComparables(brand, model, category string) ([]valuation.Comparable, error) {
+	where := `
+		AND (LOWER(c.brand) = LOWER($1) OR c.categoryName = COALESCE(NULLIF($2, ''), (
+			SELECT categoryName
+			FROM cars
+			WHERE LOWER(brand) = LOWER($1) AND LOWER(model) = LOWER($3) AND categoryName IS NOT NULL
+			GROUP BY categoryName
+			ORDER BY count(*) DESC, categoryName
+			LIMIT 1
+		)))`
+
+	return m.comparables(3*time.Second, where, brand, category, model)
+}
+
+// GetAllComparables returns every priced car, as GetComparables does for a single model, so
+// that all listings can be valued at once. It reads the whole cars table, so it is given much
+// longer than the queries made while serving requests.
+func (m CarModel) GetAllComparables() ([]valuation.Comparable, error) {
+	return m.comparables(time.Minute, "")
+}
+
+func (m CarModel) comparables(timeout time.Duration, where string, args ...interface{}) ([]valuation.Comparable, error) {
+	query := fmt.Sprintf(`
+		SELECT c.id, c.brand, c.model, c.year, COALESCE(c.categoryName, ''), c.price, c.currency, o.price, o.currency
+		FROM cars c
+		LEFT JOIN LATERAL (
+			SELECT price, currency
+			FROM orders
+			WHERE car_id = c.id AND status = 'completed'
+			ORDER BY completed_at DESC
+			LIMIT 1
+		) o ON true
+		WHERE (c.price > 0 OR o.price IS NOT NULL)
+		%s
+		ORDER BY c.id
+		`, where)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.ErrorLog.Println(err)
+		}
+	}()
+
+	comparables := []valuation.Comparable{}
+
+	for rows.Next() {
+		var (
+			c            valuation.Comparable
+			price        int64
+			currency     string
+			sold         sql.NullInt64
+			soldCurrency sql.NullString
+		)
+
+		err := rows.Scan(&c.CarID, &c.Brand, &c.Model, &c.Year, &c.Category, &price, &currency, &sold, &soldCurrency)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Price = money.New(price, currency)
+		if sold.Valid {
+			c.Price = money.New(sold.Int64, soldCurrency.String)
+			c.Sold = true
+		}
+
+		comparables = append(comparables, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return comparables, nil
+}
+
+// ReplacePriceEstimates replaces the estimated market prices of all cars with new ones. Cars
+// without a new estimate lose their old one, and with it their deal label.
+func (m CarModel) ReplacePriceEstimates(estimates []PriceEstimate) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM car_price_estimates`)
+	if err != nil {
+		return err
+	}
+
+	var (
+		ids                 []int64
+		currencies          []string
+		lows, values, highs []int64
+		confidences         []float64
+	)
+
+	for _, e := range estimates {
+		ids = append(ids, int64(e.CarID))
+		currencies = append(currencies, e.Value.Currency.Code)
+		lows = append(lows, e.Low.Amount)
+		values = append(values, e.Value.Amount)
+		highs = append(highs, e.High.Amount)
+		confidences = append(confidences, e.Confidence)
+	}
+
+	// Cars deleted since their comparables were read are skipped by the join.
+	query := `
+		INSERT INTO car_price_estimates (car_id, currency, low, value, high, confidence)
+		SELECT e.car_id, e.currency, e.low, e.value, e.high, e.confidence
+		FROM unnest($1::integer[], $2::text[], $3::bigint[], $4::bigint[], $5::bigint[], $6::real[])
+			AS e(car_id, currency, low, value, high, confidence)
+		JOIN cars c ON c.id = e.car_id
+		`
+
+	args := []interface{}{pq.Array(ids), pq.Array(currencies), pq.Array(lows), pq.Array(values), pq.Array(highs), pq.Array(confidences)}
+
+	_, err = tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,289 @@
+// Package money represents amounts of money exactly, as a whole number of minor units (e.g.
+// cents) of an ISO 4217 currency, and converts them between currencies.
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+// Currency is an ISO 4217 currency. Exponent is the number of decimal places of its minor unit,
+// e.g. 2 for the euro (cents) and 0 for the yen.
+type Currency struct {
+	Code     string
+	Exponent int
+}
+
+// exponents holds the currencies we accept prices in. Codes missing here have to be added before
+// they can be used.
+var exponents = map[string]int{
+	"AED": 2, "AMD": 2, "AUD": 2, "AZN": 2, "BYN": 2, "CAD": 2, "CHF": 2, "CNY": 2,
+	"CZK": 2, "DKK": 2, "EUR": 2, "GBP": 2, "GEL": 2, "HKD": 2, "HUF": 2, "INR": 2,
+	"JPY": 0, "KGS": 2, "KRW": 0, "KZT": 2, "MNT": 2, "NOK": 2, "PLN": 2, "RUB": 2,
+	"SEK": 2, "TJS": 2, "TMT": 2, "TRY": 2, "UAH": 2, "USD": 2, "UZS": 2,
+}
+
+// LookupCurrency returns the currency with the given ISO 4217 code, which must be in upper case.
+// ok is false for unknown codes.
+func LookupCurrency(code string) (currency Currency, ok bool) {
+	exponent, ok := exponents[code]
+	return Currency{Code: code, Exponent: exponent}, ok
+}
+
+// Money is an exact amount in a currency. Amount is in minor units.
+type Money struct {
+	Amount   int64
+	Currency Currency
+}
+
+// New returns an amount of minor units of the currency with the given code. Unknown codes are
+// taken to have two decimal places.
+func New(amount int64, code string) Money {
+	currency, ok := LookupCurrency(code)
+	if !ok {
+		currency = Currency{Code: code, Exponent: 2}
+	}
+	return Money{Amount: amount, Currency: currency}
+}
+
+// FromFloat rounds a floating point amount to the nearest minor unit. It is only meant for
+// approximate amounts, such as statistical estimates, never for amounts that are stored or paid.
+func FromFloat(amount float64, currency Currency) Money {
+	return Money{Amount: int64(math.Round(amount * math.Pow10(currency.Exponent))), Currency: currency}
+}
+
+// maxDigits is the most digits an amount may have, which keeps it well inside an int64.
+const maxDigits = 15
+
+var amountRX = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// ErrInvalidAmount is returned by Parse for anything but a plain non-negative decimal number
+// with at most as many decimal places as the currency has.
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// Parse parses a decimal amount such as 12500 or 12500.50 in the given currency.
+func Parse(s string, currency Currency) (Money, error) {
+	amount, err := parseUnits(s, currency.Exponent)
+	if err != nil {
+		return Money{}, err
+	}
+
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+// ParseRat parses a non-negative decimal number with at most places decimal places, such as an
+// interest rate of 7.95, exactly.
+func ParseRat(s string, places int) (*big.Rat, error) {
+	units, err := parseUnits(s, places)
+	if err != nil {
+		return nil, err
+	}
+
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(places)), nil)
+	return new(big.Rat).SetFrac(big.NewInt(units), scale), nil
+}
+
+// parseUnits parses a non-negative decimal number with at most places decimal places, and
+// returns it as a whole number of units of the last place, e.g. 1250050 for 12500.50.
+func parseUnits(s string, places int) (int64, error) {
+	if !amountRX.MatchString(s) {
+		return 0, ErrInvalidAmount
+	}
+
+	whole, fraction, _ := strings.Cut(s, ".")
+	if len(fraction) > places {
+		return 0, ErrInvalidAmount
+	}
+
+	digits := strings.TrimLeft(whole, "0") + fraction + strings.Repeat("0", places-len(fraction))
+	if len(digits) > maxDigits {
+		return 0, ErrInvalidAmount
+	}
+
+	var units int64
+	for _, c := range digits {
+		units = units*10 + int64(c-'0')
+	}
+
+	return units, nil
+}
+
+// Decimal formats the amount as a decimal number with the currency's number of decimal places,
+// e.g. 12500.50.
+func (m Money) Decimal() string {
+	return m.Rat().FloatString(m.Currency.Exponent)
+}
+
+// String formats the amount followed by the currency code, e.g. 12500.50 EUR.
+func (m Money) String() string {
+	return fmt.Sprintf("%s %s", m.Decimal(), m.Currency.Code)
+}
+
+// Float64 returns the amount as a float. It is only meant for approximate calculations, such as
+// statistical estimates.
+func (m Money) Float64() float64 {
+	f, _ := m.Rat().Float64()
+	return f
+}
+
+// Rat returns the amount in major units as a rational number.
+func (m Money) Rat() *big.Rat {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(m.Currency.Exponent)), nil)
+	return new(big.Rat).SetFrac(big.NewInt(m.Amount), scale)
+}
+
+// FromRat rounds an amount in major units to the nearest minor unit of the currency, with halves
+// rounded away from zero.
+func FromRat(amount *big.Rat, currency Currency) Money {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(currency.Exponent)), nil)
+
+	x := new(big.Rat).Mul(amount, new(big.Rat).SetInt(scale))
+
+	return Money{Amount: round(x), Currency: currency}
+}
+
+// Convert converts the amount to another currency. Rate is the price of one unit of m's
+// currency in the other currency. The result is rounded to the nearest minor unit, with halves
+// rounded away from zero.
+func (m Money) Convert(to Currency, rate *big.Rat) Money {
+	return FromRat(new(big.Rat).Mul(m.Rat(), rate), to)
+}
+
+// Mul multiplies the amount by x, e.g. a percentage given by Percent.Rat. Like Convert, it rounds
+// the result to the nearest minor unit, with halves rounded away from zero.
+func (m Money) Mul(x *big.Rat) Money {
+	y := new(big.Rat).Mul(new(big.Rat).SetInt64(m.Amount), x)
+	return Money{Amount: round(y), Currency: m.Currency}
+}
+
+// round rounds x to the nearest whole number, with halves rounded away from zero.
+func round(x *big.Rat) int64 {
+	num := new(big.Int).Abs(x.Num())
+	num.Mul(num, big.NewInt(2))
+	num.Add(num, x.Denom())
+
+	n := num.Quo(num, new(big.Int).Mul(x.Denom(), big.NewInt(2)))
+	if x.Sign() < 0 {
+		n.Neg(n)
+	}
+
+	return n.Int64()
+}
+
+// Percent is a percentage held exactly, in basis points (hundredths of a percent): 1250 is
+// 12.5%. Rates such as taxes and deposits are percentages, and applying them as floats could be
+// off by a minor unit.
+type Percent int64
+
+// ParsePercent parses a non-negative percentage with at most two decimal places, such as 12 or
+// 12.5, without the percent sign.
+func ParsePercent(s string) (Percent, error) {
+	basisPoints, err := parseUnits(s, 2)
+	if err != nil {
+		return 0, err
+	}
+	return Percent(basisPoints), nil
+}
+
+// Rat returns the percentage as a fraction, e.g. 1/8 for 12.5%.
+func (p Percent) Rat() *big.Rat {
+	return big.NewRat(int64(p), 10000)
+}
+
+// String formats the percentage without the percent sign or trailing zeros, e.g. 12.5.
+func (p Percent) String() string {
+	s := big.NewRat(int64(p), 100).FloatString(2)
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
+
+// MarshalJSON writes the percentage as a number, e.g. 12.5.
+func (p Percent) MarshalJSON() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalJSON reads a percentage written by MarshalJSON.
+func (p *Percent) UnmarshalJSON(data []byte) error {
+	var n json.Number
+
+	err := json.Unmarshal(data, &n)
+	if err != nil {
+		return err
+	}
+
+	*p, err = ParsePercent(n.String())
+	if err != nil {
+		return fmt.Errorf("money: invalid percentage %q", n)
+	}
+
+	return nil
+}
+
+// MarshalJSON writes the amount as an object holding the amount as an exact decimal number and
+// the currency code, e.g. {"amount":12500.50,"currency":"EUR"}.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   json.Number `json:"amount"`
+		Currency string      `json:"currency"`
+	}{json.Number(m.Decimal()), m.Currency.Code})
+}
+
+// UnmarshalJSON reads an amount written by MarshalJSON. The currency must be a known one, and
+// the amount must not have more decimal places than it has.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Amount   json.Number `json:"amount"`
+		Currency string      `json:"currency"`
+	}
+
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+
+	currency, ok := LookupCurrency(v.Currency)
+	if !ok {
+		return fmt.Errorf("money: unsupported currency %q", v.Currency)
+	}
+
+	amount, negative := strings.CutPrefix(v.Amount.String(), "-")
+
+	parsed, err := Parse(amount, currency)
+	if err != nil {
+		return fmt.Errorf("money: %w %q", err, v.Amount)
+	}
+
+	if negative {
+		parsed.Amount = -parsed.Amount
+	}
+
+	*m = parsed
+	return nil
+}
+
+// Rates holds exchange rates against a common base currency: the price of one unit of the base
+// in each currency, keyed by currency code.
+type Rates map[string]*big.Rat
+
+// Convert converts an amount to another currency. ok is false if either currency has no rate.
+func (r Rates) Convert(m Money, to Currency) (converted Money, ok bool) {
+	if m.Currency.Code == to.Code {
+		return m, true
+	}
+
+	from, ok := r[m.Currency.Code]
+	if !ok {
+		return Money{}, false
+	}
+
+	rate, ok := r[to.Code]
+	if !ok {
+		return Money{}, false
+	}
+
+	return m.Convert(to, new(big.Rat).Quo(rate, from)), true
+}
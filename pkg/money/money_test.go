@@ -0,0 +1,337 @@
+package money
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+)
+
+var (
+	eur = Currency{Code: "EUR", Exponent: 2}
+	jpy = Currency{Code: "JPY", Exponent: 0}
+	kzt = Currency{Code: "KZT", Exponent: 2}
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in       string
+		currency Currency
+		want     int64
+		wantErr  bool
+	}{
+		{in: "12500", currency: eur, want: 1250000},
+		{in: "12500.5", currency: eur, want: 1250050},
+		{in: "12500.50", currency: eur, want: 1250050},
+		{in: "0.01", currency: eur, want: 1},
+		{in: "0", currency: eur, want: 0},
+		{in: "007.10", currency: eur, want: 710},
+		{in: "1500000", currency: jpy, want: 1500000},
+		{in: "9999999999999", currency: eur, want: 999999999999900},
+		{in: "10000000000000", currency: eur, wantErr: true},
+		{in: "999999999999999", currency: jpy, want: 999999999999999},
+		{in: "1000000000000000", currency: jpy, wantErr: true},
+		{in: "12500.505", currency: eur, wantErr: true},
+		{in: "12500.5", currency: jpy, wantErr: true},
+		{in: "-1", currency: eur, wantErr: true},
+		{in: "+1", currency: eur, wantErr: true},
+		{in: "1e3", currency: eur, wantErr: true},
+		{in: "1.", currency: eur, wantErr: true},
+		{in: ".5", currency: eur, wantErr: true},
+		{in: "1 000", currency: eur, wantErr: true},
+		{in: "", currency: eur, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		m, err := Parse(tt.in, tt.currency)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Parse(%q, %s) = %s, want error", tt.in, tt.currency.Code, m)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Parse(%q, %s): %v", tt.in, tt.currency.Code, err)
+			continue
+		}
+
+		if m.Amount != tt.want || m.Currency != tt.currency {
+			t.Errorf("Parse(%q, %s) = %d %s, want %d %s", tt.in, tt.currency.Code, m.Amount, m.Currency.Code, tt.want, tt.currency.Code)
+		}
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{m: Money{Amount: 1250050, Currency: eur}, want: "12500.50"},
+		{m: Money{Amount: 5, Currency: eur}, want: "0.05"},
+		{m: Money{Amount: -150, Currency: eur}, want: "-1.50"},
+		{m: Money{Amount: 1500000, Currency: jpy}, want: "1500000"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.m.Decimal(); got != tt.want {
+			t.Errorf("%d %s: Decimal() = %s, want %s", tt.m.Amount, tt.m.Currency.Code, got, tt.want)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name string
+		m    Money
+		to   Currency
+		rate *big.Rat
+		want int64
+	}{
+		{name: "exact", m: Money{Amount: 10000, Currency: eur}, to: kzt, rate: big.NewRat(500, 1), want: 5000000},
+		{name: "rounded down", m: Money{Amount: 100, Currency: eur}, to: kzt, rate: big.NewRat(1, 3), want: 33},
+		{name: "rounded up", m: Money{Amount: 200, Currency: eur}, to: kzt, rate: big.NewRat(1, 3), want: 67},
+		{name: "half away from zero", m: Money{Amount: 1, Currency: eur}, to: kzt, rate: big.NewRat(1, 2), want: 1},
+		{name: "negative half away from zero", m: Money{Amount: -1, Currency: eur}, to: kzt, rate: big.NewRat(1, 2), want: -1},
+		{name: "to a currency without minor units", m: Money{Amount: 1050, Currency: eur}, to: jpy, rate: big.NewRat(160, 1), want: 1680},
+		{name: "half yen", m: Money{Amount: 1, Currency: eur}, to: jpy, rate: big.NewRat(50, 1), want: 1},
+		{name: "from a currency without minor units", m: Money{Amount: 1000, Currency: jpy}, to: eur, rate: big.NewRat(1, 160), want: 625},
+	}
+
+	for _, tt := range tests {
+		got := tt.m.Convert(tt.to, tt.rate)
+		if got.Amount != tt.want || got.Currency != tt.to {
+			t.Errorf("%s: Convert() = %d %s, want %d %s", tt.name, got.Amount, got.Currency.Code, tt.want, tt.to.Code)
+		}
+	}
+}
+
+func TestRatesConvert(t *testing.T) {
+	rates := Rates{
+		"EUR": big.NewRat(1, 1),
+		"KZT": big.NewRat(500, 1),
+		"JPY": big.NewRat(160, 1),
+	}
+
+	tests := []struct {
+		name   string
+		m      Money
+		to     Currency
+		want   int64
+		wantOK bool
+	}{
+		{name: "same currency", m: Money{Amount: 123, Currency: eur}, to: eur, want: 123, wantOK: true},
+		{name: "from the base", m: Money{Amount: 100, Currency: eur}, to: kzt, want: 50000, wantOK: true},
+		{name: "to the base", m: Money{Amount: 50000, Currency: kzt}, to: eur, want: 100, wantOK: true},
+		{name: "cross rate", m: Money{Amount: 1600, Currency: jpy}, to: kzt, want: 500000, wantOK: true},
+		{name: "missing source rate", m: Money{Amount: 100, Currency: Currency{Code: "USD", Exponent: 2}}, to: eur},
+		{name: "missing target rate", m: Money{Amount: 100, Currency: eur}, to: Currency{Code: "USD", Exponent: 2}},
+	}
+
+	for _, tt := range tests {
+		got, ok := rates.Convert(tt.m, tt.to)
+		if ok != tt.wantOK {
+			t.Errorf("%s: ok = %t, want %t", tt.name, ok, tt.wantOK)
+			continue
+		}
+
+		if ok && (got.Amount != tt.want || got.Currency != tt.to) {
+			t.Errorf("%s: Convert() = %d %s, want %d %s", tt.name, got.Amount, got.Currency.Code, tt.want, tt.to.Code)
+		}
+	}
+}
+
+func TestLookupCurrency(t *testing.T) {
+	tests := []struct {
+		code         string
+		wantExponent int
+		wantOK       bool
+	}{
+		{code: "EUR", wantExponent: 2, wantOK: true},
+		{code: "KZT", wantExponent: 2, wantOK: true},
+		{code: "JPY", wantExponent: 0, wantOK: true},
+		{code: "KRW", wantExponent: 0, wantOK: true},
+		{code: "eur"},
+		{code: "XXX"},
+		{code: ""},
+	}
+
+	for _, tt := range tests {
+		c, ok := LookupCurrency(tt.code)
+		if ok != tt.wantOK || (ok && c.Exponent != tt.wantExponent) {
+			t.Errorf("LookupCurrency(%q) = %+v, %t, want exponent %d, %t", tt.code, c, ok, tt.wantExponent, tt.wantOK)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{m: Money{Amount: 1250050, Currency: eur}, want: `{"amount":12500.50,"currency":"EUR"}`},
+		{m: Money{Amount: -150, Currency: kzt}, want: `{"amount":-1.50,"currency":"KZT"}`},
+		{m: Money{Amount: 1500000, Currency: jpy}, want: `{"amount":1500000,"currency":"JPY"}`},
+	}
+
+	for _, tt := range tests {
+		js, err := json.Marshal(tt.m)
+		if err != nil {
+			t.Errorf("Marshal(%s): %v", tt.m, err)
+			continue
+		}
+
+		if string(js) != tt.want {
+			t.Errorf("Marshal(%s) = %s, want %s", tt.m, js, tt.want)
+		}
+
+		var got Money
+		err = json.Unmarshal(js, &got)
+		if err != nil {
+			t.Errorf("Unmarshal(%s): %v", js, err)
+			continue
+		}
+
+		if got != tt.m {
+			t.Errorf("Unmarshal(%s) = %s, want %s", js, got, tt.m)
+		}
+	}
+}
+
+func TestUnmarshalJSONErrors(t *testing.T) {
+	tests := []string{
+		`{"amount":1,"currency":"XXX"}`,
+		`{"amount":1.5,"currency":"JPY"}`,
+		`{"amount":1.505,"currency":"EUR"}`,
+		`{"amount":1e3,"currency":"EUR"}`,
+		`12.50`,
+	}
+
+	for _, in := range tests {
+		var m Money
+		if err := json.Unmarshal([]byte(in), &m); err == nil {
+			t.Errorf("Unmarshal(%s) = %s, want error", in, m)
+		}
+	}
+}
+
+func TestMul(t *testing.T) {
+	tests := []struct {
+		name string
+		m    Money
+		x    *big.Rat
+		want int64
+	}{
+		{name: "exact", m: Money{Amount: 1500000, Currency: kzt}, x: big.NewRat(1, 10), want: 150000},
+		{name: "half away from zero", m: Money{Amount: 1500, Currency: eur}, x: big.NewRat(23, 1000), want: 35},
+		{name: "negative half away from zero", m: Money{Amount: -1500, Currency: eur}, x: big.NewRat(23, 1000), want: -35},
+		{name: "rounded down", m: Money{Amount: 1000, Currency: eur}, x: big.NewRat(1, 3), want: 333},
+		{name: "beyond float precision", m: Money{Amount: 999999999999999, Currency: jpy}, x: big.NewRat(1, 10), want: 100000000000000},
+	}
+
+	for _, tt := range tests {
+		got := tt.m.Mul(tt.x)
+		if got.Amount != tt.want || got.Currency != tt.m.Currency {
+			t.Errorf("%s: Mul() = %d %s, want %d %s", tt.name, got.Amount, got.Currency.Code, tt.want, tt.m.Currency.Code)
+		}
+	}
+}
+
+func TestParsePercent(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Percent
+		wantStr string
+		wantErr bool
+	}{
+		{in: "12", want: 1200, wantStr: "12"},
+		{in: "12.5", want: 1250, wantStr: "12.5"},
+		{in: "11.68", want: 1168, wantStr: "11.68"},
+		{in: "0", want: 0, wantStr: "0"},
+		{in: "0.05", want: 5, wantStr: "0.05"},
+		{in: "100", want: 10000, wantStr: "100"},
+		{in: "12.345", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "12%", wantErr: true},
+		{in: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		p, err := ParsePercent(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParsePercent(%q) = %s, want error", tt.in, p)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParsePercent(%q): %v", tt.in, err)
+			continue
+		}
+
+		if p != tt.want || p.String() != tt.wantStr {
+			t.Errorf("ParsePercent(%q) = %d (%s), want %d (%s)", tt.in, p, p, tt.want, tt.wantStr)
+		}
+	}
+}
+
+func TestFromRat(t *testing.T) {
+	tests := []struct {
+		r        *big.Rat
+		currency Currency
+		want     int64
+	}{
+		{r: big.NewRat(1005, 1000), currency: eur, want: 101},
+		{r: big.NewRat(-1005, 1000), currency: eur, want: -101},
+		{r: big.NewRat(2344, 1000), currency: eur, want: 234},
+		{r: big.NewRat(1, 3), currency: eur, want: 33},
+		{r: big.NewRat(2, 3), currency: eur, want: 67},
+		{r: big.NewRat(5, 10), currency: jpy, want: 1},
+		{r: big.NewRat(-5, 10), currency: jpy, want: -1},
+		{r: big.NewRat(386656, 1000), currency: jpy, want: 387},
+	}
+
+	for _, tt := range tests {
+		got := FromRat(tt.r, tt.currency)
+		if got.Amount != tt.want || got.Currency != tt.currency {
+			t.Errorf("FromRat(%s, %s) = %d %s, want %d %s", tt.r, tt.currency.Code, got.Amount, got.Currency.Code, tt.want, tt.currency.Code)
+		}
+	}
+}
+
+func TestParseRat(t *testing.T) {
+	tests := []struct {
+		in      string
+		places  int
+		want    *big.Rat
+		wantErr bool
+	}{
+		{in: "7.9", places: 4, want: big.NewRat(79, 10)},
+		{in: "4.1255", places: 4, want: big.NewRat(41255, 10000)},
+		{in: "100", places: 4, want: big.NewRat(100, 1)},
+		{in: "0", places: 4, want: new(big.Rat)},
+		{in: "4.12555", places: 4, wantErr: true},
+		{in: "-1", places: 4, wantErr: true},
+		{in: "1e2", places: 4, wantErr: true},
+		{in: "", places: 4, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		r, err := ParseRat(tt.in, tt.places)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseRat(%q, %d) = %s, want error", tt.in, tt.places, r)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseRat(%q, %d): %v", tt.in, tt.places, err)
+			continue
+		}
+
+		if r.Cmp(tt.want) != 0 {
+			t.Errorf("ParseRat(%q, %d) = %s, want %s", tt.in, tt.places, r, tt.want)
+		}
+	}
+}
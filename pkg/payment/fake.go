@@ -0,0 +1,150 @@
+package payment
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// FakeSignatureHeader carries the signature of webhook requests from the Fake provider: the hex
+// encoded HMAC-SHA256 of the request body, keyed with the webhook secret.
+const FakeSignatureHeader = "Fake-Signature"
+
+// Fake is an in-process Provider for development and tests. Nothing is ever charged: payments
+// stay pending until Complete is called, which produces the signed webhook event a real provider
+// would send once the customer had paid (or failed to).
+type Fake struct {
+	secret []byte
+
+	mu       sync.Mutex
+	payments map[string]*Payment
+	keys     map[string]string
+}
+
+// NewFake returns a Fake provider which signs its webhook events with the given secret.
+func NewFake(secret string) *Fake {
+	return &Fake{
+		secret:   []byte(secret),
+		payments: make(map[string]*Payment),
+		keys:     make(map[string]string),
+	}
+}
+
+// Name implements Provider.
+func (f *Fake) Name() string {
+	return "fake"
+}
+
+// CreatePayment implements Provider. The checkout URL points to the development endpoint which
+// completes the payment.
+func (f *Fake) CreatePayment(ctx context.Context, req Request) (*Payment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if id, ok := f.keys[req.IdempotencyKey]; ok {
+		p := *f.payments[id]
+		return &p, nil
+	}
+
+	id, err := randomID("pay_")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Payment{
+		ID:          id,
+		Status:      StatusPending,
+		CheckoutURL: "/api/v1/payments/fake/" + id,
+	}
+
+	f.payments[id] = p
+	if req.IdempotencyKey != "" {
+		f.keys[req.IdempotencyKey] = id
+	}
+
+	result := *p
+	return &result, nil
+}
+
+// ParseWebhook implements Provider.
+func (f *Fake) ParseWebhook(r *http.Request) (*Event, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := hex.DecodeString(r.Header.Get(FakeSignatureHeader))
+	if err != nil || !hmac.Equal(signature, f.sign(body)) {
+		return nil, ErrInvalidSignature
+	}
+
+	var event Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+// Complete finishes a pending payment with the given status, succeeded or failed, and returns
+// the webhook request announcing it. The request still has to be delivered to the webhook
+// handler.
+func (f *Fake) Complete(ctx context.Context, paymentID, status, webhookURL string) (*http.Request, error) {
+	if status != StatusSucceeded && status != StatusFailed {
+		return nil, fmt.Errorf("payment: invalid status %q", status)
+	}
+
+	f.mu.Lock()
+	p, ok := f.payments[paymentID]
+	if ok && p.Status == StatusPending {
+		p.Status = status
+	}
+	f.mu.Unlock()
+
+	if !ok {
+		return nil, errors.New("payment: unknown payment")
+	}
+
+	id, err := randomID("evt_")
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(Event{ID: id, PaymentID: paymentID, Status: p.Status})
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(FakeSignatureHeader, hex.EncodeToString(f.sign(body)))
+
+	return r, nil
+}
+
+func (f *Fake) sign(body []byte) []byte {
+	mac := hmac.New(sha256.New, f.secret)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func randomID(prefix string) (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
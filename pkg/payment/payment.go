@@ -0,0 +1,59 @@
+// Package payment defines the interface to payment providers. The API only talks to a Provider,
+// so that a real provider can be added next to the in-process Fake without touching the order
+// flow.
+package payment
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/balgabekj/go_car/pkg/money"
+)
+
+// Payment statuses, as reported by providers in webhook events.
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// ErrInvalidSignature is returned by ParseWebhook when a webhook request isn't signed by the
+// provider.
+var ErrInvalidSignature = errors.New("payment: invalid webhook signature")
+
+// Provider is the interface that payment providers implement.
+type Provider interface {
+	// Name identifies the provider. It is stored with each payment, so it must not change.
+	Name() string
+
+	// CreatePayment starts a payment which the customer completes at the returned CheckoutURL.
+	// Creating a payment twice with the same IdempotencyKey must return the same payment, so that
+	// a request can safely be retried.
+	CreatePayment(ctx context.Context, req Request) (*Payment, error)
+
+	// ParseWebhook verifies and decodes a status callback sent by the provider.
+	ParseWebhook(r *http.Request) (*Event, error)
+}
+
+// Request describes a payment to be made.
+type Request struct {
+	IdempotencyKey string
+	Amount         money.Money
+	Description    string
+}
+
+// Payment is a payment as created by a provider.
+type Payment struct {
+	ID          string
+	Status      string
+	CheckoutURL string
+}
+
+// Event is a change in the status of a payment. Providers may deliver an event more than once,
+// and in any order, so its ID has to be used to detect repeats.
+type Event struct {
+	ID        string `json:"id"`
+	PaymentID string `json:"payment_id"`
+	Status    string `json:"status"`
+}
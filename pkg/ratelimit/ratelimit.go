@@ -0,0 +1,170 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit describes a token bucket: it refills at Rate tokens per second and holds at most Burst
+// tokens.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Result is the outcome of taking a token from a bucket.
+type Result struct {
+	Allowed bool
+
+	// Limit is the bucket size and Remaining the number of whole tokens left after this request.
+	Limit     int
+	Remaining int
+
+	// RetryAfter is how long to wait before a token will be available again. It is only set when
+	// the request was not allowed. Reset is how long until the bucket is completely full again.
+	RetryAfter time.Duration
+	Reset      time.Duration
+}
+
+// Store keeps the state of the rate limit buckets. The in-process MemoryStore is the only
+// implementation for now; the interface exists so a shared backend (e.g. Redis) can be dropped
+// in when the API runs on more than one instance.
+type Store interface {
+	// Take removes a token from the bucket for key, creating a full bucket if there isn't one.
+	Take(key string, limit Limit) (Result, error)
+
+	// Sweep forgets buckets that haven't been used for longer than idle.
+	Sweep(idle time.Duration) error
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// MemoryStore is a Store that keeps buckets in a map guarded by a mutex.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Take implements Store.
+func (s *MemoryStore) Take(key string, limit Limit) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	burst := float64(limit.Burst)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		s.buckets[key] = b
+	}
+
+	// Refill the bucket for the time that passed since it was last used.
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	res := Result{Limit: limit.Burst}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else if limit.Rate > 0 {
+		res.RetryAfter = seconds((1 - b.tokens) / limit.Rate)
+	}
+
+	res.Remaining = int(b.tokens)
+	if limit.Rate > 0 {
+		res.Reset = seconds((burst - b.tokens) / limit.Rate)
+	}
+
+	return res, nil
+}
+
+// Sweep implements Store.
+func (s *MemoryStore) Sweep(idle time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := s.now().Add(-idle)
+
+	for key, b := range s.buckets {
+		if b.last.Before(cutoff) {
+			delete(s.buckets, key)
+		}
+	}
+
+	return nil
+}
+
+// FillTime returns how long an empty bucket takes to fill up completely. A bucket which hasn't
+// been used for that long is the same as a new one, so it can be forgotten. It returns false for
+// limits which never refill.
+func (l Limit) FillTime() (time.Duration, bool) {
+	if l.Rate <= 0 {
+		return 0, false
+	}
+
+	return seconds(float64(l.Burst) / l.Rate), true
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// ParseLimits parses a comma-separated list of group=rate:burst pairs, such as
+// "default=4:8,tokens=0.2:5", into a map of limits keyed by route group.
+func ParseLimits(spec string) (map[string]Limit, error) {
+	limits := make(map[string]Limit)
+
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		group, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit %q, expected group=rate:burst", pair)
+		}
+
+		rate, burst, ok := strings.Cut(value, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit %q, expected group=rate:burst", pair)
+		}
+
+		var (
+			limit Limit
+			err   error
+		)
+
+		limit.Rate, err = strconv.ParseFloat(rate, 64)
+		if err != nil || limit.Rate < 0 {
+			return nil, fmt.Errorf("invalid rate for group %q", group)
+		}
+
+		limit.Burst, err = strconv.Atoi(burst)
+		if err != nil || limit.Burst < 1 {
+			return nil, fmt.Errorf("invalid burst for group %q", group)
+		}
+
+		limits[group] = limit
+	}
+
+	return limits, nil
+}
@@ -6,6 +6,10 @@ var (
 	// EmailRX is a regex for sanity checking the format of email addresses.
 	// The regex pattern used is taken from  https://html.spec.whatwg.org/#valid-e-mail-address.
 	EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
+
+	// PhoneRX is a loose regex for phone numbers: an optional leading +, followed by 6 to 20
+	// digits, spaces, dashes or brackets.
+	PhoneRX = regexp.MustCompile(`^\+?[0-9 ()-]{6,20}$`)
 )
 
 // Validator struct type contains a map of validation errors.
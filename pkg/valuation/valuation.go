@@ -0,0 +1,390 @@
+// Package valuation estimates what a car is worth from comparable cars on the marketplace:
+// listings of the same model, and what such cars actually sold for.
+//
+// Comparables are first brought to the age of the car being valued using a depreciation curve
+// fitted to the marketplace data, then outliers are trimmed, and the rest are averaged with more
+// weight given to closer matches and to real sale prices. Mileage and condition aren't recorded
+// for listings, so they adjust the estimate afterwards instead of narrowing the comparables.
+package valuation
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/balgabekj/go_car/pkg/money"
+)
+
+// Conditions of a car, from best to worst.
+const (
+	ConditionExcellent = "excellent"
+	ConditionGood      = "good"
+	ConditionFair      = "fair"
+	ConditionPoor      = "poor"
+)
+
+// Conditions lists the valid conditions.
+var Conditions = []string{ConditionExcellent, ConditionGood, ConditionFair, ConditionPoor}
+
+// conditionFactors adjust the estimate, which is for a car in good condition.
+var conditionFactors = map[string]float64{
+	ConditionExcellent: 1.05,
+	ConditionGood:      1,
+	ConditionFair:      0.9,
+	ConditionPoor:      0.75,
+}
+
+// Tuning of the estimate.
+const (
+	// defaultDepreciation is the yearly loss of value used when the data doesn't have enough
+	// cars of different ages to fit a curve.
+	defaultDepreciation = 0.15
+	minDepreciation     = 0.02
+	maxDepreciation     = 0.35
+
+	// minCurvePoints is the least number of cars a depreciation curve is fitted to.
+	minCurvePoints = 4
+
+	// maxYearGap is the largest difference in model year for a car to count as comparable.
+	maxYearGap = 8
+
+	// minModelComparables is how many cars of the same model are wanted before cars of other
+	// models of the brand are left out.
+	minModelComparables = 3
+
+	// MinComparables is the least number of comparables an estimate is made from.
+	MinComparables = 2
+
+	// listingDiscount brings asking prices in line with sale prices, which tend to be lower.
+	listingDiscount = 0.95
+
+	// outlierMADs is how many (scaled) median absolute deviations from the median an adjusted
+	// price may be before it is trimmed.
+	outlierMADs = 2.5
+
+	// yearlyMileage is the distance a car is assumed to be driven each year, in kilometres.
+	yearlyMileage = 15000
+)
+
+// ErrNotEnoughData is returned when there are too few comparables to estimate a value.
+var ErrNotEnoughData = errors.New("not enough comparable cars")
+
+// Comparable is a car whose price is used in an estimate. Price is the asking price, or the sale
+// price if Sold is set, converted to the currency of the estimate. Adjusted and Weight are set by
+// Estimate: Adjusted is the price brought to the age and kind of sale of the car being valued.
+type Comparable struct {
+	CarID    int         `json:"car_id"`
+	Brand    string      `json:"brand"`
+	Model    string      `json:"model"`
+	Year     int         `json:"year"`
+	Category string      `json:"category,omitempty"`
+	Price    money.Money `json:"price"`
+	Sold     bool        `json:"sold"`
+	Adjusted money.Money `json:"adjusted_price"`
+	Weight   float64     `json:"weight"`
+}
+
+// Subject is the car being valued. Mileage, in kilometres, and Condition are optional; without
+// them the estimate is for a car with average mileage in good condition. Category is used to fit
+// a depreciation curve when the brand alone has too little data; if it isn't given, the category
+// most cars of the model are listed in is used. ExcludeCarID leaves a listed car out of its own
+// comparables.
+type Subject struct {
+	Brand        string
+	Model        string
+	Year         int
+	Category     string
+	Mileage      *int
+	Condition    string
+	ExcludeCarID int
+}
+
+// Depreciation describes the curve comparables were adjusted with: Rate is the fraction of its
+// value a car loses each year, and Source is what it was fitted to: the brand, the category or,
+// if neither had enough data, nothing (default).
+type Depreciation struct {
+	Rate   float64 `json:"annual_rate"`
+	Source string  `json:"source"`
+}
+
+// Result is an estimate. Value is the most likely price, and Low and High bound the range the
+// price is likely to be in. Confidence runs from 0 to 1 and reflects how many comparables there
+// were, how closely they match and how much they agree.
+type Result struct {
+	Low          money.Money  `json:"low"`
+	Value        money.Money  `json:"value"`
+	High         money.Money  `json:"high"`
+	Confidence   float64      `json:"confidence"`
+	Depreciation Depreciation `json:"depreciation"`
+	Adjustments  Adjustments  `json:"adjustments"`
+	Outliers     int          `json:"outliers_trimmed"`
+	Comparables  []Comparable `json:"comparables"`
+}
+
+// Adjustments are the factors the estimate was multiplied by for mileage and condition.
+type Adjustments struct {
+	Mileage   float64 `json:"mileage"`
+	Condition float64 `json:"condition"`
+}
+
+// Estimate values the subject in the given currency from the comparables, whose prices must
+// already be in that currency. Year is the current year. If fewer than MinComparables cars are
+// comparable, an ErrNotEnoughData error is returned.
+func Estimate(subject Subject, comparables []Comparable, currency money.Currency, year int) (*Result, error) {
+	if subject.Category == "" {
+		subject.Category = ModelCategory(subject, comparables)
+	}
+
+	var brand, category, models, others []Comparable
+
+	for _, c := range comparables {
+		if c.CarID == subject.ExcludeCarID || c.Price.Amount <= 0 {
+			continue
+		}
+
+		sameBrand := strings.EqualFold(c.Brand, subject.Brand)
+
+		if sameBrand {
+			brand = append(brand, c)
+		}
+		if subject.Category != "" && c.Category == subject.Category {
+			category = append(category, c)
+		}
+
+		if !sameBrand || abs(c.Year-subject.Year) > maxYearGap {
+			continue
+		}
+
+		if strings.EqualFold(c.Model, subject.Model) {
+			models = append(models, c)
+		} else {
+			others = append(others, c)
+		}
+	}
+
+	depreciation := Depreciation{Rate: defaultDepreciation, Source: "default"}
+	if rate, ok := fitDepreciation(brand, year); ok {
+		depreciation = Depreciation{Rate: rate, Source: "brand"}
+	} else if rate, ok := fitDepreciation(category, year); ok {
+		depreciation = Depreciation{Rate: rate, Source: "category"}
+	}
+
+	// Other models of the brand are a poor match, so they only count, and for little, when
+	// there are too few cars of the same model.
+	candidates := models
+	if len(models) < minModelComparables {
+		candidates = append(candidates, others...)
+	}
+
+	for i := range candidates {
+		c := &candidates[i]
+
+		price := c.Price.Float64() * math.Pow(1-depreciation.Rate, float64(c.Year-subject.Year))
+		if !c.Sold {
+			price *= listingDiscount
+		}
+		c.Adjusted = round(price, currency)
+
+		c.Weight = 1 / (1 + 0.5*float64(abs(c.Year-subject.Year)))
+		if c.Sold {
+			c.Weight *= 1.5
+		}
+		if !strings.EqualFold(c.Model, subject.Model) {
+			c.Weight *= 0.25
+		}
+	}
+
+	kept := trimOutliers(candidates)
+	if len(kept) < MinComparables {
+		return nil, ErrNotEnoughData
+	}
+
+	var sum, weights, sameModel float64
+	for _, c := range kept {
+		sum += c.Weight * c.Adjusted.Float64()
+		weights += c.Weight
+		if strings.EqualFold(c.Model, subject.Model) {
+			sameModel++
+		}
+	}
+	value := sum / weights
+
+	var variance float64
+	for _, c := range kept {
+		d := c.Adjusted.Float64() - value
+		variance += c.Weight * d * d
+	}
+	cv := math.Sqrt(variance/weights) / value
+
+	adjustments := Adjustments{Mileage: 1, Condition: 1}
+	if subject.Mileage != nil {
+		expected := float64(yearlyMileage * max(year-subject.Year, 0))
+		adjustments.Mileage = 1 + clamp(-(float64(*subject.Mileage)-expected)/10000*0.02, -0.25, 0.1)
+	}
+	if factor, ok := conditionFactors[subject.Condition]; ok {
+		adjustments.Condition = factor
+	}
+
+	value *= adjustments.Mileage * adjustments.Condition
+
+	// The range follows the spread of the comparables, and is wider when there are few of them.
+	n := float64(len(kept))
+	spread := clamp(math.Max(cv, 0.05)*(1+1/math.Sqrt(n)), 0.05, 0.3)
+
+	confidence := 0.4*math.Min(n/8, 1) + 0.3*sameModel/n + 0.3*(1-math.Min(cv/0.4, 1))
+	if depreciation.Source == "default" {
+		confidence *= 0.8
+	}
+
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].Weight > kept[j].Weight })
+
+	for i := range kept {
+		kept[i].Weight = math.Round(kept[i].Weight*100) / 100
+	}
+
+	return &Result{
+		Low:          round(value*(1-spread), currency),
+		Value:        round(value, currency),
+		High:         round(value*(1+spread), currency),
+		Confidence:   math.Round(confidence*100) / 100,
+		Depreciation: Depreciation{Rate: math.Round(depreciation.Rate*1000) / 1000, Source: depreciation.Source},
+		Adjustments:  adjustments,
+		Outliers:     len(candidates) - len(kept),
+		Comparables:  kept,
+	}, nil
+}
+
+// fitDepreciation fits an exponential depreciation curve, price = p × (1 − rate)^age, to the
+// cars by regressing the log of their price on their age. Each model gets its own p, so that
+// cheap and expensive models of a brand don't distort the slope. ok is false if there are too
+// few cars, or too little spread in their ages, to fit a curve.
+func fitDepreciation(cars []Comparable, year int) (rate float64, ok bool) {
+	type group struct {
+		ages, logs []float64
+	}
+
+	groups := map[string]*group{}
+	for _, c := range cars {
+		key := strings.ToLower(c.Brand + "\x00" + c.Model)
+		if groups[key] == nil {
+			groups[key] = &group{}
+		}
+		groups[key].ages = append(groups[key].ages, float64(year-c.Year))
+		groups[key].logs = append(groups[key].logs, math.Log(c.Price.Float64()))
+	}
+
+	var sxy, sxx float64
+	points := 0
+
+	for _, g := range groups {
+		if len(g.ages) < 2 {
+			continue
+		}
+
+		meanAge, meanLog := mean(g.ages), mean(g.logs)
+		for i := range g.ages {
+			sxy += (g.ages[i] - meanAge) * (g.logs[i] - meanLog)
+			sxx += (g.ages[i] - meanAge) * (g.ages[i] - meanAge)
+		}
+		points += len(g.ages)
+	}
+
+	if points < minCurvePoints || sxx == 0 {
+		return 0, false
+	}
+
+	return clamp(1-math.Exp(sxy/sxx), minDepreciation, maxDepreciation), true
+}
+
+// ModelCategory returns the category most of the cars of the subject's model are listed in, if
+// any. Estimate uses it for subjects without a category.
+func ModelCategory(subject Subject, cars []Comparable) string {
+	counts := map[string]int{}
+	best := ""
+
+	for _, c := range cars {
+		if c.Category == "" || !strings.EqualFold(c.Brand, subject.Brand) || !strings.EqualFold(c.Model, subject.Model) {
+			continue
+		}
+
+		counts[c.Category]++
+		if counts[c.Category] > counts[best] || (counts[c.Category] == counts[best] && c.Category < best) {
+			best = c.Category
+		}
+	}
+
+	return best
+}
+
+// trimOutliers drops comparables whose adjusted price is too far from the median, measured in
+// median absolute deviations. With fewer than four comparables nothing is trimmed, as there is
+// too little to tell what is unusual.
+func trimOutliers(cars []Comparable) []Comparable {
+	if len(cars) < 4 {
+		return cars
+	}
+
+	prices := make([]float64, len(cars))
+	for i, c := range cars {
+		prices[i] = c.Adjusted.Float64()
+	}
+
+	med := median(prices)
+
+	deviations := make([]float64, len(prices))
+	for i, p := range prices {
+		deviations[i] = math.Abs(p - med)
+	}
+
+	// 1.4826 scales the MAD to the standard deviation for normally distributed prices.
+	limit := outlierMADs * 1.4826 * median(deviations)
+	if limit == 0 {
+		return cars
+	}
+
+	var kept []Comparable
+	for i, c := range cars {
+		if deviations[i] <= limit {
+			kept = append(kept, c)
+		}
+	}
+
+	return kept
+}
+
+// round converts an amount in major units to money, rounded to whole major units: estimates
+// aren't precise enough for anything finer.
+func round(amount float64, currency money.Currency) money.Money {
+	return money.FromFloat(math.Round(amount), currency)
+}
+
+func mean(xs []float64) float64 {
+	var sum float64
+	for _, x := range xs {
+		sum += x
+	}
+	return sum / float64(len(xs))
+}
+
+func median(xs []float64) float64 {
+	sorted := append([]float64(nil), xs...)
+	sort.Float64s(sorted)
+
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+func clamp(x, lo, hi float64) float64 {
+	return math.Max(lo, math.Min(hi, x))
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,205 @@
+package valuation
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/balgabekj/go_car/pkg/money"
+)
+
+var eur = money.Currency{Code: "EUR", Exponent: 2}
+
+func car(id int, model string, year int, price float64) Comparable {
+	return Comparable{CarID: id, Brand: "Toyota", Model: model, Year: year, Price: money.FromFloat(price, eur)}
+}
+
+func adjusted(prices ...float64) []Comparable {
+	cars := make([]Comparable, len(prices))
+	for i, p := range prices {
+		cars[i] = Comparable{CarID: i + 1, Adjusted: money.FromFloat(p, eur)}
+	}
+	return cars
+}
+
+func TestTrimOutliers(t *testing.T) {
+	tests := []struct {
+		name   string
+		prices []float64
+		want   []int
+	}{
+		{name: "too few to trim", prices: []float64{10000, 10500, 50000}, want: []int{1, 2, 3}},
+		{name: "one outlier", prices: []float64{10000, 10200, 9800, 10100, 50000}, want: []int{1, 2, 3, 4}},
+		{name: "outliers on both sides", prices: []float64{1000, 10000, 10200, 9800, 10100, 9900, 50000}, want: []int{2, 3, 4, 5, 6}},
+		{name: "no outliers", prices: []float64{10000, 11000, 9000, 10500}, want: []int{1, 2, 3, 4}},
+		{name: "all equal", prices: []float64{10000, 10000, 10000, 10000}, want: []int{1, 2, 3, 4}},
+		// With most prices equal the MAD is zero, which gives no scale to measure outliers by.
+		{name: "zero MAD", prices: []float64{10000, 10000, 10000, 10000, 50000}, want: []int{1, 2, 3, 4, 5}},
+	}
+
+	for _, tt := range tests {
+		kept := trimOutliers(adjusted(tt.prices...))
+
+		var got []int
+		for _, c := range kept {
+			got = append(got, c.CarID)
+		}
+
+		if !equal(got, tt.want) {
+			t.Errorf("%s: kept %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFitDepreciation(t *testing.T) {
+	const year = 2024
+
+	// curve returns cars of a model losing the given fraction of their value each year, from
+	// new in the current year.
+	curve := func(model string, price, rate float64, ages ...int) []Comparable {
+		var cars []Comparable
+		for _, age := range ages {
+			cars = append(cars, car(0, model, year-age, price*math.Pow(1-rate, float64(age))))
+		}
+		return cars
+	}
+
+	tests := []struct {
+		name   string
+		cars   []Comparable
+		want   float64
+		wantOK bool
+	}{
+		{name: "no cars"},
+		{name: "too few cars", cars: curve("Camry", 30000, 0.1, 0, 1, 2)},
+		{name: "all the same age", cars: curve("Camry", 30000, 0.1, 3, 3, 3, 3, 3)},
+		{
+			name: "one car of each model",
+			cars: append(append(curve("Camry", 30000, 0.1, 1), curve("Corolla", 20000, 0.1, 2)...),
+				append(curve("RAV4", 35000, 0.1, 3), curve("Supra", 50000, 0.1, 4)...)...),
+		},
+		{name: "one model", cars: curve("Camry", 30000, 0.1, 0, 1, 2, 5), want: 0.1, wantOK: true},
+		{
+			name:   "models at different prices",
+			cars:   append(curve("Camry", 30000, 0.12, 1, 3), curve("Land Cruiser", 90000, 0.12, 2, 6)...),
+			want:   0.12,
+			wantOK: true,
+		},
+		{name: "appreciating", cars: curve("Supra", 50000, -0.05, 10, 20, 25, 30), want: minDepreciation, wantOK: true},
+		{name: "steep", cars: curve("Camry", 30000, 0.6, 0, 1, 2, 3), want: maxDepreciation, wantOK: true},
+	}
+
+	for _, tt := range tests {
+		rate, ok := fitDepreciation(tt.cars, year)
+		if ok != tt.wantOK {
+			t.Errorf("%s: ok = %t, want %t", tt.name, ok, tt.wantOK)
+			continue
+		}
+
+		if ok && math.Abs(rate-tt.want) > 1e-4 {
+			t.Errorf("%s: rate = %.4f, want %.4f", tt.name, rate, tt.want)
+		}
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	subject := Subject{Brand: "Toyota", Model: "Camry", Year: 2020}
+
+	t.Run("not enough data", func(t *testing.T) {
+		comparables := []Comparable{
+			car(1, "Camry", 2020, 20000),
+			car(2, "Camry", 2020, 0),
+			{CarID: 3, Brand: "Honda", Model: "Accord", Year: 2020, Price: money.FromFloat(20000, eur)},
+			car(4, "Camry", 2005, 20000),
+		}
+
+		_, err := Estimate(subject, comparables, eur, 2024)
+		if !errors.Is(err, ErrNotEnoughData) {
+			t.Errorf("got error %v, want %v", err, ErrNotEnoughData)
+		}
+	})
+
+	t.Run("excluded car", func(t *testing.T) {
+		subject := subject
+		subject.ExcludeCarID = 1
+
+		comparables := []Comparable{car(1, "Camry", 2020, 20000), car(2, "Camry", 2020, 20000)}
+
+		_, err := Estimate(subject, comparables, eur, 2024)
+		if !errors.Is(err, ErrNotEnoughData) {
+			t.Errorf("got error %v, want %v", err, ErrNotEnoughData)
+		}
+	})
+
+	t.Run("same model and year", func(t *testing.T) {
+		comparables := []Comparable{
+			car(1, "Camry", 2020, 20000),
+			car(2, "Camry", 2020, 20000),
+			car(3, "Camry", 2020, 20000),
+		}
+		comparables[2].Sold = true
+		comparables[2].Price = money.FromFloat(19000, eur)
+
+		result, err := Estimate(subject, comparables, eur, 2024)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Listings are discounted to 19000, the same as the sale price.
+		if result.Value != money.FromFloat(19000, eur) {
+			t.Errorf("value = %s, want 19000.00 EUR", result.Value)
+		}
+		if result.Low.Amount >= result.Value.Amount || result.High.Amount <= result.Value.Amount {
+			t.Errorf("range %s to %s doesn't contain the value %s", result.Low, result.High, result.Value)
+		}
+		if result.Depreciation.Source != "default" {
+			t.Errorf("depreciation source = %s, want default", result.Depreciation.Source)
+		}
+		if len(result.Comparables) != 3 || result.Comparables[0].CarID != 3 {
+			t.Errorf("comparables should be ordered by weight, with the sold car first")
+		}
+	})
+
+	t.Run("adjusted for age", func(t *testing.T) {
+		comparables := []Comparable{
+			car(1, "Camry", 2024, 30000),
+			car(2, "Camry", 2023, 27000),
+			car(3, "Camry", 2022, 24300),
+			car(4, "Camry", 2021, 21870),
+		}
+		for i := range comparables {
+			comparables[i].Sold = true
+		}
+
+		result, err := Estimate(subject, comparables, eur, 2024)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.Depreciation.Source != "brand" || result.Depreciation.Rate != 0.1 {
+			t.Errorf("depreciation = %+v, want 0.1 fitted to the brand", result.Depreciation)
+		}
+
+		// Every comparable is worth 30000 × 0.9^4 = 19683 at the subject's age.
+		for _, c := range result.Comparables {
+			if c.Adjusted != money.FromFloat(19683, eur) {
+				t.Errorf("car %d adjusted to %s, want 19683.00 EUR", c.CarID, c.Adjusted)
+			}
+		}
+		if result.Value != money.FromFloat(19683, eur) {
+			t.Errorf("value = %s, want 19683.00 EUR", result.Value)
+		}
+	})
+}
+
+func equal(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
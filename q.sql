@@ -6,6 +6,6 @@ INSERT INTO category (name) VALUES
                                 ('Coupe');
 
 -- Insert sample cars
-INSERT INTO cars (model, brand, year, price, color, isUsed, userId, categoryName) VALUES
-                                                                                      ('Range Rover', 'Land Rover', 2020, 80000, 'Black', FALSE, 46, 'SUV')
+INSERT INTO cars (model, brand, year, price, currency, color, isUsed, userId, categoryName) VALUES
+                                                                                      ('Range Rover', 'Land Rover', 2020, 8000000, 'USD', 'Black', FALSE, 46, 'SUV')
 